@@ -2,17 +2,40 @@ package main
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
 
 	"github.com/cetinibs/online-speed-test-backend-root/internal/controllers"
 	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+	"github.com/cetinibs/online-speed-test-backend-root/internal/netem"
 	"github.com/cetinibs/online-speed-test-backend-root/internal/repositories"
 	"github.com/cetinibs/online-speed-test-backend-root/internal/services"
 )
 
+// shutdownTimeout is how long requests in flight may take to finish once
+// the server is asked to stop
+const shutdownTimeout = 10 * time.Second
+
 // Basit bir HTML içeriği
 const htmlContent = `
 <!DOCTYPE html>
@@ -449,8 +472,8 @@ const htmlContent = `
                         <i class="fas fa-globe"></i>
                     </div>
                     <div class="server-details">
-                        <div class="server-name">Turkcell</div>
-                        <div class="server-location">Ankara</div>
+                        <div id="server-name" class="server-name">Auto</div>
+                        <div id="server-location" class="server-location">Nearest server</div>
                         <div class="change-server" onclick="changeServer()">Change Server</div>
                     </div>
                 </div>
@@ -490,8 +513,9 @@ const htmlContent = `
                 <div class="ping-info">
                     <div class="ping-label">Ping ms</div>
                     <div class="ping-value"><i class="fas fa-bolt"></i> <span id="ping-result">16</span></div>
-                    <div class="download-value"><i class="fas fa-arrow-down" style="color:var(--download-color)"></i> <span>53</span></div>
-                    <div class="upload-value"><i class="fas fa-arrow-up" style="color:var(--upload-color)"></i> <span>64</span></div>
+                    <div class="download-value"><i class="fas fa-arrow-down" style="color:var(--download-color)"></i> <span id="download-latency-result">--</span></div>
+                    <div class="upload-value"><i class="fas fa-arrow-up" style="color:var(--upload-color)"></i> <span id="upload-latency-result">--</span></div>
+                    <div class="ping-label">Bufferbloat <span id="bufferbloat-result">--</span></div>
                 </div>
                 
                 <div class="server-info">
@@ -584,13 +608,36 @@ const htmlContent = `
             alert('Settings page will be implemented in the future.');
         }
         
+        // Selected test server ID, empty for automatic selection
+        let selectedServerId = '';
+        
         // Change server
         function changeServer() {
-            alert('Server change functionality will be implemented in the future.');
+            fetch('/api/servers')
+                .then(response => response.json())
+                .then(servers => {
+                    const lines = servers.map((entry, index) => {
+                        const rtt = entry.samples > 0 ? entry.median_rtt_ms.toFixed(1) + ' ms' : 'unreachable';
+                        return (index + 1) + '. ' + entry.server.name + ' (' + entry.server.location + ') - ' + rtt;
+                    });
+                    const choice = prompt('Select a server (leave empty for automatic):\n' + lines.join('\n'));
+                    if (choice === null) {
+                        return;
+                    }
+                    const entry = servers[parseInt(choice, 10) - 1];
+                    selectedServerId = entry ? entry.server.id : '';
+                    document.getElementById('server-name').textContent = entry ? entry.server.name : 'Auto';
+                    document.getElementById('server-location').textContent = entry ? entry.server.location : 'Nearest server';
+                })
+                .catch(() => alert('Failed to load the server list.'));
         }
         
+        // Selected connection type
+        let connectionType = 'multi';
+        
         // Set connection type
         function setConnectionType(type) {
+            connectionType = type;
             const options = document.querySelectorAll('.connection-option');
             options.forEach(option => {
                 option.classList.remove('active');
@@ -640,67 +687,82 @@ const htmlContent = `
             speedValue.style.display = 'block';
             speedUnit.style.display = 'block';
             pingDisplay.style.display = 'flex';
+            document.getElementById('ping-value').textContent = '--';
+            document.getElementById('download-indicator').textContent = '--';
+            document.getElementById('upload-indicator').textContent = '--';
+            
+            // Stream live progress from the server
+            const params = new URLSearchParams({ isMultiConnection: connectionType === 'multi' });
+            if (selectedServerId) {
+                params.set('server', selectedServerId);
+            }
+            const source = new EventSource('/api/speedtest/stream?' + params.toString());
+            
+            source.addEventListener('phase', e => {
+                const event = JSON.parse(e.data);
+                if (event.server) {
+                    document.getElementById('server-name').textContent = event.server.name;
+                    document.getElementById('server-location').textContent = event.server.location;
+                }
+                updateSpeedometer(0, event.phase);
+            });
+            
+            source.addEventListener('latency', e => {
+                const event = JSON.parse(e.data);
+                document.getElementById('ping-value').textContent = (event.ping || 0).toFixed(0);
+            });
+            
+            source.addEventListener('sample', e => {
+                const event = JSON.parse(e.data);
+                const mbps = event.mbps || 0;
+                updateSpeedometer(mbps, event.phase);
+                document.getElementById(event.phase + '-indicator').textContent = mbps.toFixed(0);
+            });
+            
+            source.addEventListener('result', e => {
+                source.close();
+                showResult(JSON.parse(e.data).result);
+            });
+            
+            source.addEventListener('test_error', e => {
+                source.close();
+                alert('Speed test failed: ' + JSON.parse(e.data).error);
+                resetTest();
+            });
             
-            // Simulate ping test
-            setTimeout(() => {
-                document.getElementById('ping-value').textContent = '18';
-                simulateSpeedometer(0, 97, 'download');
-            }, 500);
+            source.onerror = () => {
+                source.close();
+                alert('Connection to the server was lost.');
+                resetTest();
+            };
         }
         
-        // Simulate speedometer animation
-        function simulateSpeedometer(from, to, type) {
-            const speedValue = document.getElementById('speed-value');
+        // Update speedometer reading and fill
+        function updateSpeedometer(mbps, type) {
             const speedometer = document.querySelector('.speedometer-outer');
-            const duration = 3000; // 3 seconds
-            const steps = 60;
-            const increment = (to - from) / steps;
-            let current = from;
-            let step = 0;
+            const color = type === 'upload' ? 'var(--upload-color)' : 'var(--download-color)';
             
-            // Update color based on type
-            if (type === 'download') {
-                speedometer.style.background = "conic-gradient(var(--download-color) 0% " + 30 + "deg, #2c3e50 " + 30 + "deg 100%)";
-                document.getElementById('speed-unit').textContent = 'Mbps';
-                document.getElementById('download-indicator').textContent = '57';
-                document.getElementById('upload-indicator').textContent = '—';
-            } else {
-                speedometer.style.background = "conic-gradient(var(--upload-color) 0% " + 30 + "deg, #2c3e50 " + 30 + "deg 100%)";
-                document.getElementById('speed-unit').textContent = 'Mbps';
-                document.getElementById('upload-indicator').textContent = '64';
-            }
+            document.getElementById('speed-value').textContent = mbps.toFixed(2);
             
-            const interval = setInterval(() => {
-                current += increment;
-                step++;
-                
-                // Update speedometer value
-                speedValue.textContent = current.toFixed(2);
-                
-                // Update speedometer fill
-                const percentage = (current / 1000) * 100;
-                const degrees = percentage * 3.6 * 0.8; // 80% of the circle
-                speedometer.style.background = type === 'download' 
-                    ? "conic-gradient(var(--download-color) 0% " + degrees + "deg, #2c3e50 " + degrees + "deg 100%)"
-                    : "conic-gradient(var(--upload-color) 0% " + degrees + "deg, #2c3e50 " + degrees + "deg 100%)";
-                
-                if (step >= steps) {
-                    clearInterval(interval);
-                    
-                    if (type === 'download') {
-                        // After download test, start upload test
-                        setTimeout(() => {
-                            simulateSpeedometer(0, 9.67, 'upload');
-                        }, 500);
-                    } else {
-                        // After upload test, show results
-                        setTimeout(() => {
-                            showResults();
-                            resetTest();
-                        }, 1000);
-                    }
-                }
-            }, duration / steps);
+            const percentage = Math.min(mbps / 1000, 1) * 100;
+            const degrees = percentage * 3.6 * 0.8; // 80% of the circle
+            speedometer.style.background = "conic-gradient(" + color + " 0% " + degrees + "deg, #2c3e50 " + degrees + "deg 100%)";
+        }
+        
+        // Show a finished test on the results page
+        function showResult(result) {
+            document.getElementById('result-id').textContent = result.id;
+            // Values that could not be measured are shown as missing, not as zero
+            const measured = phase => !result.provenance || ['primary', 'alternative'].includes(result.provenance[phase].source);
+            document.getElementById('download-result').textContent = measured('download') ? result.download_speed.toFixed(2) : '--';
+            document.getElementById('upload-result').textContent = measured('upload') ? result.upload_speed.toFixed(2) : '--';
+            document.getElementById('ping-result').textContent = measured('latency') ? result.ping.toFixed(0) : '--';
+            const loaded = result.loaded_latency;
+            document.getElementById('download-latency-result').textContent = loaded && loaded.download_median ? loaded.download_median.toFixed(0) : '--';
+            document.getElementById('upload-latency-result').textContent = loaded && loaded.upload_median ? loaded.upload_median.toFixed(0) : '--';
+            document.getElementById('bufferbloat-result').textContent = result.bufferbloat_grade || '--';
+            showResults();
+            resetTest();
         }
         
         // Reset test UI
@@ -736,17 +798,94 @@ func main() {
 	speedTestRepo := createInMemorySpeedTestRepo()
 	userRepo := createInMemoryUserRepo()
 
+	// Create the test server registry, persisted to a file when configured
+	serverRegistry, err := createTestServerRegistry(os.Getenv("TEST_SERVERS_FILE"))
+	if err != nil {
+		log.Fatalf("Failed to load test servers: %v", err)
+	}
+
 	// Create service instances
-	speedTestService := services.NewSpeedTestService(speedTestRepo, userRepo)
+	speedTestService := services.NewSpeedTestService(speedTestRepo, userRepo, serverRegistry)
+	if err := speedTestService.SetThroughputConfig(loadThroughputConfig()); err != nil {
+		log.Fatalf("Invalid throughput configuration: %v", err)
+	}
+	if err := speedTestService.SetPacketLossConfig(loadPacketLossConfig()); err != nil {
+		log.Fatalf("Invalid packet loss configuration: %v", err)
+	}
+	if err := speedTestService.SetDNSConfig(loadDNSConfig()); err != nil {
+		log.Fatalf("Invalid DNS configuration: %v", err)
+	}
+	// Keep the test presets in a file when configured, so presets added by
+	// an admin survive restarts
+	if path := os.Getenv("TEST_PRESETS_FILE"); path != "" {
+		if err := speedTestService.LoadTestPresets(path); err != nil {
+			log.Fatalf("Failed to load test presets: %v", err)
+		}
+	}
+
+	// Load the scheduled tests, persisted to a file when configured. They
+	// start running once the servers are up.
+	scheduler, err := services.NewScheduler(speedTestService, os.Getenv("SCHEDULES_FILE"), loadSchedulerConfig())
+	if err != nil {
+		log.Fatalf("Failed to load schedules: %v", err)
+	}
+
+	// Start the UDP echo responder used for packet loss measurements
+	udpEchoAddr := os.Getenv("UDP_ECHO_ADDR")
+	if udpEchoAddr == "" {
+		udpEchoAddr = ":9091"
+	}
+	udpEcho, err := services.ListenUDPEcho(udpEchoAddr)
+	if err != nil {
+		log.Fatalf("Failed to start UDP echo responder: %v", err)
+	}
+	defer udpEcho.Close()
+	go func() {
+		if err := udpEcho.Serve(); err != nil {
+			log.Printf("UDP echo responder stopped: %v", err)
+		}
+	}()
+	fmt.Printf("UDP echo responder listening on %s\n", udpEcho.Addr())
+	warnWithoutUDPEcho(serverRegistry)
 
 	// Create controller instances
 	speedTestController := controllers.NewSpeedTestController(speedTestService)
+	linkEmulator := loadLinkEmulator()
+	measurementController := controllers.NewMeasurementController(linkEmulator)
+	webSocketController := controllers.NewWebSocketController(speedTestService)
+	ndt7Controller := controllers.NewNDT7Controller(speedTestService)
+	serverController := controllers.NewServerController(speedTestService, os.Getenv("ADMIN_TOKEN"))
+	presetController := controllers.NewPresetController(speedTestService, os.Getenv("ADMIN_TOKEN"))
+	linkProfileController := controllers.NewLinkProfileController(linkEmulator, os.Getenv("ADMIN_TOKEN"))
+	scheduleController := controllers.NewScheduleController(scheduler)
 
 	// Set up HTTP server
 	mux := http.NewServeMux()
 
 	// Define API routes
 	mux.HandleFunc("/api/speedtest", speedTestController.RunTest)
+	mux.HandleFunc("/api/speedtest/stream", speedTestController.StreamTest)
+	mux.HandleFunc("/api/speedtest/ws", webSocketController.BrowserTest)
+	mux.HandleFunc("/api/speedtest/history", speedTestController.GetHistory)
+	mux.HandleFunc("/api/servers", serverController.ListServers)
+	mux.HandleFunc("/api/presets", presetController.ListPresets)
+	mux.HandleFunc("/api/link-profiles", linkProfileController.ListLinkProfiles)
+	mux.HandleFunc("/api/schedules", scheduleController.Schedules)
+
+	// Define admin routes
+	mux.HandleFunc("/api/admin/servers", serverController.ManageServers)
+	mux.HandleFunc("/api/admin/servers/disable", serverController.DisableServer)
+	mux.HandleFunc("/api/admin/presets", presetController.ManagePresets)
+	mux.HandleFunc("/api/admin/link-profiles", linkProfileController.ManageLinkProfiles)
+	mux.HandleFunc("/api/admin/link-profiles/default", linkProfileController.DefaultLinkProfile)
+
+	// Define measurement endpoints served by this backend
+	mux.HandleFunc("/__down", measurementController.Download)
+	mux.HandleFunc("/__up", measurementController.Upload)
+
+	// Define ndt7 protocol endpoints
+	mux.HandleFunc("/ndt/v7/download", ndt7Controller.Download)
+	mux.HandleFunc("/ndt/v7/upload", ndt7Controller.Upload)
 
 	// Serve HTML content directly
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -754,14 +893,301 @@ func main() {
 		fmt.Fprint(w, htmlContent)
 	})
 
-	// Start the server
+	// Serve HTTPS and HTTP/3 so clients can compare protocols against this
+	// backend. Without a configured certificate a self-signed one is used.
+	tlsAddr := os.Getenv("TLS_ADDR")
+	if tlsAddr == "" {
+		tlsAddr = ":9443"
+	}
+	tlsConfig, err := loadTLSConfig(os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"))
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificate: %v", err)
+	}
+	http3Server := &http3.Server{Addr: tlsAddr, Handler: mux, TLSConfig: http3.ConfigureTLSConfig(tlsConfig), Logger: slog.Default()}
+	defer http3Server.Close()
+	go func() {
+		if err := http3Server.ListenAndServe(); err != nil {
+			log.Printf("HTTP/3 server stopped: %v", err)
+		}
+	}()
+	tlsServer := &http.Server{
+		Addr:      tlsAddr,
+		TLSConfig: tlsConfig,
+		// TCP connect latency probes close their connections before the TLS
+		// handshake, which would otherwise be logged as an error every time
+		ErrorLog: log.New(io.Discard, "", 0),
+		// Advertise HTTP/3 on the same port
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http3Server.SetQUICHeaders(w.Header())
+			mux.ServeHTTP(w, r)
+		}),
+	}
+	// EMULATED_LINK shapes the TCP listeners, so HTTP/3 is never slowed down
+	link := loadEmulatedLink()
+	tlsListener, err := net.Listen("tcp", tlsAddr)
+	if err != nil {
+		log.Fatalf("Failed to start HTTPS server: %v", err)
+	}
+	go func() {
+		if err := tlsServer.ServeTLS(netem.NewListener(tlsListener, link), "", ""); err != nil {
+			log.Printf("HTTPS server stopped: %v", err)
+		}
+	}()
+	fmt.Printf("HTTPS and HTTP/3 listening on %s\n", tlsAddr)
+
+	// Start the server. Plain HTTP accepts HTTP/2 with prior knowledge (h2c)
+	// as well as HTTP/1.1.
 	port := 9090 // Farklı bir port kullanıyoruz
 	fmt.Printf("Starting server on port %d...\n", port)
 	fmt.Printf("Server is running at http://localhost:%d\n", port)
-	err := http.ListenAndServe(":"+strconv.Itoa(port), mux)
+	server := &http.Server{Addr: ":" + strconv.Itoa(port), Handler: mux, Protocols: new(http.Protocols)}
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+	listener, err := net.Listen("tcp", server.Addr)
 	if err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
+
+	scheduler.Start()
+	defer scheduler.Close()
+
+	// Serve until SIGINT or SIGTERM, then let requests in flight finish and
+	// return so the deferred Close calls stop the scheduled tests and the
+	// other listeners
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(netem.NewListener(listener, link))
+	}()
+	select {
+	case err := <-serveErr:
+		log.Printf("Server stopped: %v", err)
+	case <-ctx.Done():
+		log.Printf("Shutting down...")
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down server: %v", err)
+	}
+	if err := tlsServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down HTTPS server: %v", err)
+	}
+}
+
+// loadTLSConfig loads the certificate of the HTTPS and HTTP/3 listeners.
+// Without certFile and keyFile a self-signed certificate for localhost is
+// generated, which clients must be told to accept.
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("No TLS_CERT_FILE configured, using a self-signed certificate")
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, nil
+}
+
+// loadEmulatedLink reads the link emulated in front of the TCP listeners
+// from the EMULATED_LINK environment variable, for example
+// "down=10mbit,up=1mbit,rtt=40ms". Without it nothing is emulated. Uploads
+// are only slowed where this server reads them, so clients on the same host
+// see uploads faster than the link; see netem.NewListener.
+func loadEmulatedLink() netem.Profile {
+	value := os.Getenv("EMULATED_LINK")
+	if value == "" {
+		return netem.Profile{}
+	}
+	profile, err := netem.ParseProfile(value)
+	if err != nil {
+		log.Fatalf("Invalid EMULATED_LINK: %v", err)
+	}
+	log.Printf("Emulating a %s link on the TCP listeners", value)
+	return profile
+}
+
+// loadLinkEmulator creates the link emulator of the measurement endpoints
+// with the built-in profiles. LINK_PROFILES_FILE keeps the profiles and the
+// default in a file, so changes made by an admin survive restarts, and
+// LINK_PROFILE names a profile to apply to requests that do not select one.
+func loadLinkEmulator() *services.LinkEmulator {
+	linkEmulator := services.NewLinkEmulator(services.DefaultLinkProfiles())
+	if path := os.Getenv("LINK_PROFILES_FILE"); path != "" {
+		if err := linkEmulator.LoadProfiles(path); err != nil {
+			log.Fatalf("Failed to load link profiles: %v", err)
+		}
+	}
+	if name := os.Getenv("LINK_PROFILE"); name != "" {
+		if err := linkEmulator.SetDefaultProfile(name); err != nil {
+			log.Fatalf("Invalid LINK_PROFILE: %v", err)
+		}
+		log.Printf("Emulating the %s link profile on the measurement endpoints", name)
+	}
+	return linkEmulator
+}
+
+// loadThroughputConfig reads the throughput phase timing from the
+// TEST_DURATION, TEST_WARMUP and TEST_SAMPLE_INTERVAL environment variables
+func loadThroughputConfig() services.ThroughputConfig {
+	cfg := services.DefaultThroughputConfig()
+	for env, field := range map[string]*time.Duration{
+		"TEST_DURATION":        &cfg.Duration,
+		"TEST_WARMUP":          &cfg.WarmUp,
+		"TEST_SAMPLE_INTERVAL": &cfg.SampleInterval,
+	} {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", env, err)
+		}
+		*field = d
+	}
+	return cfg
+}
+
+// loadPacketLossConfig reads the UDP probe settings from the
+// UDP_PROBE_RATE, UDP_PROBE_COUNT and UDP_PROBE_SIZE environment variables
+func loadPacketLossConfig() services.PacketLossConfig {
+	cfg := services.DefaultPacketLossConfig()
+	for env, field := range map[string]*int{
+		"UDP_PROBE_RATE":  &cfg.Rate,
+		"UDP_PROBE_COUNT": &cfg.Count,
+		"UDP_PROBE_SIZE":  &cfg.PacketSize,
+	} {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", env, err)
+		}
+		*field = n
+	}
+	return cfg
+}
+
+// loadSchedulerConfig reads the scheduled test settings from the
+// SCHEDULE_MAX_CONCURRENT, SCHEDULE_MAX_SCHEDULES,
+// SCHEDULE_MAX_PER_CLIENT, SCHEDULE_MAX_JITTER and SCHEDULE_MIN_INTERVAL
+// environment variables
+func loadSchedulerConfig() services.SchedulerConfig {
+	cfg := services.DefaultSchedulerConfig()
+	for env, field := range map[string]*int{
+		"SCHEDULE_MAX_CONCURRENT": &cfg.MaxConcurrent,
+		"SCHEDULE_MAX_SCHEDULES":  &cfg.MaxSchedules,
+		"SCHEDULE_MAX_PER_CLIENT": &cfg.MaxSchedulesPerClient,
+	} {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", env, err)
+		}
+		*field = n
+	}
+	for env, field := range map[string]*time.Duration{
+		"SCHEDULE_MAX_JITTER":   &cfg.MaxJitter,
+		"SCHEDULE_MIN_INTERVAL": &cfg.MinInterval,
+	} {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", env, err)
+		}
+		*field = d
+	}
+	return cfg
+}
+
+// loadDNSConfig reads the DNS benchmark settings from the DNS_RESOLVERS,
+// DNS_NAMES, DNS_QUERIES and DNS_TIMEOUT environment variables. Resolvers
+// and names are comma separated; resolvers are given as "system",
+// "udp://host:port", "tcp://host:port" or a DoH URL.
+func loadDNSConfig() services.DNSConfig {
+	cfg := services.DefaultDNSConfig()
+	if value := os.Getenv("DNS_RESOLVERS"); value != "" {
+		cfg.Resolvers = nil
+		for _, spec := range strings.Split(value, ",") {
+			resolver, err := services.ParseDNSResolver(strings.TrimSpace(spec))
+			if err != nil {
+				log.Fatalf("Invalid DNS_RESOLVERS: %v", err)
+			}
+			cfg.Resolvers = append(cfg.Resolvers, resolver)
+		}
+	}
+	if value := os.Getenv("DNS_NAMES"); value != "" {
+		cfg.Names = strings.Split(value, ",")
+	}
+	if value := os.Getenv("DNS_QUERIES"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("Invalid DNS_QUERIES: %v", err)
+		}
+		cfg.Queries = n
+	}
+	if value := os.Getenv("DNS_TIMEOUT"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("Invalid DNS_TIMEOUT: %v", err)
+		}
+		cfg.Timeout = d
+	}
+	return cfg
+}
+
+// warnWithoutUDPEcho logs that the packet loss phase will be skipped when no
+// enabled test server has a UDP echo responder configured
+func warnWithoutUDPEcho(registry services.TestServerRegistry) {
+	servers, err := registry.List(context.Background())
+	if err != nil {
+		return
+	}
+	for _, server := range servers {
+		if server.Supports(services.PhasePacketLoss) {
+			return
+		}
+	}
+	log.Printf("No test server has a udp_echo_address; packet loss will not be measured until one is added")
+}
+
+// createTestServerRegistry creates a file-backed registry when path is set,
+// and an in-memory registry with the default servers otherwise
+func createTestServerRegistry(path string) (services.TestServerRegistry, error) {
+	if path == "" {
+		return services.NewInMemoryTestServerRegistry(services.DefaultTestServers()...), nil
+	}
+	return services.NewFileTestServerRegistry(path, services.DefaultTestServers())
 }
 
 // createInMemorySpeedTestRepo creates an in-memory implementation of SpeedTestRepository
@@ -774,17 +1200,23 @@ func createInMemoryUserRepo() repositories.UserRepository {
 	return &InMemoryUserRepo{users: make(map[string]*models.UserProfile)}
 }
 
-// InMemorySpeedTestRepo is an in-memory implementation of SpeedTestRepository
+// InMemorySpeedTestRepo is an in-memory implementation of SpeedTestRepository.
+// Scheduled tests save results in the background, so access is locked.
 type InMemorySpeedTestRepo struct {
+	mu      sync.RWMutex
 	results map[string]*models.SpeedTestResult
 }
 
 func (r *InMemorySpeedTestRepo) SaveResult(ctx context.Context, result *models.SpeedTestResult) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.results[result.ID] = result
 	return nil
 }
 
 func (r *InMemorySpeedTestRepo) GetResultsByUserID(ctx context.Context, userID string) ([]*models.SpeedTestResult, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	var userResults []*models.SpeedTestResult
 	for _, result := range r.results {
 		if result.UserID == userID {
@@ -795,6 +1227,8 @@ func (r *InMemorySpeedTestRepo) GetResultsByUserID(ctx context.Context, userID s
 }
 
 func (r *InMemorySpeedTestRepo) GetResultByID(ctx context.Context, id string) (*models.SpeedTestResult, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	result, ok := r.results[id]
 	if !ok {
 		return nil, fmt.Errorf("result not found")
@@ -803,6 +1237,8 @@ func (r *InMemorySpeedTestRepo) GetResultByID(ctx context.Context, id string) (*
 }
 
 func (r *InMemorySpeedTestRepo) DeleteResult(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	delete(r.results, id)
 	return nil
 }
@@ -1,3 +1,16 @@
 module github.com/cetinibs/online-speed-test-backend-root
 
-go 1.21
+go 1.24
+
+require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/quic-go/quic-go v0.59.1
+	golang.org/x/net v0.43.0
+	golang.org/x/sys v0.35.0
+)
+
+require (
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
+)
@@ -0,0 +1,173 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/services"
+)
+
+// LinkProfileController handles HTTP requests for the link profiles the
+// measurement endpoints can emulate
+type LinkProfileController struct {
+	linkEmulator *services.LinkEmulator
+	adminToken   string
+}
+
+// NewLinkProfileController creates a new instance of LinkProfileController.
+// Admin endpoints are rejected unless adminToken is set.
+func NewLinkProfileController(linkEmulator *services.LinkEmulator, adminToken string) *LinkProfileController {
+	return &LinkProfileController{
+		linkEmulator: linkEmulator,
+		adminToken:   adminToken,
+	}
+}
+
+// linkProfileList is the response listing the link profiles
+type linkProfileList struct {
+	Default  string                 `json:"default"`
+	Profiles []services.LinkProfile `json:"profiles"`
+}
+
+// writeLinkProfileError maps link profile errors to HTTP status codes
+func writeLinkProfileError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrLinkProfileNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrLinkProfileInUse):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "Failed to update link profiles: "+err.Error(), http.StatusBadRequest)
+	}
+}
+
+// writeLinkProfiles writes the link profiles and the default profile
+func (c *LinkProfileController) writeLinkProfiles(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(linkProfileList{
+		Default:  c.linkEmulator.DefaultProfile(),
+		Profiles: c.linkEmulator.ListProfiles(),
+	})
+}
+
+// ListLinkProfiles handles /api/link-profiles by listing the link profiles
+// and the one applied by default
+func (c *LinkProfileController) ListLinkProfiles(w http.ResponseWriter, r *http.Request) {
+	// Enable CORS for all requests
+	enableCORS(w)
+
+	// Handle preflight OPTIONS request
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.writeLinkProfiles(w)
+}
+
+// ManageLinkProfiles handles /api/admin/link-profiles: GET lists all
+// profiles, POST adds or replaces a profile and DELETE removes the profile
+// given by the name query parameter
+func (c *LinkProfileController) ManageLinkProfiles(w http.ResponseWriter, r *http.Request) {
+	// Enable CORS for all requests
+	enableCORS(w)
+
+	// Handle preflight OPTIONS request
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if !requireAdmin(w, r, c.adminToken) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		c.writeLinkProfiles(w)
+
+	case "POST":
+		var profile services.LinkProfile
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxOptionsBodyBytes)).Decode(&profile); err != nil {
+			http.Error(w, "Invalid link profile: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.linkEmulator.SaveProfile(profile); err != nil {
+			writeLinkProfileError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(profile)
+
+	case "DELETE":
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			http.Error(w, "Link profile name is required", http.StatusBadRequest)
+			return
+		}
+		if err := c.linkEmulator.RemoveProfile(name); err != nil {
+			writeLinkProfileError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DefaultLinkProfile handles /api/admin/link-profiles/default: GET returns
+// the default profile, POST sets it from a {"name": ...} body and DELETE
+// stops shaping requests that do not select a profile
+func (c *LinkProfileController) DefaultLinkProfile(w http.ResponseWriter, r *http.Request) {
+	// Enable CORS for all requests
+	enableCORS(w)
+
+	// Handle preflight OPTIONS request
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if !requireAdmin(w, r, c.adminToken) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+
+	case "POST":
+		var body struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxOptionsBodyBytes)).Decode(&body); err != nil {
+			http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.linkEmulator.SetDefaultProfile(body.Name); err != nil {
+			writeLinkProfileError(w, err)
+			return
+		}
+
+	case "DELETE":
+		if err := c.linkEmulator.SetDefaultProfile(""); err != nil {
+			writeLinkProfileError(w, err)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"default": c.linkEmulator.DefaultProfile()})
+}
@@ -0,0 +1,196 @@
+package controllers
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/measure"
+	"github.com/cetinibs/online-speed-test-backend-root/internal/netem"
+	"github.com/cetinibs/online-speed-test-backend-root/internal/services"
+)
+
+const (
+	// defaultMaxDownloadBytes caps the size of a single /__down response
+	defaultMaxDownloadBytes = 1 << 30 // 1GB
+
+	// defaultMaxUploadBytes caps the size of a single /__up request body
+	defaultMaxUploadBytes = 256 << 20 // 256MB
+
+	// measurementBufferSize is the chunk size used when streaming test data
+	measurementBufferSize = 32 * 1024
+)
+
+// MeasurementController serves the raw download and upload endpoints that
+// clients use to measure throughput against this backend. Transfers can be
+// slowed down to a link profile, chosen per request with the profile query
+// parameter or for every request by an admin.
+type MeasurementController struct {
+	maxDownloadBytes int64
+	maxUploadBytes   int64
+	linkEmulator     *services.LinkEmulator
+}
+
+// NewMeasurementController creates a new instance of MeasurementController
+func NewMeasurementController(linkEmulator *services.LinkEmulator) *MeasurementController {
+	return &MeasurementController{
+		maxDownloadBytes: defaultMaxDownloadBytes,
+		maxUploadBytes:   defaultMaxUploadBytes,
+		linkEmulator:     linkEmulator,
+	}
+}
+
+// enableMeasurementCORS adds CORS headers and exposes the measurement headers
+// an endpoint sends, along with X-Link-Profile, so browser clients can read
+// the server-side counters
+func enableMeasurementCORS(w http.ResponseWriter, headers ...string) {
+	enableCORS(w)
+	w.Header().Set("Access-Control-Expose-Headers", strings.Join(append(headers, "X-Link-Profile"), ", "))
+}
+
+// emulatedPath returns the emulated link the request crosses, or nil if it
+// is not shaped, and names the profile in the X-Link-Profile header. It
+// writes an error response if the request names an unknown profile.
+//
+// The requests of one test share a link. A test is told apart by the
+// test_id query parameter its client sends with every request, so clients
+// behind one NAT or proxy get a link each; without it all requests from an
+// address share one. An address holds a bounded number of links.
+func (c *MeasurementController) emulatedPath(w http.ResponseWriter, r *http.Request) (*netem.Path, bool) {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	path, profile, err := c.linkEmulator.Path(r.URL.Query().Get("profile"), client, r.URL.Query().Get("test_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if profile != "" {
+		w.Header().Set("X-Link-Profile", profile)
+	}
+	return path, true
+}
+
+// Download handles /__down?bytes=N by streaming N bytes of generated data.
+// Headers go out before the body, so X-Bytes-Sent is the size the server
+// commits to with Content-Length rather than a count: the whole payload is
+// sent, or the connection is cut and the client sees a short body. Clients
+// time the transfer themselves.
+func (c *MeasurementController) Download(w http.ResponseWriter, r *http.Request) {
+	// Enable CORS for all requests
+	enableMeasurementCORS(w, "X-Bytes-Requested", "X-Bytes-Sent")
+
+	// Handle preflight OPTIONS request
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Parse and validate the requested size
+	size, err := strconv.ParseInt(r.URL.Query().Get("bytes"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "bytes must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+	if size > c.maxDownloadBytes {
+		http.Error(w, "bytes must not exceed "+strconv.FormatInt(c.maxDownloadBytes, 10), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	path, ok := c.emulatedPath(w, r)
+	if !ok {
+		return
+	}
+
+	// Browsers cannot read trailers, so the committed size goes out as a
+	// plain header
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Bytes-Requested", strconv.FormatInt(size, 10))
+	w.Header().Set("X-Bytes-Sent", strconv.FormatInt(size, 10))
+
+	// Stream the shared random payload without generating or buffering it.
+	// Over an emulated link the request first crosses the uplink, and the
+	// response crosses the downlink.
+	if path != nil {
+		if path.WaitUp(r.Context()) != nil {
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		body := path.NewWriter(w)
+		io.Copy(body, measure.NewPayloadReader(size))
+		body.Close()
+	} else {
+		w.WriteHeader(http.StatusOK)
+		io.Copy(w, measure.NewPayloadReader(size))
+	}
+}
+
+// Upload handles /__up by reading and discarding the request body. The
+// response counts the bytes received and times reading them.
+func (c *MeasurementController) Upload(w http.ResponseWriter, r *http.Request) {
+	// Enable CORS for all requests
+	enableMeasurementCORS(w, "X-Bytes-Received", "X-Server-Duration-Ms")
+
+	// Handle preflight OPTIONS request
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "POST" && r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path, ok := c.emulatedPath(w, r)
+	if !ok {
+		return
+	}
+
+	start := time.Now()
+
+	// Read the body in chunks, rejecting anything above the cap. Over an
+	// emulated link the body is read at the pace of the uplink, and the
+	// response waits for the last byte to arrive and then for the downlink.
+	var body io.Reader = http.MaxBytesReader(w, r.Body, c.maxUploadBytes)
+	if path != nil {
+		body = path.NewReader(body)
+	}
+	received, err := io.CopyBuffer(io.Discard, body, make([]byte, measurementBufferSize))
+	if err == nil && path != nil {
+		if path.WaitUp(r.Context()) != nil || path.WaitDown(r.Context()) != nil {
+			return
+		}
+	}
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, "upload must not exceed "+strconv.FormatInt(c.maxUploadBytes, 10)+" bytes", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to read upload", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Bytes-Received", strconv.FormatInt(received, 10))
+	w.Header().Set("X-Server-Duration-Ms", formatMillis(time.Since(start)))
+	w.WriteHeader(http.StatusOK)
+}
+
+// formatMillis formats a duration as fractional milliseconds
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/services"
+)
+
+func newTestMeasurementController() *MeasurementController {
+	c := NewMeasurementController(services.NewLinkEmulator(services.DefaultLinkProfiles()))
+	c.maxDownloadBytes = 1 << 20
+	c.maxUploadBytes = 1 << 20
+	return c
+}
+
+func TestDownloadValidatesBytes(t *testing.T) {
+	c := newTestMeasurementController()
+	for _, tc := range []struct {
+		query string
+		want  int
+	}{
+		{"", http.StatusBadRequest},
+		{"bytes=abc", http.StatusBadRequest},
+		{"bytes=-1", http.StatusBadRequest},
+		{"bytes=1048577", http.StatusRequestEntityTooLarge},
+		{"bytes=10&profile=unknown", http.StatusBadRequest},
+		{"bytes=0", http.StatusOK},
+		{"bytes=1048576", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		c.Download(w, httptest.NewRequest("GET", "/__down?"+tc.query, nil))
+		if w.Code != tc.want {
+			t.Errorf("%q: status %d; want %d", tc.query, w.Code, tc.want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	c.Download(w, httptest.NewRequest("POST", "/__down?bytes=10", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST got status %d", w.Code)
+	}
+}
+
+func TestDownloadHeaders(t *testing.T) {
+	c := newTestMeasurementController()
+	w := httptest.NewRecorder()
+	c.Download(w, httptest.NewRequest("GET", "/__down?bytes=100000", nil))
+
+	if w.Code != http.StatusOK || w.Body.Len() != 100000 {
+		t.Fatalf("status %d with %d bytes", w.Code, w.Body.Len())
+	}
+	for header, want := range map[string]string{
+		"Content-Length":    "100000",
+		"Content-Type":      "application/octet-stream",
+		"Cache-Control":     "no-store",
+		"X-Bytes-Requested": "100000",
+		"X-Bytes-Sent":      "100000",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("%s is %q; want %q", header, got, want)
+		}
+	}
+	exposed := w.Header().Get("Access-Control-Expose-Headers")
+	if !strings.Contains(exposed, "X-Bytes-Sent") || strings.Contains(exposed, "X-Server-Duration-Ms") {
+		t.Errorf("exposed headers %q", exposed)
+	}
+	if w.Header().Get("X-Link-Profile") != "" {
+		t.Error("an unshaped download named a link profile")
+	}
+}
+
+func TestDownloadOverLinkProfile(t *testing.T) {
+	c := newTestMeasurementController()
+	if err := c.linkEmulator.SaveProfile(services.LinkProfile{Name: "lab", DownMbps: 1000, UpMbps: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	c.Download(w, httptest.NewRequest("GET", "/__down?bytes=1000&profile=lab&test_id=one", nil))
+	if w.Code != http.StatusOK || w.Body.Len() != 1000 || w.Header().Get("X-Link-Profile") != "lab" {
+		t.Fatalf("status %d with %d bytes over profile %q", w.Code, w.Body.Len(), w.Header().Get("X-Link-Profile"))
+	}
+}
+
+func TestUploadCountsBytes(t *testing.T) {
+	c := newTestMeasurementController()
+	for _, method := range []string{"POST", "PUT"} {
+		w := httptest.NewRecorder()
+		c.Upload(w, httptest.NewRequest(method, "/__up", bytes.NewReader(make([]byte, 123456))))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", method, w.Code)
+		}
+		if got := w.Header().Get("X-Bytes-Received"); got != "123456" {
+			t.Errorf("%s: received %q bytes; want 123456", method, got)
+		}
+		if ms, err := strconv.ParseFloat(w.Header().Get("X-Server-Duration-Ms"), 64); err != nil || ms < 0 {
+			t.Errorf("%s: duration %q", method, w.Header().Get("X-Server-Duration-Ms"))
+		}
+		if exposed := w.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(exposed, "X-Server-Duration-Ms") {
+			t.Errorf("%s: exposed headers %q", method, exposed)
+		}
+	}
+}
+
+func TestUploadRejectsOversizedBody(t *testing.T) {
+	c := newTestMeasurementController()
+	w := httptest.NewRecorder()
+	c.Upload(w, httptest.NewRequest("POST", "/__up", bytes.NewReader(make([]byte, c.maxUploadBytes+1))))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d; want 413", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	c.Upload(w, httptest.NewRequest("GET", "/__up", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET got status %d", w.Code)
+	}
+}
@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/services"
+)
+
+// NDT7Controller serves the ndt7 download and upload endpoints so that
+// standard M-Lab ndt7 clients can test against this backend
+type NDT7Controller struct {
+	speedTestService *services.SpeedTestService
+	upgrader         websocket.Upgrader
+}
+
+// NewNDT7Controller creates a new instance of NDT7Controller
+func NewNDT7Controller(speedTestService *services.SpeedTestService) *NDT7Controller {
+	return &NDT7Controller{
+		speedTestService: speedTestService,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  64 * 1024,
+			WriteBufferSize: 64 * 1024,
+			Subprotocols:    []string{services.NDT7Subprotocol},
+			// ndt7 clients may run on any origin
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
+
+// Download handles /ndt/v7/download
+func (c *NDT7Controller) Download(w http.ResponseWriter, r *http.Request) {
+	c.serve(w, r, services.PhaseDownload)
+}
+
+// Upload handles /ndt/v7/upload
+func (c *NDT7Controller) Upload(w http.ResponseWriter, r *http.Request) {
+	c.serve(w, r, services.PhaseUpload)
+}
+
+// serve upgrades the request and runs the given ndt7 test
+func (c *NDT7Controller) serve(w http.ResponseWriter, r *http.Request, test string) {
+	// The spec requires clients to request the ndt7 subprotocol
+	if !hasSubprotocol(r, services.NDT7Subprotocol) {
+		http.Error(w, "Missing "+services.NDT7Subprotocol+" subprotocol", http.StatusBadRequest)
+		return
+	}
+
+	userID, ipInfo := clientInfo(r)
+
+	// Upgrade writes an error response itself on failure
+	conn, err := c.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(services.NDT7ReadLimit)
+
+	if test == services.PhaseDownload {
+		_, err = c.speedTestService.RunNDT7Download(r.Context(), conn, userID, ipInfo)
+	} else {
+		_, err = c.speedTestService.RunNDT7Upload(r.Context(), conn, userID, ipInfo)
+	}
+	if err != nil {
+		log.Printf("ndt7 %s test failed: %v", test, err)
+	}
+}
+
+// hasSubprotocol reports whether the client offered the given subprotocol
+func hasSubprotocol(r *http.Request, protocol string) bool {
+	for _, offered := range websocket.Subprotocols(r) {
+		if offered == protocol {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/services"
+)
+
+// PresetController handles HTTP requests for test presets
+type PresetController struct {
+	speedTestService *services.SpeedTestService
+	adminToken       string
+}
+
+// NewPresetController creates a new instance of PresetController. Admin
+// endpoints are rejected unless adminToken is set.
+func NewPresetController(speedTestService *services.SpeedTestService, adminToken string) *PresetController {
+	return &PresetController{
+		speedTestService: speedTestService,
+		adminToken:       adminToken,
+	}
+}
+
+// writePresetError maps preset errors to HTTP status codes
+func writePresetError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrPresetNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrPresetRequired):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "Failed to update test presets: "+err.Error(), http.StatusBadRequest)
+	}
+}
+
+// ListPresets handles /api/presets by listing the test presets
+func (c *PresetController) ListPresets(w http.ResponseWriter, r *http.Request) {
+	// Enable CORS for all requests
+	enableCORS(w)
+
+	// Handle preflight OPTIONS request
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.speedTestService.ListTestPresets(r.Context()))
+}
+
+// ManagePresets handles /api/admin/presets: GET lists all presets, POST adds
+// or replaces a preset and DELETE removes the preset given by the name query
+// parameter
+func (c *PresetController) ManagePresets(w http.ResponseWriter, r *http.Request) {
+	// Enable CORS for all requests
+	enableCORS(w)
+
+	// Handle preflight OPTIONS request
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if !requireAdmin(w, r, c.adminToken) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.speedTestService.ListTestPresets(r.Context()))
+
+	case "POST":
+		var preset services.TestPreset
+		if err := json.NewDecoder(r.Body).Decode(&preset); err != nil {
+			http.Error(w, "Invalid test preset: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.speedTestService.SaveTestPreset(r.Context(), preset); err != nil {
+			writePresetError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(preset)
+
+	case "DELETE":
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			http.Error(w, "Preset name is required", http.StatusBadRequest)
+			return
+		}
+		if err := c.speedTestService.RemoveTestPreset(r.Context(), name); err != nil {
+			writePresetError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
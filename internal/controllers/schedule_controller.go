@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/services"
+)
+
+// ScheduleController handles HTTP requests for recurring speed tests
+type ScheduleController struct {
+	scheduler *services.Scheduler
+}
+
+// NewScheduleController creates a new instance of ScheduleController
+func NewScheduleController(scheduler *services.Scheduler) *ScheduleController {
+	return &ScheduleController{scheduler: scheduler}
+}
+
+// writeScheduleError maps schedule errors to HTTP status codes
+func writeScheduleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrScheduleNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrTooManySchedules):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, services.ErrScheduleTokenMismatch):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, "Invalid schedule: "+err.Error(), http.StatusBadRequest)
+	}
+}
+
+// Schedules handles /api/schedules: GET lists the schedules of the user
+// given by the user_id query parameter, of one device with device_id, or
+// returns the one given by id. POST creates a schedule, or replaces the one
+// with the id of the body, and DELETE removes the schedule given by id.
+//
+// The first schedule of a user comes back with a token. Every later request
+// for the user's schedules must give it as "Authorization: Bearer <token>".
+func (c *ScheduleController) Schedules(w http.ResponseWriter, r *http.Request) {
+	// Enable CORS for all requests
+	enableCORS(w)
+
+	// Handle preflight OPTIONS request
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// In a real implementation, we would extract the user ID from the authenticated session
+	query := r.URL.Query()
+	userID := query.Get("user_id")
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	switch r.Method {
+	case "GET":
+		if userID == "" {
+			http.Error(w, "User ID is required", http.StatusBadRequest)
+			return
+		}
+		if id := query.Get("id"); id != "" {
+			schedule, err := c.scheduler.GetSchedule(userID, token, id)
+			if err != nil {
+				writeScheduleError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(schedule)
+			return
+		}
+		schedules, err := c.scheduler.ListSchedules(userID, token, query.Get("device_id"))
+		if err != nil {
+			writeScheduleError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(schedules)
+
+	case "POST":
+		var schedule services.Schedule
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxOptionsBodyBytes)).Decode(&schedule); err != nil {
+			http.Error(w, "Invalid schedule: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if userID != "" {
+			schedule.UserID = userID
+		}
+		// Scheduled results carry the client information of the request
+		// that saved the schedule, and its address counts against the
+		// schedules one client may create
+		_, schedule.ClientInfo = clientInfo(r)
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		schedule.Client = client
+		saved, err := c.scheduler.SaveSchedule(schedule, token)
+		if err != nil {
+			writeScheduleError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(saved)
+
+	case "DELETE":
+		id := query.Get("id")
+		if userID == "" || id == "" {
+			http.Error(w, "User ID and schedule ID are required", http.StatusBadRequest)
+			return
+		}
+		if err := c.scheduler.RemoveSchedule(userID, token, id); err != nil {
+			writeScheduleError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,206 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/services"
+)
+
+// ServerController handles HTTP requests for managing test servers
+type ServerController struct {
+	speedTestService *services.SpeedTestService
+	adminToken       string
+}
+
+// NewServerController creates a new instance of ServerController. Admin
+// endpoints are rejected unless adminToken is set.
+func NewServerController(speedTestService *services.SpeedTestService, adminToken string) *ServerController {
+	return &ServerController{
+		speedTestService: speedTestService,
+		adminToken:       adminToken,
+	}
+}
+
+// requireAdmin checks the bearer token of an admin request against
+// adminToken and writes an error response if it is missing or wrong
+func requireAdmin(w http.ResponseWriter, r *http.Request, adminToken string) bool {
+	if adminToken == "" {
+		http.Error(w, "Admin API is disabled", http.StatusForbidden)
+		return false
+	}
+	expected := "Bearer " + adminToken
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// writeRegistryError maps registry errors to HTTP status codes
+func writeRegistryError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrServerNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrServerExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "Failed to update test servers: "+err.Error(), http.StatusBadRequest)
+	}
+}
+
+// publicTestServer is a test server as the public endpoints show it. It
+// hides the settings only the backend needs, such as the echo responder
+// address and whether TLS verification is skipped.
+type publicTestServer struct {
+	ID                 string                      `json:"id"`
+	Name               string                      `json:"name"`
+	URL                string                      `json:"url"`
+	Location           string                      `json:"location"`
+	Capabilities       services.ServerCapabilities `json:"capabilities"`
+	UDPEchoAddress     string                      `json:"-"`
+	InsecureSkipVerify bool                        `json:"-"`
+	Disabled           bool                        `json:"disabled"`
+}
+
+// publicServerLatency is a ranked test server as /api/servers lists it
+type publicServerLatency struct {
+	Server    publicTestServer `json:"server"`
+	MedianRTT float64          `json:"median_rtt_ms"`
+	Samples   int              `json:"samples"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// ListServers handles /api/servers by listing the candidate test servers
+// ordered by their measured latency
+func (c *ServerController) ListServers(w http.ResponseWriter, r *http.Request) {
+	// Enable CORS for all requests
+	enableCORS(w)
+
+	// Handle preflight OPTIONS request
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ranked, err := c.speedTestService.RankServers(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to list test servers", http.StatusInternalServerError)
+		return
+	}
+	listed := make([]publicServerLatency, len(ranked))
+	for i, latency := range ranked {
+		listed[i] = publicServerLatency{
+			Server:    publicTestServer(latency.Server),
+			MedianRTT: latency.MedianRTT,
+			Samples:   latency.Samples,
+			Error:     latency.Error,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listed)
+}
+
+// ManageServers handles /api/admin/servers: GET lists all servers, POST adds
+// a server and DELETE removes the server given by the id query parameter
+func (c *ServerController) ManageServers(w http.ResponseWriter, r *http.Request) {
+	// Enable CORS for all requests
+	enableCORS(w)
+
+	// Handle preflight OPTIONS request
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if !requireAdmin(w, r, c.adminToken) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		servers, err := c.speedTestService.ListTestServers(r.Context())
+		if err != nil {
+			http.Error(w, "Failed to list test servers", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(servers)
+
+	case "POST":
+		var server services.TestServer
+		if err := json.NewDecoder(r.Body).Decode(&server); err != nil {
+			http.Error(w, "Invalid test server: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.speedTestService.AddTestServer(r.Context(), server); err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(server)
+
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "Server ID is required", http.StatusBadRequest)
+			return
+		}
+		if err := c.speedTestService.RemoveTestServer(r.Context(), id); err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DisableServer handles /api/admin/servers/disable?id=...&disabled=true|false
+func (c *ServerController) DisableServer(w http.ResponseWriter, r *http.Request) {
+	// Enable CORS for all requests
+	enableCORS(w)
+
+	// Handle preflight OPTIONS request
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !requireAdmin(w, r, c.adminToken) {
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Server ID is required", http.StatusBadRequest)
+		return
+	}
+
+	// Disable by default, re-enable with disabled=false
+	disabled := r.URL.Query().Get("disabled") != "false"
+
+	if err := c.speedTestService.SetTestServerDisabled(r.Context(), id, disabled); err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
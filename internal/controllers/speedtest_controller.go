@@ -2,11 +2,20 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
 	"github.com/cetinibs/online-speed-test-backend-root/internal/services"
 )
 
+// maxOptionsBodyBytes caps the size of a JSON test options body
+const maxOptionsBodyBytes = 64 * 1024
+
 // SpeedTestController handles HTTP requests for speed testing
 type SpeedTestController struct {
 	speedTestService *services.SpeedTestService
@@ -22,10 +31,158 @@ func NewSpeedTestController(speedTestService *services.SpeedTestService) *SpeedT
 // enableCORS adds CORS headers to allow cross-origin requests
 func enableCORS(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 }
 
+// clientInfo extracts the user and client information of a request
+func clientInfo(r *http.Request) (string, map[string]string) {
+	// In a real implementation, we would extract the user ID from the authenticated session
+	userID := "anonymous" // Default for unauthenticated users
+
+	// Get IP information (in a real implementation, this would come from a geolocation service)
+	ipInfo := map[string]string{
+		"ip":      r.RemoteAddr,
+		"isp":     "Example ISP",
+		"country": "Turkey",
+		"region":  "Istanbul",
+	}
+
+	return userID, ipInfo
+}
+
+// parseTestOptions reads the options of a speed test from a JSON body, if
+// there is one, and from query parameters, which take precedence
+func parseTestOptions(r *http.Request) (services.TestOptions, error) {
+	var opts services.TestOptions
+	hasBody := r.Method == "POST" && r.ContentLength != 0
+	if hasBody {
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxOptionsBodyBytes)).Decode(&opts); err != nil {
+			return opts, fmt.Errorf("invalid test options: %w", err)
+		}
+	}
+
+	query := r.URL.Query()
+	if preset := query.Get("preset"); preset != "" {
+		opts.Preset = preset
+	}
+	// Get the requested test server, if any; the nearest one is used otherwise
+	if serverID := query.Get("server"); serverID != "" {
+		opts.ServerID = serverID
+	}
+	// In strict mode a failed phase fails the test instead of falling back,
+	// adaptive mode ramps the stream count up to max_streams and dual-stack
+	// mode compares IPv4 and IPv6 after the regular phases. Setting a flag
+	// to false turns off the preset's flag.
+	for name, field := range map[string]**bool{
+		"strict":           &opts.Strict,
+		"adaptive_streams": &opts.AdaptiveStreams,
+		"dual_stack":       &opts.DualStack,
+	} {
+		if value := query.Get(name); value != "" {
+			flag, err := strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*field = &flag
+		}
+	}
+	if phases := query.Get("phases"); phases != "" {
+		opts.Phases = strings.Split(phases, ",")
+	}
+	// The protocol is one of http/1.1, h2 or h3; empty negotiates it
+	if protocol := query.Get("protocol"); protocol != "" {
+		opts.Protocol = protocol
+	}
+
+	// A single connection test uses one stream in each direction. Clients
+	// of the original API choose with isMultiConnection alone, which
+	// defaulted to a single connection, so requests without a body or a
+	// preset keep that default.
+	switch query.Get("isMultiConnection") {
+	case "true":
+	case "false":
+		opts.DownloadStreams, opts.UploadStreams = 1, 1
+	default:
+		if !hasBody && opts.Preset == "" {
+			opts.DownloadStreams, opts.UploadStreams = 1, 1
+		}
+	}
+
+	ints := []struct {
+		name  string
+		field *int
+	}{
+		{"duration_ms", &opts.DurationMs},
+		{"warmup_ms", &opts.WarmUpMs},
+		{"streams", &opts.DownloadStreams},
+		{"streams", &opts.UploadStreams},
+		{"download_streams", &opts.DownloadStreams},
+		{"upload_streams", &opts.UploadStreams},
+		{"max_streams", &opts.MaxStreams},
+	}
+	for _, param := range ints {
+		if value := query.Get(param.name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return opts, fmt.Errorf("invalid %s: %w", param.name, err)
+			}
+			*param.field = n
+		}
+	}
+	for name, field := range map[string]*int64{
+		"download_request_bytes": &opts.DownloadRequestBytes,
+		"upload_request_bytes":   &opts.UploadRequestBytes,
+	} {
+		if value := query.Get(name); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return opts, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*field = n
+		}
+	}
+
+	return opts, nil
+}
+
+// testErrorStatus returns the HTTP status code for an error running a test
+func testErrorStatus(err error) int {
+	if errors.Is(err, services.ErrInvalidOptions) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// includes reports whether the comma-separated include query parameter
+// requests the given optional field
+func includes(r *http.Request, field string) bool {
+	for _, included := range strings.Split(r.URL.Query().Get("include"), ",") {
+		if strings.TrimSpace(included) == field {
+			return true
+		}
+	}
+	return false
+}
+
+// presentResult returns the result as it should be sent to the client.
+// Raw RTT samples and throughput traces are only returned when requested
+// with include=rtt_samples and include=traces.
+func presentResult(r *http.Request, result *models.SpeedTestResult) *models.SpeedTestResult {
+	if result == nil {
+		return result
+	}
+	// Copy so the stored result keeps its samples
+	presented := *result
+	if !includes(r, "rtt_samples") {
+		presented.RTTSamples = nil
+	}
+	if !includes(r, "traces") {
+		presented.Traces = nil
+	}
+	return &presented
+}
+
 // RunTest handles the request to run a speed test
 func (c *SpeedTestController) RunTest(w http.ResponseWriter, r *http.Request) {
 	// Enable CORS for all requests
@@ -37,34 +194,76 @@ func (c *SpeedTestController) RunTest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// In a real implementation, we would extract the user ID from the authenticated session
-	userID := "anonymous" // Default for unauthenticated users
+	userID, ipInfo := clientInfo(r)
+	opts, err := parseTestOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Get connection type from query parameters
-	isMultiConnection := false
-	multiConnParam := r.URL.Query().Get("isMultiConnection")
-	if multiConnParam == "true" {
-		isMultiConnection = true
+	// Run the speed test with the requested options
+	result, err := c.speedTestService.RunSpeedTest(r.Context(), userID, ipInfo, opts)
+	if err != nil {
+		http.Error(w, "Failed to run speed test: "+err.Error(), testErrorStatus(err))
+		return
 	}
 
-	// Get IP information (in a real implementation, this would come from a geolocation service)
-	ipInfo := map[string]string{
-		"ip":      r.RemoteAddr,
-		"isp":     "Example ISP",
-		"country": "Turkey",
-		"region":  "Istanbul",
+	// Return the result as JSON
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(presentResult(r, result))
+}
+
+// StreamTest handles the request to run a speed test and streams its
+// progress as Server-Sent Events
+func (c *SpeedTestController) StreamTest(w http.ResponseWriter, r *http.Request) {
+	// Enable CORS for all requests
+	enableCORS(w)
+
+	// Handle preflight OPTIONS request
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
 	}
 
-	// Run the speed test with connection type parameter
-	result, err := c.speedTestService.RunSpeedTest(r.Context(), userID, ipInfo, isMultiConnection)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	userID, ipInfo := clientInfo(r)
+	opts, err := parseTestOptions(r)
 	if err != nil {
-		http.Error(w, "Failed to run speed test: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Return the result as JSON
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Events are emitted from the goroutine running the test, which is this
+	// handler's goroutine, so writes never race
+	send := func(event string, data interface{}) {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+		flusher.Flush()
+	}
+
+	// The test is cancelled when the client disconnects
+	result, err := c.speedTestService.RunSpeedTestWithProgress(r.Context(), userID, ipInfo, opts, func(event services.ProgressEvent) {
+		event.Result = presentResult(r, event.Result)
+		send(event.Type, event)
+	})
+	if err != nil {
+		// An aborted test still has a partial result
+		send("test_error", map[string]interface{}{"error": err.Error(), "result": presentResult(r, result)})
+	}
 }
 
 // GetHistory handles the request to get a user's test history
@@ -92,6 +291,10 @@ func (c *SpeedTestController) GetHistory(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	for i, result := range results {
+		results[i] = presentResult(r, result)
+	}
+
 	// Return the results as JSON
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(results)
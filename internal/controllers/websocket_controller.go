@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/services"
+)
+
+// WebSocketController handles browser-driven speed tests over WebSockets
+type WebSocketController struct {
+	speedTestService *services.SpeedTestService
+	upgrader         websocket.Upgrader
+}
+
+// NewWebSocketController creates a new instance of WebSocketController
+func NewWebSocketController(speedTestService *services.SpeedTestService) *WebSocketController {
+	return &WebSocketController{
+		speedTestService: speedTestService,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  64 * 1024,
+			WriteBufferSize: 64 * 1024,
+			// The API allows any origin, see enableCORS
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
+
+// BrowserTest handles /api/speedtest/ws by running a browser-driven speed
+// test over a WebSocket
+func (c *WebSocketController) BrowserTest(w http.ResponseWriter, r *http.Request) {
+	userID, ipInfo := clientInfo(r)
+
+	// Upgrade writes an error response itself on failure
+	conn, err := c.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(services.BrowserReadLimit)
+
+	if _, err := c.speedTestService.RunBrowserTest(r.Context(), conn, userID, ipInfo); err != nil {
+		log.Printf("Browser speed test failed: %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package measure_test
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/controllers"
+	"github.com/cetinibs/online-speed-test-backend-root/internal/measure"
+	"github.com/cetinibs/online-speed-test-backend-root/internal/netem"
+	"github.com/cetinibs/online-speed-test-backend-root/internal/services"
+)
+
+// accuracyLinks are the emulated links the probes are checked against
+var accuracyLinks = []struct {
+	name    string
+	profile string
+	down    float64
+	up      float64
+	rtt     float64
+}{
+	{"dsl", "down=10mbit,up=1mbit,rtt=40ms", 10, 1, 40},
+	{"mobile", "down=30mbit,up=8mbit,rtt=60ms,jitter=5ms,loss=0.5%", 30, 8, 60},
+	{"fiber", "down=500mbit,up=50mbit,rtt=5ms", 500, 50, 5},
+}
+
+const (
+	// accuracyTolerance is the largest relative error the probes may make
+	accuracyTolerance = 0.1
+
+	// latencySlack is the error in milliseconds a latency probe may make
+	// on any link. Waking up the dialer once the emulated handshake is done
+	// adds a fraction of a millisecond, which matters on short links.
+	latencySlack = 2
+)
+
+// newMeasurementServer serves the backend's measurement endpoints
+func newMeasurementServer(t *testing.T) *httptest.Server {
+	measurement := controllers.NewMeasurementController(services.NewLinkEmulator(nil))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/__down", measurement.Download)
+	mux.HandleFunc("/__up", measurement.Upload)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newEmulatedProber returns a prober whose connections to server cross the
+// link of dialer. The link is emulated on the client side because a client
+// counts an upload as the bytes its kernel accepted, and over loopback the
+// kernel accepts megabytes more than a server-side link has carried. Its
+// connections are closed when the test ends, so that they do not carry on
+// draining into the links of later tests.
+func newEmulatedProber(t *testing.T, server *httptest.Server, dialer *netem.Dialer) *measure.ServerProber {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	t.Cleanup(transport.CloseIdleConnections)
+	return &measure.ServerProber{
+		URL:       server.URL,
+		Transport: transport,
+		Pinger:    measure.ConnectPinger{Dialer: dialer, Count: 20},
+		Config: measure.ThroughputConfig{
+			Duration:       3 * time.Second,
+			WarmUp:         time.Second,
+			SampleInterval: 100 * time.Millisecond,
+			TrimFraction:   0.1,
+		},
+		DownloadStreams:      4,
+		UploadStreams:        4,
+		DownloadRequestBytes: 8 << 20,
+		UploadRequestBytes:   1 << 20,
+	}
+}
+
+// checkWithin fails the test if measured is further from want than
+// accuracyTolerance or, if it is larger, slack
+func checkWithin(t *testing.T, what string, measured, want, slack float64) {
+	t.Helper()
+	if allowed := max(want*accuracyTolerance, slack); math.Abs(measured-want) > allowed {
+		t.Errorf("%s measured %.2f; want %.2f within %.2f", what, measured, want, allowed)
+		return
+	}
+	t.Logf("%s measured %.2f of %.2f", what, measured, want)
+}
+
+func TestProbeAccuracy(t *testing.T) {
+	if testing.Short() {
+		t.Skip("accuracy tests run for several seconds per link")
+	}
+	for _, link := range accuracyLinks {
+		t.Run(link.name, func(t *testing.T) {
+			profile, err := netem.ParseProfile(link.profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prober := newEmulatedProber(t, newMeasurementServer(t), netem.NewDialer(nil, profile))
+			latency, err := prober.Latency(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkWithin(t, "latency", latency.Mean, link.rtt, latencySlack)
+
+			download, err := prober.Download(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkWithin(t, "download", download.Mbps, link.down, 0)
+			if download.Streams != prober.DownloadStreams {
+				t.Errorf("ran %d download streams; want %d", download.Streams, prober.DownloadStreams)
+			}
+			if download.Timings == nil || download.Timings.Requests < prober.DownloadStreams {
+				t.Errorf("download timings %+v; want at least one request per stream", download.Timings)
+			}
+
+			upload, err := prober.Upload(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkWithin(t, "upload", upload.Mbps, link.up, 0)
+		})
+	}
+}
+
+func TestProbeCancelled(t *testing.T) {
+	profile, err := netem.ParseProfile(accuracyLinks[0].profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prober := newEmulatedProber(t, newMeasurementServer(t), netem.NewDialer(nil, profile))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := prober.Download(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("cancelled phase returned %v; want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,75 @@
+package measure
+
+import (
+	"time"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+const (
+	// adaptiveStepDuration is how long each stream count runs before the
+	// ramp decides whether to add another stream
+	adaptiveStepDuration = time.Second
+
+	// adaptiveGrowthThreshold is the relative throughput growth a step must
+	// show over the previous one for another stream to be added
+	adaptiveGrowthThreshold = 0.1
+)
+
+// streamRamp decides when an adaptive phase adds a stream. Each step runs
+// for adaptiveStepDuration; a stream is added while the throughput of a step
+// grows past the threshold and the cap has not been reached.
+type streamRamp struct {
+	max       int
+	streams   int
+	stepStart time.Duration
+	window    []float64
+	steps     []models.StreamStep
+	done      bool
+
+	// settledAt is the elapsed phase time at which the last stream was added
+	settledAt time.Duration
+}
+
+func newStreamRamp(max int) *streamRamp {
+	return &streamRamp{max: max, streams: 1}
+}
+
+// observe records a throughput sample and reports whether a stream should
+// be added
+func (r *streamRamp) observe(sample Sample) bool {
+	if r.done {
+		return false
+	}
+	r.window = append(r.window, sample.Mbps)
+	if sample.Elapsed-r.stepStart < adaptiveStepDuration {
+		return false
+	}
+
+	// The first half of a step covers the slow start of the newest stream
+	settled := r.window[len(r.window)/2:]
+	var sum float64
+	for _, mbps := range settled {
+		sum += mbps
+	}
+	step := models.StreamStep{Streams: r.streams, Mbps: sum / float64(len(settled))}
+	r.steps = append(r.steps, step)
+	r.window = nil
+	r.stepStart = sample.Elapsed
+
+	if len(r.steps) > 1 {
+		previous := r.steps[len(r.steps)-2]
+		if step.Mbps < previous.Mbps*(1+adaptiveGrowthThreshold) {
+			r.done = true
+			return false
+		}
+	}
+	if r.streams >= r.max {
+		r.done = true
+		return false
+	}
+
+	r.streams++
+	r.settledAt = sample.Elapsed
+	return true
+}
@@ -0,0 +1,123 @@
+package measure
+
+import (
+	"context"
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+// TestAdaptivePhaseFakeClock drives adaptive phases with a fake clock. Each
+// stream moves 10 Mbps until the link saturates; the test feeds the bytes of
+// every 100ms interval to the streams running at the time, so each ramp step
+// of one second is ten samples.
+func TestAdaptivePhaseFakeClock(t *testing.T) {
+	const (
+		streamMbps = 10
+		interval   = 100 * time.Millisecond
+	)
+	for _, tc := range []struct {
+		name string
+		max  int
+		// linkStreams is the number of streams that saturate the link
+		linkStreams int
+		want        []models.StreamStep
+	}{
+		{
+			name:        "stops when the throughput stops growing",
+			max:         8,
+			linkStreams: 3,
+			want:        []models.StreamStep{{Streams: 1, Mbps: 10}, {Streams: 2, Mbps: 20}, {Streams: 3, Mbps: 30}, {Streams: 4, Mbps: 30}},
+		},
+		{
+			name:        "stops at the stream cap",
+			max:         3,
+			linkStreams: 8,
+			want:        []models.StreamStep{{Streams: 1, Mbps: 10}, {Streams: 2, Mbps: 20}, {Streams: 3, Mbps: 30}},
+		},
+		{
+			name:        "keeps one stream that fills the link",
+			max:         8,
+			linkStreams: 1,
+			want:        []models.StreamStep{{Streams: 1, Mbps: 10}, {Streams: 2, Mbps: 10}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := newFakeClock()
+			started := make(chan *Meter, tc.max+1)
+			samples := make(chan Sample, 1)
+			p := phase{
+				cfg:      ThroughputConfig{Duration: 6 * time.Second, SampleInterval: interval},
+				clock:    clock,
+				streams:  tc.max,
+				adaptive: true,
+				stream: func(ctx context.Context, meter *Meter) error {
+					started <- meter
+					<-ctx.Done()
+					return nil
+				},
+				onSample: func(sample Sample) { samples <- sample },
+			}
+
+			type outcome struct {
+				throughput Throughput
+				err        error
+			}
+			done := make(chan outcome)
+			go func() {
+				throughput, err := p.run(context.Background())
+				done <- outcome{throughput, err}
+			}()
+
+			// Wait for the phase deadline and the sample ticker
+			clock.waitTimers(2)
+			var meters []*Meter
+			for i := 1; i <= 60; i++ {
+				// Each step runs the streams the ramp expects of it, and the
+				// last one for the rest of the phase
+				step := tc.want[min((i-1)/10, len(tc.want)-1)]
+				for len(meters) < step.Streams {
+					select {
+					case meter := <-started:
+						meters = append(meters, meter)
+					case <-time.After(time.Second):
+						t.Fatalf("interval %d runs %d streams; want %d", i, len(meters), step.Streams)
+					}
+				}
+
+				mbps := float64(streamMbps * min(len(meters), tc.linkStreams))
+				perStream := int(mbps * 1e6 / 8 * interval.Seconds() / float64(len(meters)))
+				for _, meter := range meters {
+					meter.Add(perStream)
+				}
+				clock.Advance(interval)
+				// The last tick races the phase deadline
+				if i < 60 {
+					<-samples
+				}
+			}
+
+			result := <-done
+			if result.err != nil {
+				t.Fatal(result.err)
+			}
+			ramp := result.throughput.Ramp
+			for i := range ramp {
+				ramp[i].Mbps = math.Round(ramp[i].Mbps)
+			}
+			if !slices.Equal(ramp, tc.want) {
+				t.Fatalf("ramp %+v; want %+v", ramp, tc.want)
+			}
+			if last := tc.want[len(tc.want)-1]; result.throughput.Streams != last.Streams || len(started) != 0 {
+				t.Fatalf("ended with %d streams, %d more started; want %d", result.throughput.Streams, len(started), last.Streams)
+			}
+			// The steady state is only taken once the last stream was added
+			if want := float64(streamMbps * min(tc.want[len(tc.want)-1].Streams, tc.linkStreams)); math.Abs(result.throughput.Mbps-want) > 1e-6 {
+				t.Fatalf("measured %.3f Mbps; want %.0f", result.throughput.Mbps, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package measure
+
+import (
+	"context"
+	"time"
+)
+
+// Clock tells the time and paces measurements. Probers read every timestamp
+// from their clock, so tests can inject a fake one.
+type Clock interface {
+	Now() time.Time
+	// NewTicker returns a ticker that fires every d
+	NewTicker(d time.Duration) Ticker
+	// After returns a channel that receives the time once d has passed
+	After(d time.Duration) <-chan time.Time
+}
+
+// Ticker delivers ticks of a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock is the wall clock of the machine
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+type systemTicker struct{ ticker *time.Ticker }
+
+func (t systemTicker) C() <-chan time.Time { return t.ticker.C }
+func (t systemTicker) Stop()               { t.ticker.Stop() }
+
+// clockOrSystem returns clock, or the system clock if it is nil
+func clockOrSystem(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock
+	}
+	return clock
+}
+
+// Sleep pauses for d on clock, returning early with an error if ctx is done
+func Sleep(ctx context.Context, clock Clock, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-clockOrSystem(clock).After(d):
+		return nil
+	}
+}
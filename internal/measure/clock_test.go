@@ -0,0 +1,121 @@
+package measure
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when the test advances it
+type fakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// fakeTimer backs the tickers and After channels of a fakeClock. A period of
+// zero fires once.
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Time
+	period  time.Duration
+	ch      chan time.Time
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	c := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return c.add(d, d)
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, 0).ch
+}
+
+func (c *fakeClock) add(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := &fakeTimer{clock: c, at: c.now.Add(d), period: period, ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.ch <- c.now
+		timer.stopped = true
+	}
+	c.timers = append(c.timers, timer)
+	c.cond.Broadcast()
+	return timer
+}
+
+// Advance moves the clock forward by d and fires the timers that are due.
+// Like time.Ticker, a tick is dropped if the previous one was not received.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, timer := range c.timers {
+		for !timer.stopped && !timer.at.After(c.now) {
+			select {
+			case timer.ch <- c.now:
+			default:
+			}
+			if timer.period == 0 {
+				timer.stopped = true
+			} else {
+				timer.at = timer.at.Add(timer.period)
+			}
+		}
+	}
+}
+
+// waitTimers blocks until n timers have been created
+func (c *fakeClock) waitTimers(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+func (t *fakeTimer) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.stopped = true
+}
+
+func TestFakeClockTicker(t *testing.T) {
+	clock := newFakeClock()
+	ticker := clock.NewTicker(100 * time.Millisecond)
+	after := clock.After(250 * time.Millisecond)
+
+	clock.Advance(100 * time.Millisecond)
+	select {
+	case <-ticker.C():
+	default:
+		t.Fatal("ticker did not fire after one period")
+	}
+	clock.Advance(100 * time.Millisecond)
+	select {
+	case <-after:
+		t.Fatal("After fired early")
+	default:
+	}
+	clock.Advance(100 * time.Millisecond)
+	select {
+	case <-after:
+	default:
+		t.Fatal("After did not fire")
+	}
+}
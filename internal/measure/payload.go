@@ -0,0 +1,160 @@
+package measure
+
+import (
+	"crypto/rand"
+	"io"
+	mathrand "math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// payloadBlockSize is the size of the random block upload bodies are
+	// cut from. It is far larger than the window of common compressors, so
+	// the repeated block does not compress.
+	payloadBlockSize = 4 << 20
+
+	// payloadChunkSize is the most a payload reader hands to a writer at
+	// once, which keeps the byte meter updated smoothly
+	payloadChunkSize = 64 << 10
+
+	// minUploadChunk is the smallest chunk a metered payload reader hands
+	// out, and the size of its first chunk
+	minUploadChunk = 4 << 10
+
+	// uploadChunkTime is how long a metered payload reader aims for the
+	// writer to take over each chunk
+	uploadChunkTime = 10 * time.Millisecond
+)
+
+var (
+	payloadOnce  sync.Once
+	payloadBlock []byte
+)
+
+// sharedPayload returns the random block shared by every upload. It is
+// generated on first use.
+func sharedPayload() []byte {
+	payloadOnce.Do(func() {
+		payloadBlock = make([]byte, payloadBlockSize)
+		rand.Read(payloadBlock)
+	})
+	return payloadBlock
+}
+
+// payloadReader streams a non-compressible request body of a fixed size
+// from the shared random block, reporting every byte sent to meter if it is
+// set. No payload is generated or allocated per request; Read copies from
+// the block and WriteTo hands it to the writer directly.
+//
+// Bytes are counted when the writer takes them, ahead of the network. On a
+// slow link a full chunk takes the writer longer than a sample interval, so
+// the meter would jump once every few samples and the trimmed mean would
+// drop the jumps. A metered reader therefore sizes each chunk to what the
+// writer took about uploadChunkTime to send last time, as timed by its clock.
+type payloadReader struct {
+	block     []byte
+	offset    int
+	remaining int64
+	meter     *Meter
+	clock     Clock
+
+	// handed is the size of the previous chunk and handedAt when it was
+	// handed out
+	handed   int
+	handedAt time.Time
+}
+
+// newPayloadReader returns a reader of size bytes. Each reader starts at a
+// random offset so parallel streams do not send identical bytes. A metered
+// reader paces its chunks with clock; nil uses the system clock.
+func newPayloadReader(size int64, meter *Meter, clock Clock) *payloadReader {
+	return &payloadReader{
+		block:     sharedPayload(),
+		offset:    mathrand.Intn(payloadBlockSize),
+		remaining: size,
+		meter:     meter,
+		clock:     clockOrSystem(clock),
+	}
+}
+
+// NewPayloadReader returns a non-compressible reader of size bytes for
+// serving download measurements
+func NewPayloadReader(size int64) io.Reader {
+	return newPayloadReader(size, nil, nil)
+}
+
+// next returns the next slice of the payload, at most max bytes long
+func (p *payloadReader) next(max int) []byte {
+	if p.offset == len(p.block) {
+		p.offset = 0
+	}
+	chunk := p.block[p.offset:]
+	if len(chunk) > max {
+		chunk = chunk[:max]
+	}
+	if int64(len(chunk)) > p.remaining {
+		chunk = chunk[:p.remaining]
+	}
+	return chunk
+}
+
+// advance consumes n bytes of the payload
+func (p *payloadReader) advance(n int) {
+	p.offset += n
+	p.remaining -= int64(n)
+	if p.meter != nil && n > 0 {
+		p.meter.Add(n)
+	}
+}
+
+// handOut records that a chunk of n bytes was handed to the writer at at
+func (p *payloadReader) handOut(n int, at time.Time) {
+	if p.meter != nil {
+		p.handed, p.handedAt = n, at
+	}
+}
+
+// chunkLimit returns the most the next chunk may hold. It is only below
+// payloadChunkSize for metered readers whose writer is slow.
+func (p *payloadReader) chunkLimit() int {
+	if p.meter == nil {
+		return payloadChunkSize
+	}
+	if p.handedAt.IsZero() {
+		return minUploadChunk
+	}
+	elapsed := p.clock.Now().Sub(p.handedAt)
+	if elapsed <= 0 {
+		return payloadChunkSize
+	}
+	size := int(float64(p.handed) * float64(uploadChunkTime) / float64(elapsed))
+	return min(max(size, minUploadChunk), payloadChunkSize)
+}
+
+func (p *payloadReader) Read(b []byte) (int, error) {
+	if p.remaining <= 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, p.next(min(len(b), p.chunkLimit())))
+	p.advance(n)
+	p.handOut(n, p.clock.Now())
+	return n, nil
+}
+
+// WriteTo writes the rest of the payload to w without an intermediate
+// buffer. io.Copy prefers it over Read.
+func (p *payloadReader) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for p.remaining > 0 {
+		chunk, start := p.next(p.chunkLimit()), p.clock.Now()
+		n, err := w.Write(chunk)
+		p.advance(n)
+		p.handOut(n, start)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,116 @@
+package measure
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// benchmarkRequestBytes is the body size of each benchmarked request
+const benchmarkRequestBytes = 8 << 20
+
+func TestPayloadReaderSize(t *testing.T) {
+	for _, size := range []int64{0, 1, payloadChunkSize + 1, payloadBlockSize + 3} {
+		meter := &Meter{}
+		n, err := io.Copy(io.Discard, newPayloadReader(size, meter, nil))
+		if err != nil || n != size {
+			t.Fatalf("copied %d bytes, err %v; want %d", n, err, size)
+		}
+		if got := meter.Total(); got != size {
+			t.Fatalf("meter counted %d bytes; want %d", got, size)
+		}
+
+		read, err := io.ReadAll(struct{ io.Reader }{newPayloadReader(size, nil, nil)})
+		if err != nil || int64(len(read)) != size {
+			t.Fatalf("read %d bytes, err %v; want %d", len(read), err, size)
+		}
+	}
+}
+
+// slowWriter takes a fixed time on clock over every write, like a slow
+// upload link
+type slowWriter struct {
+	clock  *fakeClock
+	delay  time.Duration
+	writes []int
+}
+
+func (w *slowWriter) Write(b []byte) (int, error) {
+	w.clock.Advance(w.delay)
+	w.writes = append(w.writes, len(b))
+	return len(b), nil
+}
+
+func TestPayloadReaderShrinksChunksForSlowWriters(t *testing.T) {
+	clock := newFakeClock()
+	w := &slowWriter{clock: clock, delay: 20 * time.Millisecond}
+	io.Copy(w, newPayloadReader(4*payloadChunkSize, &Meter{}, clock))
+	// A writer taking 20ms per chunk is handed the smallest chunks after
+	// the first, which is the smallest already
+	for i, n := range w.writes[:5] {
+		if n != minUploadChunk {
+			t.Fatalf("write %d took %d bytes; want %d", i, n, minUploadChunk)
+		}
+	}
+
+	// A writer taking 1ms over the first chunk is handed ten times as much,
+	// enough for the rest of uploadChunkTime
+	w = &slowWriter{clock: clock, delay: time.Millisecond}
+	io.Copy(w, newPayloadReader(payloadChunkSize, &Meter{}, clock))
+	if len(w.writes) < 2 || w.writes[1] != 10*minUploadChunk {
+		t.Fatalf("fast writer took %v; want a second chunk of %d", w.writes, 10*minUploadChunk)
+	}
+
+	// An unmetered reader always hands out full chunks
+	w = &slowWriter{clock: clock, delay: 20 * time.Millisecond}
+	io.Copy(w, newPayloadReader(2*payloadChunkSize, nil, nil))
+	if len(w.writes) != 2 {
+		t.Fatalf("unmetered reader wrote %v; want two full chunks", w.writes)
+	}
+}
+
+func TestPayloadReaderIsNotCompressible(t *testing.T) {
+	var compressed bytes.Buffer
+	w, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	io.Copy(w, newPayloadReader(2*payloadBlockSize, nil, nil))
+	w.Close()
+	if ratio := float64(compressed.Len()) / float64(2*payloadBlockSize); ratio < 0.99 {
+		t.Fatalf("payload compressed to %.2f of its size", ratio)
+	}
+}
+
+// BenchmarkPayloadMathRand measures the body the upload streams used to
+// send: bytes generated by math/rand on every request
+func BenchmarkPayloadMathRand(b *testing.B) {
+	b.SetBytes(benchmarkRequestBytes)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		source := rand.New(rand.NewSource(time.Now().UnixNano()))
+		io.Copy(io.Discard, io.LimitReader(source, benchmarkRequestBytes))
+	}
+}
+
+// BenchmarkPayloadAllocated measures a body allocated and filled per request
+func BenchmarkPayloadAllocated(b *testing.B) {
+	b.SetBytes(benchmarkRequestBytes)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		payload := make([]byte, benchmarkRequestBytes)
+		rand.Read(payload)
+		io.Copy(io.Discard, bytes.NewReader(payload))
+	}
+}
+
+func BenchmarkPayloadReader(b *testing.B) {
+	sharedPayload()
+	meter := &Meter{}
+	b.SetBytes(benchmarkRequestBytes)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		io.Copy(io.Discard, newPayloadReader(benchmarkRequestBytes, meter, nil))
+	}
+}
@@ -0,0 +1,64 @@
+// Package measure implements the latency and throughput measurements of a
+// speed test. Probers take their network access and clock as dependencies,
+// so every measurement can run against local test servers.
+package measure
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Prober measures the latency, download speed and upload speed of a link
+type Prober interface {
+	Latency(ctx context.Context) (LatencyStats, error)
+	Download(ctx context.Context) (Throughput, error)
+	Upload(ctx context.Context) (Throughput, error)
+}
+
+// Dialer opens network connections. *net.Dialer implements it.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// ConnectPinger measures round-trip times as the time taken to open a TCP
+// connection, which needs no cooperation from the remote host
+type ConnectPinger struct {
+	// Dialer opens the connections; nil uses a net.Dialer
+	Dialer Dialer
+	// Clock times the connects; nil uses the system clock
+	Clock Clock
+	// Count is the number of connects to each address
+	Count int
+	// Interval is the pause between connects
+	Interval time.Duration
+}
+
+// RTTs measures the connect time to addr over network Count times. It
+// returns the successful samples in milliseconds and the last error. Once
+// ctx is done it stops and returns the samples taken so far.
+func (p ConnectPinger) RTTs(ctx context.Context, network string, addr string) ([]float64, error) {
+	dialer := p.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	clock := clockOrSystem(p.Clock)
+
+	var rtts []float64
+	var lastErr error
+	for i := 0; i < p.Count && ctx.Err() == nil; i++ {
+		if i > 0 && Sleep(ctx, clock, p.Interval) != nil {
+			break
+		}
+
+		start := clock.Now()
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		rtts = append(rtts, Millis(clock.Now().Sub(start)))
+		conn.Close()
+	}
+	return rtts, lastErr
+}
@@ -0,0 +1,191 @@
+package measure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Ways a PublicProber measures latency
+const (
+	// PingTCPConnect times TCP connects to port 80 of each host
+	PingTCPConnect = "tcp_connect"
+	// PingHTTPHead times HTTPS HEAD requests to each host, for networks
+	// that block plain TCP to them
+	PingHTTPHead = "http_head"
+)
+
+// publicRequestTimeout bounds every request to a public endpoint
+const publicRequestTimeout = 15 * time.Second
+
+// PublicProber measures a link against public internet endpoints when no
+// test server can be used. The files and echo endpoints it transfers are
+// small, so its speeds underestimate fast links.
+type PublicProber struct {
+	// PingHosts are the hosts whose round-trip time is the latency
+	PingHosts []string
+	// PingMethod is PingTCPConnect or PingHTTPHead
+	PingMethod string
+	// PingCount is the number of pings sent to each host
+	PingCount int
+	// PingInterval is the pause after each ping
+	PingInterval time.Duration
+
+	// DownloadURLs are the files downloaded to measure the download speed
+	DownloadURLs []string
+	// UploadURLs are the echo endpoints UploadBytes are posted to
+	UploadURLs  []string
+	UploadBytes int64
+
+	// Transport sends the HTTP requests; nil uses http.DefaultTransport
+	Transport http.RoundTripper
+	// Dialer opens the TCP connections of PingTCPConnect
+	Dialer Dialer
+	// Clock times every measurement; nil uses the system clock
+	Clock Clock
+}
+
+// Latency pings every host and combines their RTTs. It fails if fewer than
+// three pings succeed.
+func (p *PublicProber) Latency(ctx context.Context) (LatencyStats, error) {
+	var series [][]float64
+	var count int
+	for _, host := range p.PingHosts {
+		var rtts []float64
+		if p.PingMethod == PingHTTPHead {
+			rtts = p.headRTTs(ctx, host)
+		} else {
+			pinger := ConnectPinger{Dialer: p.Dialer, Clock: p.Clock, Count: p.PingCount, Interval: p.PingInterval}
+			rtts, _ = pinger.RTTs(ctx, "tcp", host+":80")
+		}
+		if ctx.Err() != nil {
+			return LatencyStats{}, ctx.Err()
+		}
+		series = append(series, rtts)
+		count += len(rtts)
+	}
+
+	if count < 3 {
+		return LatencyStats{}, fmt.Errorf("not enough successful pings")
+	}
+	return NewLatencyStats(series...), nil
+}
+
+// headRTTs times PingCount HEAD requests to host, skipping failed ones
+func (p *PublicProber) headRTTs(ctx context.Context, host string) []float64 {
+	clock := clockOrSystem(p.Clock)
+	client := p.client()
+
+	var rtts []float64
+	for i := 0; i < p.PingCount; i++ {
+		start := clock.Now()
+		req, err := http.NewRequestWithContext(ctx, "HEAD", "https://"+host, nil)
+		if err != nil {
+			return rtts
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return rtts
+			}
+			continue
+		}
+		resp.Body.Close()
+		rtts = append(rtts, Millis(clock.Now().Sub(start)))
+		if Sleep(ctx, clock, p.PingInterval) != nil {
+			return rtts
+		}
+	}
+	return rtts
+}
+
+// Download downloads every file and returns the median speed
+func (p *PublicProber) Download(ctx context.Context) (Throughput, error) {
+	speeds, err := p.transfer(ctx, "download", p.DownloadURLs, func(url string) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", url, nil)
+	})
+	if err != nil {
+		return Throughput{}, err
+	}
+	return Throughput{Mbps: speeds[len(speeds)/2]}, nil
+}
+
+// Upload posts UploadBytes to every echo endpoint and returns the median
+// speed
+func (p *PublicProber) Upload(ctx context.Context) (Throughput, error) {
+	speeds, err := p.transfer(ctx, "upload", p.UploadURLs, func(url string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, newPayloadReader(p.UploadBytes, nil, nil))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = p.UploadBytes
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+	})
+	if err != nil {
+		return Throughput{}, err
+	}
+	return Throughput{Mbps: speeds[len(speeds)/2]}, nil
+}
+
+// transfer sends the request newRequest makes for each URL and returns the
+// sorted speeds of the transfers that succeeded. The speed counts the
+// request body if there is one and the response body otherwise, over the
+// whole exchange. A URL that answers with an error status is skipped, and
+// if no transfer succeeds transfer returns the last failure.
+func (p *PublicProber) transfer(ctx context.Context, what string, urls []string, newRequest func(url string) (*http.Request, error)) ([]float64, error) {
+	clock := clockOrSystem(p.Clock)
+	client := p.client()
+
+	var speeds []float64
+	lastErr := errors.New("no URLs to test")
+	for _, url := range urls {
+		req, err := newRequest(url)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		start := clock.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+			continue
+		}
+		received, _ := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		elapsed := clock.Now().Sub(start).Seconds()
+		bytes := received
+		if req.ContentLength > 0 {
+			bytes = req.ContentLength
+		}
+		if bytes > 0 && elapsed > 0 {
+			speeds = append(speeds, float64(bytes)*8/1000000/elapsed)
+		}
+	}
+	if len(speeds) == 0 {
+		return nil, fmt.Errorf("all alternative %s tests failed: %w", what, lastErr)
+	}
+	sort.Float64s(speeds)
+	return speeds, nil
+}
+
+// client returns an HTTP client over the prober's transport
+func (p *PublicProber) client() *http.Client {
+	return &http.Client{Transport: p.Transport, Timeout: publicRequestTimeout}
+}
@@ -0,0 +1,141 @@
+package measure
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPublicProberSpeedsFakeClock serves every transfer instantly and lets
+// each URL advance a fake clock by its own duration, so the speed of each
+// transfer is known exactly
+func TestPublicProberSpeedsFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	durations := map[string]time.Duration{
+		"https://a.example/file": 100 * time.Millisecond,
+		"https://b.example/file": 200 * time.Millisecond,
+		"https://c.example/file": 400 * time.Millisecond,
+	}
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body := io.NopCloser(bytes.NewReader(make([]byte, 1000000)))
+		if req.Body != nil {
+			io.Copy(io.Discard, req.Body)
+			body = io.NopCloser(strings.NewReader("{}"))
+		}
+		clock.Advance(durations[req.URL.String()])
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: body, Request: req}, nil
+	})
+	urls := []string{"https://a.example/file", "https://b.example/file", "https://c.example/file"}
+	prober := &PublicProber{
+		DownloadURLs: urls,
+		UploadURLs:   urls,
+		UploadBytes:  500000,
+		Transport:    transport,
+		Clock:        clock,
+	}
+
+	// 1MB takes 100ms, 200ms and 400ms: 80, 40 and 20 Mbps
+	download, err := prober.Download(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(download.Mbps-40) > 1e-9 {
+		t.Fatalf("download %.3f Mbps; want the median of 40", download.Mbps)
+	}
+
+	// Only the 500KB body counts, not the echoed response: 40, 20 and 10 Mbps
+	upload, err := prober.Upload(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(upload.Mbps-20) > 1e-9 {
+		t.Fatalf("upload %.3f Mbps; want the median of 20", upload.Mbps)
+	}
+}
+
+func TestPublicProberSkipsErrorStatus(t *testing.T) {
+	clock := newFakeClock()
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Body != nil {
+			io.Copy(io.Discard, req.Body)
+		}
+		clock.Advance(100 * time.Millisecond)
+		if req.URL.Host == "down.example" {
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("busy")), Request: req}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(make([]byte, 1000000))), Request: req}, nil
+	})
+	prober := &PublicProber{
+		DownloadURLs: []string{"https://down.example/file", "https://up.example/file"},
+		UploadURLs:   []string{"https://down.example/file"},
+		UploadBytes:  500000,
+		Transport:    transport,
+		Clock:        clock,
+	}
+
+	// Only the working URL counts: 1MB in 100ms
+	download, err := prober.Download(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(download.Mbps-80) > 1e-9 {
+		t.Fatalf("download %.3f Mbps; want 80", download.Mbps)
+	}
+
+	// An upload refused by every URL is not counted as sent
+	if upload, err := prober.Upload(context.Background()); err == nil {
+		t.Fatalf("upload to failing URLs measured %.3f Mbps", upload.Mbps)
+	}
+}
+
+func TestPublicProberHeadLatency(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			t.Errorf("ping sent a %s request", r.Method)
+		}
+	}))
+	defer server.Close()
+
+	prober := &PublicProber{
+		PingHosts:  []string{server.Listener.Addr().String()},
+		PingMethod: PingHTTPHead,
+		PingCount:  3,
+		Transport:  server.Client().Transport,
+	}
+	latency, err := prober.Latency(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(latency.Samples) != 3 {
+		t.Fatalf("took %d samples; want 3", len(latency.Samples))
+	}
+}
+
+func TestPublicProberLatencyNeedsThreePings(t *testing.T) {
+	var dials int
+	dialer := dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials++
+		if dials > 2 {
+			return nil, errors.New("unreachable")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	})
+	prober := &PublicProber{
+		PingHosts: []string{"a.example", "b.example"},
+		PingCount: 2,
+		Dialer:    dialer,
+	}
+	if _, err := prober.Latency(context.Background()); err == nil {
+		t.Fatal("latency measured from two pings")
+	}
+}
@@ -0,0 +1,242 @@
+package measure
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// downloadBufferSize is the read buffer of each download stream
+const downloadBufferSize = 64 * 1024
+
+// Phases a throughput sample can belong to
+const (
+	PhaseDownload = "download"
+	PhaseUpload   = "upload"
+)
+
+// HTTP protocols a throughput phase can run over
+const (
+	ProtocolHTTP1 = "http/1.1"
+	ProtocolHTTP2 = "h2"
+	ProtocolHTTP3 = "h3"
+)
+
+// ServerProber measures a link against a test server. Latency is the TCP
+// connect time to the server; download and upload speeds are measured over
+// parallel streams of requests to its /__down and /__up endpoints.
+type ServerProber struct {
+	// URL is the base URL of the test server
+	URL string
+	// Transport sends the download and upload requests; nil uses
+	// http.DefaultTransport
+	Transport http.RoundTripper
+	// Pinger measures the latency to the server
+	Pinger ConnectPinger
+	// Clock times the throughput phases; nil uses the system clock
+	Clock Clock
+	// Config times the throughput phases
+	Config ThroughputConfig
+
+	DownloadStreams      int
+	UploadStreams        int
+	DownloadRequestBytes int64
+	UploadRequestBytes   int64
+	// Adaptive starts each phase with one stream and adds streams while the
+	// throughput keeps growing, up to DownloadStreams or UploadStreams
+	Adaptive bool
+
+	// OnSample receives every throughput sample of the download and upload
+	// phase as it is taken. It is called from the goroutine running the
+	// phase.
+	OnSample func(phase string, sample Sample)
+}
+
+// Latency measures the TCP connect time to the server
+func (p *ServerProber) Latency(ctx context.Context) (LatencyStats, error) {
+	addr, err := ServerAddress(p.URL)
+	if err != nil {
+		return LatencyStats{}, err
+	}
+	rtts, err := p.Pinger.RTTs(ctx, "tcp", addr)
+	if len(rtts) == 0 {
+		if err == nil {
+			err = ctx.Err()
+		}
+		return LatencyStats{}, fmt.Errorf("test server is not reachable: %v", err)
+	}
+	return NewLatencyStats(rtts), nil
+}
+
+// Download measures the download speed from the server
+func (p *ServerProber) Download(ctx context.Context) (Throughput, error) {
+	return p.runPhase(ctx, PhaseDownload, p.DownloadStreams, func(client *protocolRecorder, timings *timingRecorder) streamFunc {
+		return downloadStream(client, timings, p.URL, p.DownloadRequestBytes)
+	})
+}
+
+// Upload measures the upload speed to the server
+func (p *ServerProber) Upload(ctx context.Context) (Throughput, error) {
+	return p.runPhase(ctx, PhaseUpload, p.UploadStreams, func(client *protocolRecorder, timings *timingRecorder) streamFunc {
+		return uploadStream(client, timings, clockOrSystem(p.Clock), p.URL, p.UploadRequestBytes)
+	})
+}
+
+// runPhase runs a timed phase of streams made by newStream, recording the
+// connection timings and the protocol the server answered with
+func (p *ServerProber) runPhase(ctx context.Context, name string, streams int, newStream func(*protocolRecorder, *timingRecorder) streamFunc) (Throughput, error) {
+	clock := clockOrSystem(p.Clock)
+	transport := p.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	client := &protocolRecorder{client: &http.Client{Transport: transport}}
+	timings := newTimingRecorder(clock)
+
+	ph := phase{
+		cfg:      p.Config,
+		clock:    clock,
+		streams:  streams,
+		adaptive: p.Adaptive,
+		stream:   newStream(client, timings),
+	}
+	if p.OnSample != nil {
+		ph.onSample = func(sample Sample) { p.OnSample(name, sample) }
+	}
+	result, err := ph.run(ctx)
+	result.Timings = timings.summary()
+	result.Protocol = client.protocol()
+	return result, err
+}
+
+// protocolRecorder sends requests and remembers the protocol the last
+// response was received with
+type protocolRecorder struct {
+	client *http.Client
+
+	mu         sync.Mutex
+	negotiated string
+}
+
+func (c *protocolRecorder) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.negotiated = ProtocolName(resp.ProtoMajor)
+	c.mu.Unlock()
+	return resp, nil
+}
+
+// protocol returns the protocol of the last response, or "" if no request
+// succeeded
+func (c *protocolRecorder) protocol() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.negotiated
+}
+
+// ProtocolName maps an HTTP major version to its protocol name
+func ProtocolName(major int) string {
+	switch major {
+	case 2:
+		return ProtocolHTTP2
+	case 3:
+		return ProtocolHTTP3
+	}
+	return ProtocolHTTP1
+}
+
+// downloadStream repeatedly downloads requestBytes from the server at
+// baseURL until ctx is done, recording the timing of each request
+func downloadStream(client *protocolRecorder, timings *timingRecorder, baseURL string, requestBytes int64) streamFunc {
+	return func(ctx context.Context, meter *Meter) error {
+		url := fmt.Sprintf("%s/__down?bytes=%d", baseURL, requestBytes)
+		buf := make([]byte, downloadBufferSize)
+
+		for ctx.Err() == nil {
+			req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+			if err != nil {
+				return err
+			}
+			resp, err := client.do(timings.trace(req))
+			if err != nil {
+				return phaseError(ctx, err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				return fmt.Errorf("download returned status %d", resp.StatusCode)
+			}
+
+			for {
+				n, err := resp.Body.Read(buf)
+				if n > 0 {
+					meter.Add(n)
+				}
+				if err != nil {
+					resp.Body.Close()
+					if err != io.EOF {
+						return phaseError(ctx, err)
+					}
+					break
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// uploadStream repeatedly uploads requestBytes of random data to the server
+// at baseURL until ctx is done, recording the timing of each request. The
+// bodies are paced with clock.
+func uploadStream(client *protocolRecorder, timings *timingRecorder, clock Clock, baseURL string, requestBytes int64) streamFunc {
+	return func(ctx context.Context, meter *Meter) error {
+		url := baseURL + "/__up"
+
+		for ctx.Err() == nil {
+			body := newPayloadReader(requestBytes, meter, clock)
+			req, err := http.NewRequestWithContext(ctx, "POST", url, body)
+			if err != nil {
+				return err
+			}
+			req.ContentLength = requestBytes
+			req.Header.Set("Content-Type", "application/octet-stream")
+
+			resp, err := client.do(timings.trace(req))
+			if err != nil {
+				return phaseError(ctx, err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("upload returned status %d", resp.StatusCode)
+			}
+		}
+		return nil
+	}
+}
+
+// ServerAddress returns the host:port to dial for a server URL
+func ServerAddress(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("test server url %q has no host", rawURL)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
@@ -0,0 +1,147 @@
+package measure
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// roundTripperFunc adapts a function to http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// dialerFunc adapts a function to Dialer
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+func TestServerProberLatency(t *testing.T) {
+	clock := newFakeClock()
+	delays := []time.Duration{10 * time.Millisecond, 30 * time.Millisecond, 20 * time.Millisecond}
+	var dials int
+	dialer := dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network != "tcp" || addr != "speed.example:443" {
+			t.Errorf("dialed %s %s", network, addr)
+		}
+		clock.Advance(delays[dials])
+		dials++
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	})
+
+	prober := &ServerProber{
+		URL:    "https://speed.example",
+		Pinger: ConnectPinger{Dialer: dialer, Clock: clock, Count: len(delays)},
+	}
+	latency, err := prober.Latency(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latency.Mean != 20 || latency.Median != 20 || latency.Min != 10 || latency.Max != 30 {
+		t.Fatalf("latency %+v; want mean and median 20, min 10, max 30", latency)
+	}
+	// RFC 3550 jitter: the mean of |30-10| and |20-30|
+	if latency.Jitter != 15 {
+		t.Fatalf("jitter %.2f; want 15", latency.Jitter)
+	}
+}
+
+func TestServerProberLatencyUnreachable(t *testing.T) {
+	dialer := dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: io.ErrUnexpectedEOF}
+	})
+	prober := &ServerProber{
+		URL:    "http://speed.example",
+		Pinger: ConnectPinger{Dialer: dialer, Count: 3},
+	}
+	if _, err := prober.Latency(context.Background()); err == nil {
+		t.Fatal("unreachable server has a latency")
+	}
+}
+
+// TestServerProberDownloadFakeClock drives a download phase with a fake
+// clock and a transport whose body delivers exactly 125000 bytes per 100ms
+// interval, which is 10 Mbps
+func TestServerProberDownloadFakeClock(t *testing.T) {
+	const intervalBytes = 125000
+	clock := newFakeClock()
+	body, feed := io.Pipe()
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		go func() {
+			<-req.Context().Done()
+			feed.CloseWithError(req.Context().Err())
+		}()
+		return &http.Response{StatusCode: http.StatusOK, ProtoMajor: 1, Header: http.Header{}, Body: body, Request: req}, nil
+	})
+
+	samples := make(chan Sample, 1)
+	prober := &ServerProber{
+		URL:       "http://speed.example",
+		Transport: transport,
+		Clock:     clock,
+		Config: ThroughputConfig{
+			Duration:       2 * time.Second,
+			WarmUp:         500 * time.Millisecond,
+			SampleInterval: 100 * time.Millisecond,
+		},
+		DownloadStreams:      1,
+		DownloadRequestBytes: 1 << 30,
+		OnSample: func(phase string, sample Sample) {
+			if phase != PhaseDownload {
+				t.Errorf("sample of phase %q", phase)
+			}
+			samples <- sample
+		},
+	}
+
+	type outcome struct {
+		throughput Throughput
+		err        error
+	}
+	done := make(chan outcome)
+	go func() {
+		throughput, err := prober.Download(context.Background())
+		done <- outcome{throughput, err}
+	}()
+
+	// Wait for the phase deadline and the sample ticker
+	clock.waitTimers(2)
+	chunk := make([]byte, intervalBytes)
+	for i := 1; i <= 20; i++ {
+		feed.Write(chunk)
+		// An empty write returns once the stream reads again, so the chunk
+		// has been counted
+		feed.Write(nil)
+		clock.Advance(100 * time.Millisecond)
+		// The last tick races the phase deadline
+		if i < 20 {
+			if sample := <-samples; math.Abs(sample.Mbps-10) > 1e-9 {
+				t.Fatalf("sample %d is %.3f Mbps; want 10", i, sample.Mbps)
+			}
+		}
+	}
+
+	result := <-done
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	if math.Abs(result.throughput.Mbps-10) > 1e-9 {
+		t.Fatalf("measured %.3f Mbps; want 10", result.throughput.Mbps)
+	}
+	if result.throughput.Streams != 1 || result.throughput.Protocol != ProtocolHTTP1 {
+		t.Fatalf("streams %d, protocol %q; want 1 over %s", result.throughput.Streams, result.throughput.Protocol, ProtocolHTTP1)
+	}
+	if result.throughput.Trace.Bytes != 20*intervalBytes {
+		t.Fatalf("trace counted %d bytes; want %d", result.throughput.Trace.Bytes, 20*intervalBytes)
+	}
+}
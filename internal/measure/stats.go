@@ -0,0 +1,108 @@
+package measure
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Median returns the median of values without modifying the slice
+func Median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// TrimmedMean drops the given fraction of the lowest and highest values and
+// returns the mean of the rest
+func TrimmedMean(values []float64, trim float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	cut := int(float64(len(sorted)) * trim)
+	kept := sorted[cut : len(sorted)-cut]
+
+	var sum float64
+	for _, v := range kept {
+		sum += v
+	}
+	return sum / float64(len(kept))
+}
+
+// LatencyStats summarizes round-trip time samples in milliseconds
+type LatencyStats struct {
+	Mean    float64
+	Jitter  float64
+	Min     float64
+	Max     float64
+	Median  float64
+	P95     float64
+	Samples []float64
+}
+
+// NewLatencyStats computes latency statistics from one or more RTT series.
+// Jitter follows RFC 3550: it is the mean absolute difference between
+// consecutive samples, taken within each series so that switching between
+// hosts is not counted as delay variation.
+func NewLatencyStats(series ...[]float64) LatencyStats {
+	var stats LatencyStats
+	var diffSum float64
+	var diffCount int
+	for _, rtts := range series {
+		stats.Samples = append(stats.Samples, rtts...)
+		for i := 1; i < len(rtts); i++ {
+			diffSum += math.Abs(rtts[i] - rtts[i-1])
+			diffCount++
+		}
+	}
+	if len(stats.Samples) == 0 {
+		return stats
+	}
+
+	var sum float64
+	stats.Min, stats.Max = stats.Samples[0], stats.Samples[0]
+	for _, rtt := range stats.Samples {
+		sum += rtt
+		stats.Min = math.Min(stats.Min, rtt)
+		stats.Max = math.Max(stats.Max, rtt)
+	}
+	stats.Mean = sum / float64(len(stats.Samples))
+	stats.Median = Median(stats.Samples)
+	stats.P95 = Percentile(stats.Samples, 95)
+	if diffCount > 0 {
+		stats.Jitter = diffSum / float64(diffCount)
+	}
+	return stats
+}
+
+// Percentile returns the p-th percentile of values using the nearest-rank
+// method
+func Percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Millis converts a duration to fractional milliseconds
+func Millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
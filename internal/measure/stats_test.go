@@ -0,0 +1,43 @@
+package measure
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestNewLatencyStats(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		series [][]float64
+		want   LatencyStats
+	}{
+		{"no samples", nil, LatencyStats{}},
+		{"empty series", [][]float64{{}, {}}, LatencyStats{}},
+		{
+			"single sample",
+			[][]float64{{20}},
+			LatencyStats{Mean: 20, Min: 20, Max: 20, Median: 20, P95: 20, Samples: []float64{20}},
+		},
+		{
+			// RFC 3550 jitter: the mean of |30-10|, |20-30| and |40-20|
+			"known sequence",
+			[][]float64{{10, 30, 20, 40}},
+			LatencyStats{Mean: 25, Jitter: 50.0 / 3, Min: 10, Max: 40, Median: 25, P95: 40, Samples: []float64{10, 30, 20, 40}},
+		},
+		{
+			// The step from 20 to 50 between hosts is not delay variation
+			"two series",
+			[][]float64{{10, 20}, {50, 60}},
+			LatencyStats{Mean: 35, Jitter: 10, Min: 10, Max: 60, Median: 35, P95: 60, Samples: []float64{10, 20, 50, 60}},
+		},
+	} {
+		got := NewLatencyStats(tc.series...)
+		want := tc.want
+		near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+		if !near(got.Mean, want.Mean) || !near(got.Jitter, want.Jitter) || got.Min != want.Min || got.Max != want.Max ||
+			got.Median != want.Median || got.P95 != want.P95 || !slices.Equal(got.Samples, want.Samples) {
+			t.Errorf("%s: stats %+v; want %+v", tc.name, got, want)
+		}
+	}
+}
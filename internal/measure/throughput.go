@@ -0,0 +1,331 @@
+package measure
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+// ThroughputConfig controls how the download and upload phases are timed
+type ThroughputConfig struct {
+	// Duration is how long each throughput phase runs
+	Duration time.Duration
+	// WarmUp is the initial window whose samples are discarded, covering
+	// DNS, connection setup, the TLS handshake and TCP slow start
+	WarmUp time.Duration
+	// SampleInterval is the spacing between byte counter snapshots
+	SampleInterval time.Duration
+	// TrimFraction is the fraction of samples dropped from each end before
+	// averaging the remaining interval speeds
+	TrimFraction float64
+}
+
+// DefaultThroughputConfig returns the default throughput phase timing
+func DefaultThroughputConfig() ThroughputConfig {
+	return ThroughputConfig{
+		Duration:       10 * time.Second,
+		WarmUp:         2 * time.Second,
+		SampleInterval: 100 * time.Millisecond,
+		TrimFraction:   0.1,
+	}
+}
+
+// Validate checks that the configuration describes a usable phase
+func (c ThroughputConfig) Validate() error {
+	if c.Duration <= 0 || c.SampleInterval <= 0 {
+		return fmt.Errorf("duration and sample interval must be positive")
+	}
+	if c.WarmUp < 0 || c.WarmUp >= c.Duration {
+		return fmt.Errorf("warm-up must be shorter than the phase duration")
+	}
+	if c.TrimFraction < 0 || c.TrimFraction >= 0.5 {
+		return fmt.Errorf("trim fraction must be in [0, 0.5)")
+	}
+	return nil
+}
+
+// Sample is the speed observed during one sample interval
+type Sample struct {
+	Elapsed time.Duration
+	Mbps    float64
+}
+
+// Meter counts the bytes transferred by one stream. Every stream has a
+// meter of its own and only the sampler reads them, so counting a read is a
+// single uncontended atomic add rather than a lock shared by all streams.
+// The meter fills a cache line so meters of different streams never share
+// one.
+type Meter struct {
+	total atomic.Int64
+	_     [56]byte
+}
+
+// Add counts n more bytes
+func (m *Meter) Add(n int) {
+	m.total.Add(int64(n))
+}
+
+// Write counts and discards b, so that copying into a meter counts the
+// bytes as they are read rather than once the copy is done
+func (m *Meter) Write(b []byte) (int, error) {
+	m.Add(len(b))
+	return len(b), nil
+}
+
+// Total returns the bytes counted so far
+func (m *Meter) Total() int64 {
+	return m.total.Load()
+}
+
+// IntervalSampler turns a growing byte total into per-interval speeds
+type IntervalSampler struct {
+	// Samples holds every sample taken so far
+	Samples []Sample
+
+	start     time.Time
+	last      time.Time
+	lastBytes int64
+	interval  time.Duration
+}
+
+// NewIntervalSampler returns a sampler of a transfer that started at start
+func NewIntervalSampler(start time.Time, interval time.Duration) *IntervalSampler {
+	return &IntervalSampler{start: start, last: start, interval: interval}
+}
+
+// Observe records a sample if at least one interval has passed since the
+// previous one. total is the number of bytes transferred since start.
+func (p *IntervalSampler) Observe(now time.Time, total int64) (Sample, bool) {
+	elapsed := now.Sub(p.last)
+	if elapsed <= 0 || elapsed < p.interval*9/10 {
+		return Sample{}, false
+	}
+
+	sample := Sample{
+		Elapsed: now.Sub(p.start),
+		Mbps:    float64(total-p.lastBytes) * 8 / 1000000 / elapsed.Seconds(),
+	}
+	p.Samples = append(p.Samples, sample)
+	p.last, p.lastBytes = now, total
+	return sample, true
+}
+
+// SteadyStateSpeed discards the samples taken during warm-up and returns the
+// trimmed mean of the rest. If the phase ended before warm-up was over every
+// sample is used instead.
+func SteadyStateSpeed(samples []Sample, warmUp time.Duration, trim float64) float64 {
+	var speeds []float64
+	for _, sample := range samples {
+		if sample.Elapsed > warmUp {
+			speeds = append(speeds, sample.Mbps)
+		}
+	}
+	if len(speeds) == 0 {
+		for _, sample := range samples {
+			speeds = append(speeds, sample.Mbps)
+		}
+	}
+	return TrimmedMean(speeds, trim)
+}
+
+// Throughput is the outcome of a download or upload measurement
+type Throughput struct {
+	Mbps float64
+	// Streams is the number of streams the phase ended with
+	Streams int
+	// Ramp records the stream count steps of an adaptive phase
+	Ramp []models.StreamStep
+	// Trace is the throughput time series of the phase
+	Trace *models.PhaseTrace
+	// Timings breaks down the requests of the phase
+	Timings *models.PhaseTimings
+	// Protocol is the HTTP protocol the server answered with
+	Protocol string
+}
+
+// streamFunc transfers data until ctx is done, reporting bytes to meter
+type streamFunc func(ctx context.Context, meter *Meter) error
+
+// phase describes a timed throughput phase
+type phase struct {
+	cfg     ThroughputConfig
+	clock   Clock
+	streams int
+	// adaptive starts the phase with one stream and adds streams while the
+	// throughput keeps growing, up to streams
+	adaptive bool
+	stream   streamFunc
+	onSample func(Sample)
+}
+
+// run runs the streams of the phase in parallel for the configured
+// duration, samples the byte meters at fixed intervals and returns the
+// steady-state speed. If parent is done before the phase completes, the
+// streams are stopped and its error returned.
+//
+// In adaptive mode the steady state is only taken after the last stream was
+// added.
+func (p phase) run(parent context.Context) (Throughput, error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	deadline := p.clock.After(p.cfg.Duration)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-deadline:
+			cancel()
+		}
+	}()
+
+	start := p.clock.Now()
+	group := newStreamGroup(ctx, p.stream)
+
+	var ramp *streamRamp
+	if p.adaptive {
+		ramp = newStreamRamp(p.streams)
+		group.add(1)
+	} else {
+		group.add(p.streams)
+	}
+
+	trace := newTraceRecorder(p.cfg.SampleInterval)
+	samples := sampleStreams(ctx, p.clock, group, p.cfg.SampleInterval, func(sample Sample, streamBytes []int64) {
+		if p.onSample != nil {
+			p.onSample(sample)
+		}
+		trace.record(sample, streamBytes)
+		if ramp != nil && ramp.observe(sample) {
+			group.add(1)
+		}
+	})
+	cancel()
+	<-group.done
+
+	if err := parent.Err(); err != nil {
+		return Throughput{}, err
+	}
+	total, streamBytes := group.snapshot()
+	if total == 0 {
+		if err := group.firstError(); err != nil {
+			return Throughput{}, err
+		}
+		return Throughput{}, fmt.Errorf("no data transferred")
+	}
+
+	result := Throughput{Streams: len(streamBytes), Trace: trace.finish(p.clock.Now().Sub(start), total, streamBytes)}
+	warmUp := p.cfg.WarmUp
+	if ramp != nil {
+		result.Ramp = ramp.steps
+		if ramp.settledAt > warmUp {
+			warmUp = ramp.settledAt
+		}
+	}
+	result.Mbps = SteadyStateSpeed(samples, warmUp, p.cfg.TrimFraction)
+	return result, nil
+}
+
+// streamGroup runs the streams of a phase, each with its own meter. Streams
+// can be added while the phase runs; done is closed once every stream has
+// stopped.
+type streamGroup struct {
+	ctx    context.Context
+	stream streamFunc
+	done   chan struct{}
+
+	mu     sync.Mutex
+	meters []*Meter
+	active int
+	errs   []error
+}
+
+func newStreamGroup(ctx context.Context, stream streamFunc) *streamGroup {
+	return &streamGroup{ctx: ctx, stream: stream, done: make(chan struct{})}
+}
+
+// add starts n more streams. It does nothing once every stream has stopped.
+func (g *streamGroup) add(n int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.meters) > 0 && g.active == 0 {
+		return
+	}
+	for i := 0; i < n; i++ {
+		meter := &Meter{}
+		g.meters = append(g.meters, meter)
+		g.active++
+		go func() {
+			err := g.stream(g.ctx, meter)
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			if err != nil {
+				g.errs = append(g.errs, err)
+			}
+			g.active--
+			if g.active == 0 {
+				// All streams stopping early, e.g. because every connection
+				// failed, ends the phase before the deadline
+				close(g.done)
+			}
+		}()
+	}
+}
+
+// snapshot returns the bytes transferred by all streams and by each stream
+func (g *streamGroup) snapshot() (int64, []int64) {
+	g.mu.Lock()
+	meters := g.meters
+	g.mu.Unlock()
+
+	var total int64
+	perStream := make([]int64, len(meters))
+	for i, meter := range meters {
+		perStream[i] = meter.Total()
+		total += perStream[i]
+	}
+	return total, perStream
+}
+
+// firstError returns the first error a stream stopped with
+func (g *streamGroup) firstError() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.errs) == 0 {
+		return nil
+	}
+	return g.errs[0]
+}
+
+// sampleStreams snapshots the meters of group every interval until ctx is
+// done or the streams have stopped, passing each aggregate sample and the
+// per-stream byte counts to onSample
+func sampleStreams(ctx context.Context, clock Clock, group *streamGroup, interval time.Duration, onSample func(Sample, []int64)) []Sample {
+	sampler := NewIntervalSampler(clock.Now(), interval)
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return sampler.Samples
+		case <-group.done:
+			return sampler.Samples
+		case now := <-ticker.C():
+			total, streamBytes := group.snapshot()
+			if sample, ok := sampler.Observe(now, total); ok {
+				onSample(sample, streamBytes)
+			}
+		}
+	}
+}
+
+// phaseError hides errors caused by the phase deadline, which is the normal
+// way for a stream to stop
+func phaseError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,232 @@
+package measure
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	// benchmarkStreams is the number of parallel streams of the throughput
+	// benchmarks
+	benchmarkStreams = 16
+
+	// benchmarkReadSize is the read size of the streams, the 16KB the
+	// multi-connection download used to read and count at a time
+	benchmarkReadSize = 16 * 1024
+
+	// benchmarkPhase is how long each measured phase runs
+	benchmarkPhase = 500 * time.Millisecond
+
+	// benchmarkDownloadBytes is the size of each benchmarked download
+	benchmarkDownloadBytes = 25000000
+)
+
+// streamCounter counts the bytes read by each stream of a phase
+type streamCounter interface {
+	add(stream int, n int)
+	total() int64
+}
+
+// mutexCounter is the old accounting: one lock shared by every stream,
+// guarding the total and the per-connection counts
+type mutexCounter struct {
+	mu         sync.Mutex
+	totalBytes int64
+	connBytes  []int64
+}
+
+func newMutexCounter(streams int) *mutexCounter {
+	return &mutexCounter{connBytes: make([]int64, streams)}
+}
+
+func (c *mutexCounter) add(stream int, n int) {
+	c.mu.Lock()
+	c.totalBytes += int64(n)
+	c.connBytes[stream] += int64(n)
+	c.mu.Unlock()
+}
+
+func (c *mutexCounter) total() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.totalBytes
+}
+
+// meterCounter is the current accounting: a meter per stream
+type meterCounter []Meter
+
+func (c meterCounter) add(stream int, n int) {
+	c[stream].Add(n)
+}
+
+func (c meterCounter) total() int64 {
+	var total int64
+	for i := range c {
+		total += c[i].Total()
+	}
+	return total
+}
+
+func TestByteMeterConcurrentAdds(t *testing.T) {
+	var meter Meter
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				meter.Add(3)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := meter.Total(); got != 8*1000*3 {
+		t.Fatalf("meter counted %d bytes; want %d", got, 8*1000*3)
+	}
+}
+
+func TestIntervalSamplerSpeed(t *testing.T) {
+	start := time.Now()
+	sampler := NewIntervalSampler(start, 100*time.Millisecond)
+	if _, ok := sampler.Observe(start.Add(50*time.Millisecond), 1000); ok {
+		t.Fatal("sample taken before an interval had passed")
+	}
+	sample, ok := sampler.Observe(start.Add(100*time.Millisecond), 1250000)
+	if !ok {
+		t.Fatal("no sample taken after an interval")
+	}
+	if sample.Mbps != 100 {
+		t.Fatalf("sample speed %.2f Mbps; want 100", sample.Mbps)
+	}
+}
+
+// benchmarkCounting counts reads of benchmarkReadSize bytes from parallel
+// goroutines, each its own stream
+func benchmarkCounting(b *testing.B, counter streamCounter) {
+	var next sync.Mutex
+	streams := 0
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		next.Lock()
+		stream := streams % benchmarkStreams
+		streams++
+		next.Unlock()
+		for pb.Next() {
+			counter.add(stream, benchmarkReadSize)
+		}
+	})
+}
+
+func BenchmarkCountingSharedMutex(b *testing.B) {
+	benchmarkCounting(b, newMutexCounter(benchmarkStreams))
+}
+
+func BenchmarkCountingByteMeters(b *testing.B) {
+	benchmarkCounting(b, make(meterCounter, benchmarkStreams))
+}
+
+// measureLocal runs benchmarkStreams streams reading from open for
+// benchmarkPhase while a sampler snapshots counter every 100ms, like a
+// throughput phase, and returns the speed measured in Mbps
+func measureLocal(b *testing.B, counter streamCounter, open func() (io.ReadCloser, error)) float64 {
+	ctx, cancel := context.WithTimeout(context.Background(), benchmarkPhase)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for stream := 0; stream < benchmarkStreams; stream++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, benchmarkReadSize)
+			for ctx.Err() == nil {
+				body, err := open()
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				for ctx.Err() == nil {
+					n, err := body.Read(buf)
+					counter.add(stream, n)
+					if err != nil {
+						break
+					}
+				}
+				body.Close()
+			}
+		}()
+	}
+
+	start := time.Now()
+	sampler := NewIntervalSampler(start, 100*time.Millisecond)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			sampler.Observe(now, counter.total())
+			continue
+		case <-ctx.Done():
+		}
+		break
+	}
+	wg.Wait()
+	return SteadyStateSpeed(sampler.Samples, 0, 0)
+}
+
+// benchmarkLocalDownload reports the mean speed measured against a local
+// endpoint as the Mbps metric
+func benchmarkLocalDownload(b *testing.B, newCounter func() streamCounter, open func() (io.ReadCloser, error)) {
+	var mbps float64
+	for i := 0; i < b.N; i++ {
+		mbps += measureLocal(b, newCounter(), open)
+	}
+	b.ReportMetric(mbps/float64(b.N), "Mbps")
+}
+
+// memoryEndpoint serves downloads straight from the shared payload, the
+// fastest endpoint there can be
+func memoryEndpoint() (io.ReadCloser, error) {
+	return io.NopCloser(struct{ io.Reader }{newPayloadReader(benchmarkDownloadBytes, nil, nil)}), nil
+}
+
+// loopbackEndpoint returns an endpoint downloading from a local HTTP server
+func loopbackEndpoint(b *testing.B) func() (io.ReadCloser, error) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, NewPayloadReader(benchmarkDownloadBytes))
+	}))
+	b.Cleanup(server.Close)
+	client := &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+	url := server.URL + "/__down?bytes=" + strconv.Itoa(benchmarkDownloadBytes)
+	return func() (io.ReadCloser, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+}
+
+func sharedMutex() streamCounter { return newMutexCounter(benchmarkStreams) }
+func byteMeters() streamCounter  { return make(meterCounter, benchmarkStreams) }
+
+func BenchmarkMemoryDownloadSharedMutex(b *testing.B) {
+	benchmarkLocalDownload(b, sharedMutex, memoryEndpoint)
+}
+
+func BenchmarkMemoryDownloadByteMeters(b *testing.B) {
+	benchmarkLocalDownload(b, byteMeters, memoryEndpoint)
+}
+
+func BenchmarkLoopbackDownloadSharedMutex(b *testing.B) {
+	benchmarkLocalDownload(b, sharedMutex, loopbackEndpoint(b))
+}
+
+func BenchmarkLoopbackDownloadByteMeters(b *testing.B) {
+	benchmarkLocalDownload(b, byteMeters, loopbackEndpoint(b))
+}
@@ -0,0 +1,129 @@
+package measure
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+// requestTiming is the breakdown of a single request. newConnection is set
+// when the request dialed the connection it was sent on; a request that was
+// handed a connection dialed for another one has no setup timings.
+type requestTiming struct {
+	newConnection bool
+	dnsLookup     time.Duration
+	tcpConnect    time.Duration
+	tlsHandshake  time.Duration
+	firstByte     time.Duration
+}
+
+// timingRecorder collects the request timings of a throughput phase with
+// net/http/httptrace, so connection setup can be told apart from transfer
+// time
+type timingRecorder struct {
+	clock Clock
+
+	mu       sync.Mutex
+	requests []requestTiming
+}
+
+func newTimingRecorder(clock Clock) *timingRecorder {
+	return &timingRecorder{clock: clock}
+}
+
+// trace returns req with a client trace that records its timing once the
+// first response byte arrives. Requests that fail before that are not
+// recorded.
+func (t *timingRecorder) trace(req *http.Request) *http.Request {
+	// The hooks may run on other goroutines, e.g. while dialing, so every
+	// field is guarded by the recorder's lock
+	var timing requestTiming
+	var dnsStart, connectStart, tlsStart, wrote time.Time
+	since := func(start time.Time) time.Duration {
+		if start.IsZero() {
+			return 0
+		}
+		return t.clock.Now().Sub(start)
+	}
+	locked := func(f func()) {
+		t.mu.Lock()
+		f()
+		t.mu.Unlock()
+	}
+
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			locked(func() { dnsStart = t.clock.Now() })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			locked(func() { timing.dnsLookup = since(dnsStart) })
+		},
+		ConnectStart: func(string, string) {
+			locked(func() {
+				// Dual-stack dialing may race several connects; keep the first
+				if connectStart.IsZero() {
+					connectStart = t.clock.Now()
+				}
+			})
+		},
+		ConnectDone: func(_, _ string, err error) {
+			locked(func() {
+				if err == nil && !timing.newConnection {
+					timing.newConnection = true
+					timing.tcpConnect = since(connectStart)
+				}
+			})
+		},
+		TLSHandshakeStart: func() {
+			locked(func() { tlsStart = t.clock.Now() })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			locked(func() { timing.tlsHandshake = since(tlsStart) })
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			locked(func() { wrote = t.clock.Now() })
+		},
+		GotFirstResponseByte: func() {
+			locked(func() {
+				timing.firstByte = since(wrote)
+				t.requests = append(t.requests, timing)
+			})
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// summary returns the median timings of the recorded requests, or nil if
+// none completed
+func (t *timingRecorder) summary() *models.PhaseTimings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.requests) == 0 {
+		return nil
+	}
+
+	summary := &models.PhaseTimings{Requests: len(t.requests)}
+	var dns, connect, handshake, firstByte []float64
+	for _, request := range t.requests {
+		firstByte = append(firstByte, Millis(request.firstByte))
+		if Millis(request.firstByte) > summary.FirstByteMax {
+			summary.FirstByteMax = Millis(request.firstByte)
+		}
+		if !request.newConnection {
+			continue
+		}
+		summary.NewConnections++
+		dns = append(dns, Millis(request.dnsLookup))
+		connect = append(connect, Millis(request.tcpConnect))
+		handshake = append(handshake, Millis(request.tlsHandshake))
+	}
+	summary.DNSLookup = Median(dns)
+	summary.TCPConnect = Median(connect)
+	summary.TLSHandshake = Median(handshake)
+	summary.FirstByte = Median(firstByte)
+	return summary
+}
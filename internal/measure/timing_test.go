@@ -0,0 +1,75 @@
+package measure
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+	"time"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+// TestTimingRecorder replays the trace callbacks of three requests with a
+// fake clock: two that dial a connection of their own and one that reuses
+// a connection
+func TestTimingRecorder(t *testing.T) {
+	clock := newFakeClock()
+	timings := newTimingRecorder(clock)
+	traceOf := func() *httptrace.ClientTrace {
+		req := timings.trace(httptest.NewRequest("GET", "http://speed.example/__down", nil))
+		return httptrace.ContextClientTrace(req.Context())
+	}
+	step := func(ms int) { clock.Advance(time.Duration(ms) * time.Millisecond) }
+
+	for _, setup := range []struct{ dns, connect, handshake, firstByte int }{
+		{2, 10, 20, 30},
+		{4, 30, 40, 50},
+	} {
+		trace := traceOf()
+		trace.DNSStart(httptrace.DNSStartInfo{})
+		step(setup.dns)
+		trace.DNSDone(httptrace.DNSDoneInfo{})
+		// A failed connect of a racing dial does not count
+		trace.ConnectStart("tcp", "[::1]:443")
+		trace.ConnectDone("tcp", "[::1]:443", errors.New("unreachable"))
+		trace.ConnectStart("tcp", "127.0.0.1:443")
+		step(setup.connect)
+		trace.ConnectDone("tcp", "127.0.0.1:443", nil)
+		trace.TLSHandshakeStart()
+		step(setup.handshake)
+		trace.TLSHandshakeDone(tls.ConnectionState{}, nil)
+		trace.WroteRequest(httptrace.WroteRequestInfo{})
+		step(setup.firstByte)
+		trace.GotFirstResponseByte()
+	}
+
+	reused := traceOf()
+	reused.WroteRequest(httptrace.WroteRequestInfo{})
+	step(10)
+	reused.GotFirstResponseByte()
+
+	// A request that fails before its first byte is not recorded
+	failed := traceOf()
+	failed.WroteRequest(httptrace.WroteRequestInfo{})
+
+	want := models.PhaseTimings{
+		Requests:       3,
+		NewConnections: 2,
+		DNSLookup:      3,
+		TCPConnect:     20,
+		TLSHandshake:   30,
+		FirstByte:      30,
+		FirstByteMax:   50,
+	}
+	if got := timings.summary(); got == nil || *got != want {
+		t.Fatalf("summary %+v; want %+v", got, want)
+	}
+}
+
+func TestTimingRecorderWithoutRequests(t *testing.T) {
+	if summary := newTimingRecorder(newFakeClock()).summary(); summary != nil {
+		t.Fatalf("summary %+v of no requests", summary)
+	}
+}
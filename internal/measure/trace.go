@@ -0,0 +1,64 @@
+package measure
+
+import (
+	"time"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+// traceRecorder builds the throughput time series of a phase, in total and
+// per stream, from the samples taken while it runs
+type traceRecorder struct {
+	interval    time.Duration
+	lastElapsed time.Duration
+	lastBytes   []int64
+	total       []float32
+	streams     []*models.StreamTrace
+}
+
+func newTraceRecorder(interval time.Duration) *traceRecorder {
+	return &traceRecorder{interval: interval}
+}
+
+// record adds one interval. streamBytes holds the bytes each stream has
+// transferred since the phase started; streams added since the previous
+// interval start their series here.
+func (t *traceRecorder) record(sample Sample, streamBytes []int64) {
+	seconds := (sample.Elapsed - t.lastElapsed).Seconds()
+	t.lastElapsed = sample.Elapsed
+	t.total = append(t.total, float32(sample.Mbps))
+
+	for i, bytes := range streamBytes {
+		if i == len(t.streams) {
+			t.streams = append(t.streams, &models.StreamTrace{Offset: len(t.total) - 1})
+			t.lastBytes = append(t.lastBytes, 0)
+		}
+		var mbps float64
+		if seconds > 0 {
+			mbps = float64(bytes-t.lastBytes[i]) * 8 / 1000000 / seconds
+		}
+		t.streams[i].Mbps = append(t.streams[i].Mbps, float32(mbps))
+		t.lastBytes[i] = bytes
+	}
+}
+
+// finish returns the trace of a phase that ran for duration and transferred
+// total bytes, streamBytes of them on each stream
+func (t *traceRecorder) finish(duration time.Duration, total int64, streamBytes []int64) *models.PhaseTrace {
+	trace := &models.PhaseTrace{
+		IntervalMs: int(t.interval / time.Millisecond),
+		DurationMs: Millis(duration),
+		Bytes:      total,
+		Mbps:       t.total,
+	}
+	for i, bytes := range streamBytes {
+		// A stream added after the last sample has no series of its own
+		stream := models.StreamTrace{Offset: len(t.total), Bytes: bytes}
+		if i < len(t.streams) {
+			stream.Offset = t.streams[i].Offset
+			stream.Mbps = t.streams[i].Mbps
+		}
+		trace.Streams = append(trace.Streams, stream)
+	}
+	return trace
+}
@@ -0,0 +1,42 @@
+package measure
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTraceRecorder(t *testing.T) {
+	trace := newTraceRecorder(100 * time.Millisecond)
+	// One stream moves 12500 bytes, 1 Mbps, per interval; a second one joins
+	// in the second interval with 25000 bytes per interval
+	trace.record(Sample{Elapsed: 100 * time.Millisecond, Mbps: 1}, []int64{12500})
+	trace.record(Sample{Elapsed: 200 * time.Millisecond, Mbps: 3}, []int64{25000, 25000})
+	trace.record(Sample{Elapsed: 300 * time.Millisecond, Mbps: 3}, []int64{37500, 50000})
+
+	// A third stream is added after the last sample
+	got := trace.finish(350*time.Millisecond, 90000, []int64{40000, 50000, 0})
+	if got.IntervalMs != 100 || got.DurationMs != 350 || got.Bytes != 90000 {
+		t.Fatalf("trace of %d ms intervals over %v ms with %d bytes", got.IntervalMs, got.DurationMs, got.Bytes)
+	}
+	if !slices.Equal(got.Mbps, []float32{1, 3, 3}) {
+		t.Fatalf("total %v; want [1 3 3]", got.Mbps)
+	}
+	if len(got.Streams) != 3 {
+		t.Fatalf("%d streams; want 3", len(got.Streams))
+	}
+	for i, want := range []struct {
+		offset int
+		bytes  int64
+		mbps   []float32
+	}{
+		{0, 40000, []float32{1, 1, 1}},
+		{1, 50000, []float32{2, 2}},
+		{3, 0, nil},
+	} {
+		stream := got.Streams[i]
+		if stream.Offset != want.offset || stream.Bytes != want.bytes || !slices.Equal(stream.Mbps, want.mbps) {
+			t.Errorf("stream %d is %+v; want offset %d, %d bytes and %v", i, stream, want.offset, want.bytes, want.mbps)
+		}
+	}
+}
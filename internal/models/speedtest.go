@@ -2,6 +2,21 @@ package models
 
 import "time"
 
+// Kinds of speed test a result can come from
+const (
+	// TestTypeHTTP is a server-side test against a /__down and /__up server
+	TestTypeHTTP = "http"
+	// TestTypeBrowser is a browser-driven test over the WebSocket protocol
+	TestTypeBrowser = "browser"
+	// TestTypeNDT7Download and TestTypeNDT7Upload are ndt7 client tests
+	TestTypeNDT7Download = "ndt7_download"
+	TestTypeNDT7Upload   = "ndt7_upload"
+)
+
+// OriginScheduled marks the results of tests run by a schedule rather than
+// started by a client
+const OriginScheduled = "scheduled"
+
 // SpeedTestResult represents the result of a speed test
 type SpeedTestResult struct {
 	ID           string    `json:"id" bson:"_id,omitempty"`
@@ -10,13 +25,215 @@ type SpeedTestResult struct {
 	UploadSpeed   float64   `json:"upload_speed" bson:"upload_speed"`
 	Ping         float64   `json:"ping" bson:"ping"`
 	Jitter       float64   `json:"jitter" bson:"jitter"`
+	PingMin      float64   `json:"ping_min" bson:"ping_min"`
+	PingMax      float64   `json:"ping_max" bson:"ping_max"`
+	PingMedian   float64   `json:"ping_median" bson:"ping_median"`
+	PingP95      float64   `json:"ping_p95" bson:"ping_p95"`
+	RTTSamples   []float64 `json:"rtt_samples,omitempty" bson:"rtt_samples,omitempty"`
+	PacketLoss   *PacketLossResult `json:"packet_loss,omitempty" bson:"packet_loss,omitempty"`
+	DNS          *DNSResult `json:"dns,omitempty" bson:"dns,omitempty"`
+	LoadedLatency *LoadedLatencyResult `json:"loaded_latency,omitempty" bson:"loaded_latency,omitempty"`
+	BufferbloatGrade string `json:"bufferbloat_grade,omitempty" bson:"bufferbloat_grade,omitempty"`
+	Provenance *ResultProvenance `json:"provenance,omitempty" bson:"provenance,omitempty"`
+	// Aborted is set when the test was cancelled before every phase ran
+	Aborted bool `json:"aborted,omitempty" bson:"aborted,omitempty"`
 	ISP          string    `json:"isp" bson:"isp"`
 	IPAddress    string    `json:"ip_address" bson:"ip_address"`
 	Country      string    `json:"country" bson:"country"`
 	Region       string    `json:"region" bson:"region"`
+	Server       TestServerInfo `json:"server" bson:"server"`
+	TestType     string    `json:"test_type" bson:"test_type"`
+	Preset       string    `json:"preset,omitempty" bson:"preset,omitempty"`
+	// Origin is OriginScheduled for tests run by a schedule, and empty for
+	// tests a client started. ScheduleID and DeviceID identify the schedule.
+	Origin     string `json:"origin,omitempty" bson:"origin,omitempty"`
+	ScheduleID string `json:"schedule_id,omitempty" bson:"schedule_id,omitempty"`
+	DeviceID   string `json:"device_id,omitempty" bson:"device_id,omitempty"`
+	// Protocol is the HTTP protocol the throughput phases ran over: "http/1.1",
+	// "h2" or "h3"
+	Protocol string `json:"protocol,omitempty" bson:"protocol,omitempty"`
+	// DownloadStreams and UploadStreams are the streams each phase ended with
+	DownloadStreams int `json:"download_streams,omitempty" bson:"download_streams,omitempty"`
+	UploadStreams   int `json:"upload_streams,omitempty" bson:"upload_streams,omitempty"`
+	// DownloadRamp and UploadRamp record the throughput at each stream count
+	// of an adaptive phase
+	DownloadRamp []StreamStep `json:"download_ramp,omitempty" bson:"download_ramp,omitempty"`
+	UploadRamp   []StreamStep `json:"upload_ramp,omitempty" bson:"upload_ramp,omitempty"`
+	// Traces holds the throughput time series of each phase. It is large,
+	// so clients only receive it when they ask for it.
+	Traces *ResultTraces `json:"traces,omitempty" bson:"traces,omitempty"`
+	// ConnectionTimings breaks down the setup time of the throughput
+	// requests, separately from the throughput itself
+	ConnectionTimings *ConnectionTimings `json:"connection_timings,omitempty" bson:"connection_timings,omitempty"`
+	// DualStack compares the IPv4 and IPv6 paths in dual-stack mode
+	DualStack *DualStackResult `json:"dual_stack,omitempty" bson:"dual_stack,omitempty"`
 	CreatedAt    time.Time `json:"created_at" bson:"created_at"`
 }
 
+// TestServerInfo identifies the test server a speed test ran against
+type TestServerInfo struct {
+	ID       string `json:"id" bson:"id"`
+	Name     string `json:"name" bson:"name"`
+	URL      string `json:"url" bson:"url"`
+	Location string `json:"location" bson:"location"`
+}
+
+// PacketLossResult is the outcome of a UDP packet loss probe
+type PacketLossResult struct {
+	Sent        int     `json:"sent" bson:"sent"`
+	Received    int     `json:"received" bson:"received"`
+	LossPercent float64 `json:"loss_percent" bson:"loss_percent"`
+	Reordered   int     `json:"reordered" bson:"reordered"`
+	Duplicates  int     `json:"duplicates" bson:"duplicates"`
+	// Jitter is the one-way jitter of the client to server path in ms
+	Jitter float64 `json:"jitter" bson:"jitter"`
+}
+
+// DNSResult is the outcome of the DNS resolver benchmark
+type DNSResult struct {
+	Resolvers []DNSResolverResult `json:"resolvers" bson:"resolvers"`
+	// Recommended is the name of the fastest resolver that answered
+	// reliably, empty if none did
+	Recommended string `json:"recommended,omitempty" bson:"recommended,omitempty"`
+}
+
+// DNSResolverResult is the lookup performance of one resolver. Times are in
+// ms and only cover successful lookups.
+type DNSResolverResult struct {
+	Name        string  `json:"name" bson:"name"`
+	Protocol    string  `json:"protocol" bson:"protocol"`
+	Address     string  `json:"address,omitempty" bson:"address,omitempty"`
+	Queries     int     `json:"queries" bson:"queries"`
+	Failures    int     `json:"failures" bson:"failures"`
+	FailureRate float64 `json:"failure_rate" bson:"failure_rate"`
+	Median      float64 `json:"median_ms" bson:"median_ms"`
+	P95         float64 `json:"p95_ms" bson:"p95_ms"`
+	// Error is the last lookup error, if any lookup failed
+	Error string `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// LoadedLatencyResult compares the round-trip time to the test server while
+// the link is idle and while it is saturated. Values are in ms.
+type LoadedLatencyResult struct {
+	IdleMedian     float64 `json:"idle_median" bson:"idle_median"`
+	DownloadMedian float64 `json:"download_median" bson:"download_median"`
+	DownloadP95    float64 `json:"download_p95" bson:"download_p95"`
+	DownloadJitter float64 `json:"download_jitter" bson:"download_jitter"`
+	UploadMedian   float64 `json:"upload_median" bson:"upload_median"`
+	UploadP95      float64 `json:"upload_p95" bson:"upload_p95"`
+	UploadJitter   float64 `json:"upload_jitter" bson:"upload_jitter"`
+}
+
+// StreamStep is the throughput measured while a phase ran a given number of
+// streams
+type StreamStep struct {
+	Streams int     `json:"streams" bson:"streams"`
+	Mbps    float64 `json:"mbps" bson:"mbps"`
+}
+
+// ResultTraces holds the throughput time series of the phases of a test
+type ResultTraces struct {
+	Download *PhaseTrace `json:"download,omitempty" bson:"download,omitempty"`
+	Upload   *PhaseTrace `json:"upload,omitempty" bson:"upload,omitempty"`
+}
+
+// PhaseTrace is the throughput time series of one phase. Samples are spaced
+// IntervalMs apart, so only the speeds are stored, as 32-bit floats.
+type PhaseTrace struct {
+	IntervalMs int     `json:"interval_ms" bson:"interval_ms"`
+	DurationMs float64 `json:"duration_ms" bson:"duration_ms"`
+	Bytes      int64   `json:"bytes" bson:"bytes"`
+	// Mbps is the aggregate throughput of each interval
+	Mbps    []float32     `json:"mbps" bson:"mbps"`
+	Streams []StreamTrace `json:"streams,omitempty" bson:"streams,omitempty"`
+}
+
+// StreamTrace is the throughput time series of one stream of a phase
+type StreamTrace struct {
+	// Offset is the index of the interval in which the stream started
+	Offset int       `json:"offset" bson:"offset"`
+	Bytes  int64     `json:"bytes" bson:"bytes"`
+	Mbps   []float32 `json:"mbps" bson:"mbps"`
+}
+
+// ConnectionTimings holds the request timings of the throughput phases of a
+// test
+type ConnectionTimings struct {
+	Download *PhaseTimings `json:"download,omitempty" bson:"download,omitempty"`
+	Upload   *PhaseTimings `json:"upload,omitempty" bson:"upload,omitempty"`
+}
+
+// PhaseTimings summarizes the requests of one throughput phase. Times are
+// medians in ms. DNS lookup, TCP connect and TLS handshake only cover the
+// requests that opened a new connection; first byte is the wait for the
+// response after the request was written, for every request. Over HTTP/3 the
+// connect and TLS handshake are a single QUIC handshake and report the same
+// time.
+type PhaseTimings struct {
+	Requests       int     `json:"requests" bson:"requests"`
+	NewConnections int     `json:"new_connections" bson:"new_connections"`
+	DNSLookup      float64 `json:"dns_lookup_ms" bson:"dns_lookup_ms"`
+	TCPConnect     float64 `json:"tcp_connect_ms" bson:"tcp_connect_ms"`
+	TLSHandshake   float64 `json:"tls_handshake_ms" bson:"tls_handshake_ms"`
+	FirstByte      float64 `json:"first_byte_ms" bson:"first_byte_ms"`
+	// FirstByteMax is the slowest first byte of the phase
+	FirstByteMax float64 `json:"first_byte_max_ms" bson:"first_byte_max_ms"`
+}
+
+// DualStackResult holds the measurements repeated over each address family
+type DualStackResult struct {
+	IPv4 FamilyResult `json:"ipv4" bson:"ipv4"`
+	IPv6 FamilyResult `json:"ipv6" bson:"ipv6"`
+}
+
+// FamilyResult holds the latency and throughput measured over one address
+// family. Speeds are in Mbps and latencies in ms.
+type FamilyResult struct {
+	// Available is false when the server has no address of the family or
+	// cannot be reached over it; Error then says why
+	Available bool `json:"available" bson:"available"`
+	// Address is the server address the family was tested against
+	Address       string  `json:"address,omitempty" bson:"address,omitempty"`
+	Ping          float64 `json:"ping" bson:"ping"`
+	Jitter        float64 `json:"jitter" bson:"jitter"`
+	PingMedian    float64 `json:"ping_median" bson:"ping_median"`
+	DownloadSpeed float64 `json:"download_speed" bson:"download_speed"`
+	UploadSpeed   float64 `json:"upload_speed" bson:"upload_speed"`
+	// Error describes the first phase that failed over this family
+	Error string `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// Sources a measured value can come from
+const (
+	// SourcePrimary means the value was measured with the primary method
+	SourcePrimary = "primary"
+	// SourceAlternative means the primary method failed and the value was
+	// measured with a less accurate alternative method
+	SourceAlternative = "alternative"
+	// SourceUnavailable means every method failed and the value is not set
+	SourceUnavailable = "unavailable"
+	// SourceSkipped means the phase was not requested
+	SourceSkipped = "skipped"
+)
+
+// Provenance records how a measured value was obtained
+type Provenance struct {
+	Source string `json:"source" bson:"source"`
+	Method string `json:"method,omitempty" bson:"method,omitempty"`
+	Server string `json:"server,omitempty" bson:"server,omitempty"`
+	Error  string `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// ResultProvenance records the provenance of each phase of a test
+type ResultProvenance struct {
+	Latency       Provenance  `json:"latency" bson:"latency"`
+	Download      Provenance  `json:"download" bson:"download"`
+	Upload        Provenance  `json:"upload" bson:"upload"`
+	PacketLoss    *Provenance `json:"packet_loss,omitempty" bson:"packet_loss,omitempty"`
+	DNS           *Provenance `json:"dns,omitempty" bson:"dns,omitempty"`
+	LoadedLatency *Provenance `json:"loaded_latency,omitempty" bson:"loaded_latency,omitempty"`
+}
+
 // UserProfile represents a user's profile information
 type UserProfile struct {
 	ID        string    `json:"id" bson:"_id,omitempty"`
@@ -0,0 +1,205 @@
+package netem
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// lingerTimeout is how long a closed connection keeps delivering the data
+// still on its way over the link
+const lingerTimeout = 5 * time.Second
+
+// conn is a connection whose traffic crosses an emulated link. Writes go
+// through the send pipe and a goroutine delivers them to the underlying
+// connection as they arrive; another goroutine reads the underlying
+// connection into the receive pipe, which Read drains. A direction whose
+// link is not shaped is passed straight through.
+type conn struct {
+	net.Conn
+	send *pipe
+	recv *pipe
+	// delivered is closed once the send pipe has been drained
+	delivered chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewConn wraps c so that its writes cross the send link and its reads the
+// receive link. Each connection has links of its own; connections that share
+// a bottleneck are made by NewListener or a Dialer.
+func NewConn(c net.Conn, send, receive Link) net.Conn {
+	return newConn(c, newWire(send), newWire(receive))
+}
+
+func newConn(c net.Conn, send, recv *wire) net.Conn {
+	if !send.link.shaped() && !recv.link.shaped() {
+		return c
+	}
+	sc := &conn{Conn: c, delivered: make(chan struct{})}
+	if send.link.shaped() {
+		sc.send = newPipe(send)
+		go sc.deliver()
+	} else {
+		close(sc.delivered)
+	}
+	if recv.link.shaped() {
+		sc.recv = newPipe(recv)
+		go sc.receive()
+	}
+	return sc
+}
+
+// deliver writes the segments of the send pipe to the underlying connection
+// as they arrive
+func (c *conn) deliver() {
+	defer close(c.delivered)
+	deliver(c.send, c.Conn)
+}
+
+// receive feeds the underlying connection into the receive pipe
+func (c *conn) receive() {
+	buf := make([]byte, c.recv.segment)
+	for {
+		n, err := c.Conn.Read(buf)
+		if n > 0 {
+			if _, err := c.recv.push(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			c.recv.finish(err)
+			return
+		}
+	}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	if c.recv == nil {
+		return c.Conn.Read(b)
+	}
+	return c.recv.pop(b)
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	if c.send == nil {
+		return c.Conn.Write(b)
+	}
+	return c.send.push(b)
+}
+
+// Close stops reading at once but, like a TCP socket, lets the data already
+// written finish crossing the link before the underlying connection closes
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		if c.recv != nil {
+			c.recv.abort(net.ErrClosed)
+		}
+		if c.send == nil {
+			c.closeErr = c.Conn.Close()
+			return
+		}
+		arrival := c.send.finish(io.EOF)
+		c.Conn.SetWriteDeadline(later(arrival, time.Now()).Add(lingerTimeout))
+		go func() {
+			<-c.delivered
+			c.Conn.Close()
+		}()
+	})
+	return c.closeErr
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	if c.recv == nil {
+		return c.Conn.SetReadDeadline(t)
+	}
+	c.recv.setPopDeadline(t)
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	if c.send == nil {
+		return c.Conn.SetWriteDeadline(t)
+	}
+	c.send.setPushDeadline(t)
+	return nil
+}
+
+// listener shapes the connections it accepts
+type listener struct {
+	net.Listener
+	path *Path
+}
+
+// NewListener wraps l so that the connections it accepts cross the link
+// described by profile. The server sends down and receives up, and every
+// connection shares the link, as if all clients sat behind the same
+// bottleneck.
+//
+// Uploads are shaped as the server reads them. A nearby client's kernel
+// buffers megabytes ahead of that, so a client counting the bytes it writes
+// reads uploads high until those buffers are full; a Dialer shapes uploads
+// where the client writes them.
+func NewListener(l net.Listener, profile Profile) net.Listener {
+	if profile == (Profile{}) {
+		return l
+	}
+	return &listener{Listener: l, path: NewPath(profile)}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newConn(c, l.path.down, l.path.up), nil
+}
+
+// ContextDialer is the dialing method of net.Dialer
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Dialer dials connections that cross an emulated link, the client side
+// counterpart of NewListener. Use one or the other, or the traffic is
+// shaped twice.
+type Dialer struct {
+	dialer ContextDialer
+	path   *Path
+}
+
+// NewDialer returns a dialer whose connections share the link described by
+// profile. A nil dialer uses a zero net.Dialer.
+func NewDialer(dialer ContextDialer, profile Profile) *Dialer {
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	return &Dialer{dialer: dialer, path: NewPath(profile)}
+}
+
+// DialContext connects to addr and returns once the handshake would have
+// crossed the link in both directions. The real handshake counts towards
+// the emulated one, so a connect takes a round trip of the link rather than
+// a round trip plus the time the underlying dialer took.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	start := time.Now()
+	c, err := d.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := sleep(ctx, d.path.up.link.delay()+d.path.down.link.delay()-time.Since(start)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return newConn(c, d.path.up, d.path.down), nil
+}
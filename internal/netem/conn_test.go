@@ -0,0 +1,196 @@
+package netem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// shapedPair returns a connection whose writes cross send and the plain
+// peer it writes to
+func shapedPair(t *testing.T, send, receive Link) (net.Conn, net.Conn) {
+	client, server := net.Pipe()
+	shaped := NewConn(client, send, receive)
+	t.Cleanup(func() {
+		shaped.Close()
+		server.Close()
+	})
+	return shaped, server
+}
+
+// checkDuration fails the test if elapsed is more than 15% below or 50%
+// above want. A loaded machine only ever makes transfers slower.
+func checkDuration(t *testing.T, elapsed, want time.Duration) {
+	t.Helper()
+	if elapsed < want*85/100 || elapsed > want*150/100 {
+		t.Fatalf("took %v; want %v within -15%% and +50%%", elapsed, want)
+	}
+}
+
+func TestConnRate(t *testing.T) {
+	// 250000 bytes at 10 Mbps take 200ms
+	shaped, peer := shapedPair(t, Link{Rate: 10000000}, Link{})
+	go shaped.Write(make([]byte, 250000))
+
+	start := time.Now()
+	if _, err := io.ReadFull(peer, make([]byte, 250000)); err != nil {
+		t.Fatal(err)
+	}
+	checkDuration(t, time.Since(start), 200*time.Millisecond)
+}
+
+func TestConnDelay(t *testing.T) {
+	shaped, peer := shapedPair(t, Link{}, Link{Delay: 50 * time.Millisecond})
+
+	start := time.Now()
+	go peer.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(shaped, buf); err != nil {
+		t.Fatal(err)
+	}
+	checkDuration(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestConnJitterKeepsOrder(t *testing.T) {
+	shaped, peer := shapedPair(t, Link{Delay: 10 * time.Millisecond, Jitter: 10 * time.Millisecond}, Link{})
+
+	var sent bytes.Buffer
+	go func() {
+		for i := 0; i < 200; i++ {
+			shaped.Write([]byte{byte(i)})
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		sent.WriteByte(byte(i))
+	}
+	received := make([]byte, sent.Len())
+	if _, err := io.ReadFull(peer, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, sent.Bytes()) {
+		t.Fatal("jitter reordered the stream")
+	}
+}
+
+// TestConnReadDeadline interrupts a pending read with a past deadline, as
+// net/http does to take over a connection, and reads on afterwards
+func TestConnReadDeadline(t *testing.T) {
+	shaped, peer := shapedPair(t, Link{}, Link{Delay: 10 * time.Millisecond})
+
+	done := make(chan error)
+	go func() {
+		_, err := shaped.Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	shaped.SetReadDeadline(time.Unix(1, 0))
+	var netErr net.Error
+	if err := <-done; !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("read returned %v; want a timeout", err)
+	}
+
+	shaped.SetReadDeadline(time.Time{})
+	go peer.Write([]byte("x"))
+	if _, err := shaped.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnCloseDeliversWrites(t *testing.T) {
+	shaped, peer := shapedPair(t, Link{Rate: 10000000, Delay: 20 * time.Millisecond}, Link{})
+
+	payload := bytes.Repeat([]byte("netem"), 10000)
+	go func() {
+		shaped.Write(payload)
+		shaped.Close()
+	}()
+	received, err := io.ReadAll(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, payload) {
+		t.Fatalf("received %d of %d bytes before the connection closed", len(received), len(payload))
+	}
+}
+
+// TestListenerSharesLink downloads over two connections at once and expects
+// them to share the rate of the link
+func TestListenerSharesLink(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(inner, Profile{Down: Link{Rate: 8000000}})
+	defer l.Close()
+
+	// Each connection sends 100000 bytes, 200000 at 8 Mbps take 200ms
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c.Write(make([]byte, 100000))
+				c.Close()
+			}()
+		}
+	}()
+
+	start := time.Now()
+	done := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			c, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				done <- err
+				return
+			}
+			defer c.Close()
+			_, err = io.ReadFull(c, make([]byte, 100000))
+			done <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkDuration(t, time.Since(start), 200*time.Millisecond)
+}
+
+// slowDialer takes delay to connect, like a dialer on a loaded machine
+type slowDialer struct {
+	delay time.Duration
+}
+
+func (d slowDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	time.Sleep(d.delay)
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
+func TestDialerHandshakeTakesRoundTrip(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The 30ms the dialer takes are part of the 40ms round trip, not added
+	// to it
+	d := NewDialer(slowDialer{30 * time.Millisecond}, Profile{
+		Down: Link{Delay: 20 * time.Millisecond},
+		Up:   Link{Delay: 20 * time.Millisecond},
+	})
+	start := time.Now()
+	c, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	checkDuration(t, time.Since(start), 40*time.Millisecond)
+}
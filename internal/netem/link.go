@@ -0,0 +1,195 @@
+// Package netem emulates network links in user space. It wraps net.Conn,
+// net.Listener and dialers so that traffic crosses a link of a given rate,
+// delay, jitter and loss, which lets the measurement code be checked against
+// known conditions on a machine without a network.
+package netem
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Link describes one direction of an emulated link
+type Link struct {
+	// Rate is the bottleneck rate in bits per second; zero is unlimited
+	Rate int64
+	// Delay is the one-way propagation delay
+	Delay time.Duration
+	// Jitter is the largest random deviation from Delay. Data is never
+	// reordered, so a segment is held back until the one before it arrived.
+	Jitter time.Duration
+	// Loss is the probability that a segment is lost. Connections are
+	// reliable streams, so a lost segment is sent again, which takes up the
+	// link a second time and delays its arrival by a round trip.
+	Loss float64
+	// Stalls is the mean number of times per second of sending that the
+	// link stalls, holding everything behind it for StallTime. Only links
+	// with a rate stall.
+	Stalls    float64
+	StallTime time.Duration
+}
+
+// shaped reports whether the link changes the traffic at all
+func (l Link) shaped() bool {
+	return l != Link{}
+}
+
+// serialization returns how long the link takes to send n bytes
+func (l Link) serialization(n int) time.Duration {
+	if l.Rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(n) * 8 / float64(l.Rate) * float64(time.Second))
+}
+
+// delay returns the propagation delay of one segment, including jitter
+func (l Link) delay() time.Duration {
+	d := l.Delay
+	if l.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * float64(l.Jitter))
+	}
+	return max(d, 0)
+}
+
+// Profile describes both directions of an emulated link as seen from the
+// client
+type Profile struct {
+	Down Link
+	Up   Link
+}
+
+// ParseProfile parses a profile written as comma separated key=value pairs,
+// for example "down=10mbit,up=1mbit,rtt=40ms,jitter=2ms,loss=0.1%".
+// Rates take a bit, kbit, mbit or gbit suffix. rtt is split evenly between
+// the two directions, while jitter, loss, stalls (per second) and
+// stall_time apply to each direction.
+func ParseProfile(s string) (Profile, error) {
+	var p Profile
+	for _, field := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return Profile{}, fmt.Errorf("invalid link setting %q", field)
+		}
+		var err error
+		switch key {
+		case "down":
+			p.Down.Rate, err = ParseRate(value)
+		case "up":
+			p.Up.Rate, err = ParseRate(value)
+		case "rtt":
+			var rtt time.Duration
+			rtt, err = time.ParseDuration(value)
+			p.Down.Delay, p.Up.Delay = rtt/2, rtt/2
+		case "jitter":
+			var jitter time.Duration
+			jitter, err = time.ParseDuration(value)
+			p.Down.Jitter, p.Up.Jitter = jitter, jitter
+		case "loss":
+			var loss float64
+			loss, err = parseFraction(value)
+			p.Down.Loss, p.Up.Loss = loss, loss
+		case "stalls":
+			var stalls float64
+			stalls, err = strconv.ParseFloat(value, 64)
+			p.Down.Stalls, p.Up.Stalls = stalls, stalls
+		case "stall_time":
+			var stallTime time.Duration
+			stallTime, err = time.ParseDuration(value)
+			p.Down.StallTime, p.Up.StallTime = stallTime, stallTime
+		default:
+			return Profile{}, fmt.Errorf("unknown link setting %q", key)
+		}
+		if err != nil {
+			return Profile{}, fmt.Errorf("invalid %s: %v", key, err)
+		}
+	}
+	for _, l := range []Link{p.Down, p.Up} {
+		if l.Rate < 0 || l.Delay < 0 || l.Jitter < 0 || l.Stalls < 0 || l.StallTime < 0 {
+			return Profile{}, fmt.Errorf("rates, delays and stalls must not be negative")
+		}
+		if l.Loss < 0 || l.Loss >= 1 {
+			return Profile{}, fmt.Errorf("loss must be in [0, 1)")
+		}
+	}
+	return p, nil
+}
+
+// rateUnits are the rate suffixes ParseRate accepts, longest first
+var rateUnits = []struct {
+	suffix string
+	bits   float64
+}{
+	{"kbit", 1e3},
+	{"mbit", 1e6},
+	{"gbit", 1e9},
+	{"bit", 1},
+}
+
+// ParseRate parses a rate in bits per second such as "500kbit" or "10mbit"
+func ParseRate(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for _, unit := range rateUnits {
+		if number, ok := strings.CutSuffix(s, unit.suffix); ok {
+			value, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+			if err != nil {
+				return 0, err
+			}
+			return int64(value * unit.bits), nil
+		}
+	}
+	return 0, fmt.Errorf("rate %q needs a bit, kbit, mbit or gbit suffix", s)
+}
+
+// parseFraction parses a probability given as a fraction or a percentage
+func parseFraction(s string) (float64, error) {
+	if percent, ok := strings.CutSuffix(s, "%"); ok {
+		value, err := strconv.ParseFloat(percent, 64)
+		return value / 100, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// wire is one direction of a link. Every connection over the link reserves
+// its segments on the same wire, so they share its rate like flows through a
+// real bottleneck.
+type wire struct {
+	link Link
+
+	mu     sync.Mutex
+	idleAt time.Time
+}
+
+func newWire(link Link) *wire {
+	return &wire{link: link}
+}
+
+// reserve books the wire for a segment of n bytes handed over at now and
+// returns when it has been sent. A lost segment is sent twice, and a stall
+// keeps the wire busy for its duration first.
+func (w *wire) reserve(n int, now time.Time) (sent time.Time, lost bool) {
+	lost = w.link.Loss > 0 && rand.Float64() < w.link.Loss
+	busy := w.link.serialization(n)
+	if lost {
+		busy *= 2
+	}
+	if w.link.Stalls > 0 && rand.Float64() < w.link.Stalls*busy.Seconds() {
+		busy += w.link.StallTime
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.idleAt = later(w.idleAt, now).Add(busy)
+	return w.idleAt, lost
+}
+
+// later returns the later of two times
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
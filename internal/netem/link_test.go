@@ -0,0 +1,54 @@
+package netem
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseProfile(t *testing.T) {
+	profile, err := ParseProfile("down=10mbit, up=512kbit, rtt=40ms, jitter=2ms, loss=0.5%, stalls=0.1, stall_time=800ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Profile{
+		Down: Link{Rate: 10000000, Delay: 20 * time.Millisecond, Jitter: 2 * time.Millisecond, Loss: 0.005, Stalls: 0.1, StallTime: 800 * time.Millisecond},
+		Up:   Link{Rate: 512000, Delay: 20 * time.Millisecond, Jitter: 2 * time.Millisecond, Loss: 0.005, Stalls: 0.1, StallTime: 800 * time.Millisecond},
+	}
+	if profile != want {
+		t.Fatalf("parsed %+v; want %+v", profile, want)
+	}
+
+	for _, invalid := range []string{
+		"down=10",
+		"down=fast",
+		"rtt=40",
+		"loss=1",
+		"loss=-0.1",
+		"stalls=-1",
+		"speed=10mbit",
+		"down",
+	} {
+		if _, err := ParseProfile(invalid); err == nil {
+			t.Errorf("parsed invalid profile %q", invalid)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for s, want := range map[string]int64{
+		"800bit":   800,
+		"1.5mbit":  1500000,
+		"64kbit":   64000,
+		"2Gbit":    2000000000,
+		"0.5 mbit": 500000,
+	} {
+		rate, err := ParseRate(s)
+		if err != nil {
+			t.Errorf("parsing %q: %v", s, err)
+			continue
+		}
+		if rate != want {
+			t.Errorf("parsed %q as %d; want %d", s, rate, want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package netem
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Path is an emulated link in both directions. Every stream crossing a path
+// shares its rate, like the connections of one client on a real line.
+type Path struct {
+	down *wire
+	up   *wire
+}
+
+// NewPath returns a path emulating profile
+func NewPath(profile Profile) *Path {
+	return &Path{down: newWire(profile.Down), up: newWire(profile.Up)}
+}
+
+// WaitUp blocks for the one-way delay of the up link, as a request crossing
+// it would, or until ctx is done
+func (p *Path) WaitUp(ctx context.Context) error {
+	return sleep(ctx, p.up.link.delay())
+}
+
+// WaitDown blocks for the one-way delay of the down link or until ctx is
+// done
+func (p *Path) WaitDown(ctx context.Context) error {
+	return sleep(ctx, p.down.link.delay())
+}
+
+// NewWriter returns a writer whose bytes cross the down link before they
+// are written to w. If w can be flushed, it is flushed after every write so
+// the bytes leave as they arrive.
+func (p *Path) NewWriter(w io.Writer) *Writer {
+	sw := &Writer{pipe: newPipe(p.down), delivered: make(chan struct{})}
+	go func() {
+		defer close(sw.delivered)
+		sw.err = deliver(sw.pipe, w)
+	}()
+	return sw
+}
+
+// NewReader returns a reader of r that is paced at the rate of the up link.
+// Only the rate, loss and stalls of the link apply; callers add its delay
+// with WaitUp.
+func (p *Path) NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, wire: p.up, segment: segmentSize(p.up.link)}
+}
+
+// Writer writes across the down link of a path. It must be closed, which
+// waits for the bytes written to arrive.
+type Writer struct {
+	pipe      *pipe
+	delivered chan struct{}
+	// err is the error the underlying writer failed with, set before
+	// delivered is closed
+	err error
+}
+
+func (w *Writer) Write(b []byte) (int, error) {
+	return w.pipe.push(b)
+}
+
+// Close waits until everything written has crossed the link and returns
+// the error the underlying writer failed with, if any
+func (w *Writer) Close() error {
+	w.pipe.finish(io.EOF)
+	<-w.delivered
+	return w.err
+}
+
+// Reader reads at the pace of the up link of a path
+type Reader struct {
+	r       io.Reader
+	wire    *wire
+	segment int
+}
+
+func (r *Reader) Read(b []byte) (int, error) {
+	if len(b) > r.segment {
+		b = b[:r.segment]
+	}
+	n, err := r.r.Read(b)
+	if n > 0 {
+		sent, _ := r.wire.reserve(n, time.Now())
+		waitToSend(sent)
+	}
+	return n, err
+}
+
+// deliver writes the segments of p to w as they arrive until p is finished,
+// and returns the error w failed with
+func deliver(p *pipe, w io.Writer) error {
+	buf := make([]byte, maxSegment)
+	flusher, _ := w.(interface{ Flush() })
+	for {
+		n, err := p.pop(buf)
+		if err != nil {
+			return nil
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			p.abort(err)
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// sleep blocks for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,67 @@
+package netem
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestPathWriter(t *testing.T) {
+	// 125000 bytes at 10 Mbps take 100ms and arrive 50ms later
+	path := NewPath(Profile{Down: Link{Rate: 10000000, Delay: 50 * time.Millisecond}})
+	var received bytes.Buffer
+	w := path.NewWriter(&received)
+
+	start := time.Now()
+	payload := bytes.Repeat([]byte{1}, 125000)
+	if _, err := w.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkDuration(t, time.Since(start), 150*time.Millisecond)
+	if !bytes.Equal(received.Bytes(), payload) {
+		t.Fatalf("received %d of %d bytes", received.Len(), len(payload))
+	}
+}
+
+func TestPathReader(t *testing.T) {
+	// 250000 bytes at 10 Mbps take 200ms
+	path := NewPath(Profile{Up: Link{Rate: 10000000}})
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, path.NewReader(bytes.NewReader(make([]byte, 250000))))
+	if err != nil || n != 250000 {
+		t.Fatalf("read %d bytes, err %v", n, err)
+	}
+	checkDuration(t, time.Since(start), 200*time.Millisecond)
+}
+
+func TestPathStalls(t *testing.T) {
+	// Every 2ms segment of an 8 Mbps link stalls for 1ms, so 100000 bytes
+	// take 150ms instead of 100ms
+	path := NewPath(Profile{Up: Link{Rate: 8000000, Stalls: 1000, StallTime: time.Millisecond}})
+
+	start := time.Now()
+	io.Copy(io.Discard, path.NewReader(bytes.NewReader(make([]byte, 100000))))
+	checkDuration(t, time.Since(start), 150*time.Millisecond)
+}
+
+func TestPathWait(t *testing.T) {
+	path := NewPath(Profile{Up: Link{Delay: 30 * time.Millisecond}})
+
+	start := time.Now()
+	if err := path.WaitUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkDuration(t, time.Since(start), 30*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := path.WaitUp(ctx); err != context.Canceled {
+		t.Fatalf("cancelled wait returned %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package netem
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// segmentTime is how long the wire takes to send one segment. Slicing
+	// writes this finely keeps the delivered rate smooth at the 100ms
+	// granularity throughput is sampled at, even on slow links.
+	segmentTime = 2 * time.Millisecond
+
+	// sendAhead is how far a sender may run ahead of the wire. Keeping a
+	// little queued covers late wake-ups of the sender, which would
+	// otherwise leave the wire idle and lower its rate.
+	sendAhead = 10 * time.Millisecond
+
+	// minSegment and maxSegment bound the segment size
+	minSegment = 512
+	maxSegment = 64 << 10
+
+	// unlimitedWindow bounds the bytes in flight over a link without a
+	// rate, which would otherwise buffer everything the sender writes
+	unlimitedWindow = 4 << 20
+)
+
+// segment is a slice of the stream on its way over the link
+type segment struct {
+	data []byte
+	at   time.Time
+}
+
+// pipe carries one direction of a connection over a wire. push paces the
+// bytes of the sender at the wire's rate and stamps each segment with the
+// time it reaches the far end; pop hands them to the receiver once they
+// have arrived.
+type pipe struct {
+	wire    *wire
+	segment int
+	// window bounds the bytes queued in the pipe. It covers the bytes in
+	// flight at the full rate, so it only throttles a stalled receiver.
+	window int
+
+	mu      sync.Mutex
+	changed chan struct{}
+	queue   []segment
+	queued  int
+	lastAt  time.Time
+	// err is returned by pop once the queue has drained; push fails once it
+	// is set
+	err error
+	// broken fails both ends at once, dropping whatever is queued
+	broken error
+	// pushDeadline and popDeadline are the deadlines of the side of the
+	// pipe the connection's user sees
+	pushDeadline time.Time
+	popDeadline  time.Time
+}
+
+// segmentSize returns the size of the segments sent over link
+func segmentSize(link Link) int {
+	size := int(float64(link.Rate) / 8 * segmentTime.Seconds())
+	return min(max(size, minSegment), maxSegment)
+}
+
+func newPipe(w *wire) *pipe {
+	link := w.link
+	window := unlimitedWindow
+	if link.Rate > 0 {
+		inFlight := float64(link.Rate) / 8 * (2*link.Delay + link.Jitter).Seconds()
+		window = 2*int(inFlight) + 4*maxSegment
+	}
+	return &pipe{
+		wire:    w,
+		segment: segmentSize(link),
+		window:  window,
+		changed: make(chan struct{}),
+	}
+}
+
+// push sends b over the link. It returns once the last segment is within
+// sendAhead of being on the wire, so the sender is slowed to the link's
+// rate.
+func (p *pipe) push(b []byte) (int, error) {
+	var n int
+	for n < len(b) {
+		size := min(len(b)-n, p.segment)
+		sent, err := p.enqueue(b[n : n+size])
+		if err != nil {
+			return n, err
+		}
+		n += size
+		waitToSend(sent)
+	}
+	return n, nil
+}
+
+// waitToSend blocks until a segment sent at sent is within sendAhead of
+// being on the wire
+func waitToSend(sent time.Time) {
+	if wait := time.Until(sent) - sendAhead; wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// enqueue reserves the wire for data and queues it for delivery, waiting
+// while the window is full
+func (p *pipe) enqueue(data []byte) (time.Time, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		switch {
+		case p.broken != nil:
+			return time.Time{}, p.broken
+		case p.err != nil:
+			return time.Time{}, net.ErrClosed
+		case expired(p.pushDeadline):
+			return time.Time{}, os.ErrDeadlineExceeded
+		}
+		if p.queued == 0 || p.queued+len(data) <= p.window {
+			break
+		}
+		p.wait(p.pushDeadline)
+	}
+
+	sent, lost := p.wire.reserve(len(data), time.Now())
+	delay := p.wire.link.delay()
+	if lost {
+		delay += 2 * p.wire.link.Delay
+	}
+	at := later(sent.Add(delay), p.lastAt)
+	p.lastAt = at
+
+	p.queue = append(p.queue, segment{data: bytes.Clone(data), at: at})
+	p.queued += len(data)
+	p.notify()
+	return sent, nil
+}
+
+// pop fills b with the segments that have arrived, waiting for the first
+// one if none has
+func (p *pipe) pop(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if p.broken != nil {
+			return 0, p.broken
+		}
+		if expired(p.popDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		now := time.Now()
+		var n int
+		for n < len(b) && len(p.queue) > 0 && !p.queue[0].at.After(now) {
+			head := &p.queue[0]
+			copied := copy(b[n:], head.data)
+			head.data = head.data[copied:]
+			n += copied
+			if len(head.data) == 0 {
+				p.queue[0] = segment{}
+				p.queue = p.queue[1:]
+			}
+		}
+		if n > 0 {
+			p.queued -= n
+			p.notify()
+			return n, nil
+		}
+
+		wake := p.popDeadline
+		if len(p.queue) > 0 {
+			if wake.IsZero() || p.queue[0].at.Before(wake) {
+				wake = p.queue[0].at
+			}
+		} else if p.err != nil {
+			return 0, p.err
+		}
+		p.wait(wake)
+	}
+}
+
+// finish ends the stream once the queued segments have been delivered, with
+// err returned to the receiver after them. It returns when the last segment
+// arrives.
+func (p *pipe) finish(err error) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+		p.notify()
+	}
+	return p.lastAt
+}
+
+// abort fails both ends of the pipe with err and drops the queued segments
+func (p *pipe) abort(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.broken == nil {
+		p.broken = err
+		p.queue, p.queued = nil, 0
+		p.notify()
+	}
+}
+
+func (p *pipe) setPushDeadline(t time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pushDeadline = t
+	p.notify()
+}
+
+func (p *pipe) setPopDeadline(t time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.popDeadline = t
+	p.notify()
+}
+
+// notify wakes every goroutine waiting on the pipe. The caller holds p.mu.
+func (p *pipe) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// wait releases p.mu until the pipe changes or until, if it is not zero
+func (p *pipe) wait(until time.Time) {
+	changed := p.changed
+	p.mu.Unlock()
+	defer p.mu.Lock()
+	if until.IsZero() {
+		<-changed
+		return
+	}
+	timer := time.NewTimer(time.Until(until))
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-timer.C:
+	}
+}
+
+// expired reports whether a deadline is set and has passed
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
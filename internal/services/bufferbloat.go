@@ -0,0 +1,163 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/measure"
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+// loadedProbeInterval is the pause between latency probes sent while a
+// throughput phase is running
+const loadedProbeInterval = 200 * time.Millisecond
+
+// Bufferbloat grades, from best to worst
+const (
+	BufferbloatGradeA = "A"
+	BufferbloatGradeB = "B"
+	BufferbloatGradeC = "C"
+	BufferbloatGradeD = "D"
+	BufferbloatGradeF = "F"
+)
+
+// bufferbloatGrades maps the increase of the median RTT under load, in ms,
+// to a grade. The first entry whose limit is above the increase applies.
+var bufferbloatGrades = []struct {
+	limit float64
+	grade string
+}{
+	{30, BufferbloatGradeA},
+	{60, BufferbloatGradeB},
+	{200, BufferbloatGradeC},
+	{400, BufferbloatGradeD},
+}
+
+// latencyProbe measures the TCP connect time to a test server repeatedly in
+// the background, so that latency can be observed while a phase saturates
+// the link
+type latencyProbe struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	mu     sync.Mutex
+	rtts   []float64
+}
+
+// startLatencyProbe starts probing the server until stop is called or ctx
+// is done
+func startLatencyProbe(ctx context.Context, server TestServer) *latencyProbe {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &latencyProbe{cancel: cancel, done: make(chan struct{})}
+
+	go func() {
+		defer close(p.done)
+		addr, err := measure.ServerAddress(server.URL)
+		if err != nil {
+			return
+		}
+
+		dialer := &net.Dialer{Timeout: serverProbeTimeout}
+		ticker := time.NewTicker(loadedProbeInterval)
+		defer ticker.Stop()
+		for {
+			start := time.Now()
+			if conn, err := dialer.DialContext(ctx, "tcp", addr); err == nil {
+				rtt := measure.Millis(time.Since(start))
+				conn.Close()
+				p.mu.Lock()
+				p.rtts = append(p.rtts, rtt)
+				p.mu.Unlock()
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return p
+}
+
+// stop ends probing and returns the RTTs measured so far in milliseconds. A
+// probe still in flight is abandoned.
+func (p *latencyProbe) stop() []float64 {
+	p.cancel()
+	<-p.done
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rtts
+}
+
+// newLoadedLatency summarizes the RTTs measured during each throughput phase
+// against the idle baseline. It returns nil if the server was unreachable
+// while idle.
+func newLoadedLatency(idle ServerLatency, download, upload []float64) *models.LoadedLatencyResult {
+	if !idle.reachable() {
+		return nil
+	}
+
+	result := &models.LoadedLatencyResult{IdleMedian: idle.MedianRTT}
+	if len(download) > 0 {
+		stats := measure.NewLatencyStats(download)
+		result.DownloadMedian = stats.Median
+		result.DownloadP95 = stats.P95
+		result.DownloadJitter = stats.Jitter
+	}
+	if len(upload) > 0 {
+		stats := measure.NewLatencyStats(upload)
+		result.UploadMedian = stats.Median
+		result.UploadP95 = stats.P95
+		result.UploadJitter = stats.Jitter
+	}
+	return result
+}
+
+// loadedLatency summarizes the RTTs probed during the throughput phases
+// measured against the test server and returns their provenance. A phase
+// that fell back to the public prober moved its data to and from other
+// hosts without loading the path to the server, so its probes are dropped.
+func loadedLatency(server TestServer, idle ServerLatency, provenance *models.ResultProvenance, download, upload []float64) (*models.LoadedLatencyResult, models.Provenance) {
+	if !idle.reachable() {
+		return nil, unavailable(MethodTCPConnect, server.URL, fmt.Errorf("idle baseline probe failed: %s", idle.Error))
+	}
+	downloadLoaded := provenance.Download.Source == models.SourcePrimary
+	uploadLoaded := provenance.Upload.Source == models.SourcePrimary
+	if !downloadLoaded && !uploadLoaded {
+		return nil, unavailable(MethodTCPConnect, server.URL, fmt.Errorf("no throughput phase loaded the test server: download %s, upload %s",
+			provenance.Download.Source, provenance.Upload.Source))
+	}
+	if !downloadLoaded {
+		download = nil
+	}
+	if !uploadLoaded {
+		upload = nil
+	}
+	return newLoadedLatency(idle, download, upload), measured(models.SourcePrimary, MethodTCPConnect, server.URL)
+}
+
+// bufferbloatGrade grades the worst increase of the median RTT under load
+// over the idle median. It returns an empty grade if neither direction was
+// measured.
+func bufferbloatGrade(loaded *models.LoadedLatencyResult) string {
+	if loaded == nil || (loaded.DownloadMedian == 0 && loaded.UploadMedian == 0) {
+		return ""
+	}
+
+	increase := 0.0
+	for _, loadedMedian := range []float64{loaded.DownloadMedian, loaded.UploadMedian} {
+		if loadedMedian-loaded.IdleMedian > increase {
+			increase = loadedMedian - loaded.IdleMedian
+		}
+	}
+
+	for _, g := range bufferbloatGrades {
+		if increase < g.limit {
+			return g.grade
+		}
+	}
+	return BufferbloatGradeF
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+func TestBufferbloatGrade(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		loaded *models.LoadedLatencyResult
+		want   string
+	}{
+		{"not measured", nil, ""},
+		{"neither direction loaded", &models.LoadedLatencyResult{IdleMedian: 20}, ""},
+		{"no increase", &models.LoadedLatencyResult{IdleMedian: 20, DownloadMedian: 20, UploadMedian: 20}, BufferbloatGradeA},
+		{"faster under load", &models.LoadedLatencyResult{IdleMedian: 20, DownloadMedian: 15}, BufferbloatGradeA},
+		{"just below B", &models.LoadedLatencyResult{IdleMedian: 20, DownloadMedian: 49.9}, BufferbloatGradeA},
+		{"B", &models.LoadedLatencyResult{IdleMedian: 20, DownloadMedian: 50}, BufferbloatGradeB},
+		{"C", &models.LoadedLatencyResult{IdleMedian: 20, UploadMedian: 80}, BufferbloatGradeC},
+		{"D", &models.LoadedLatencyResult{IdleMedian: 20, DownloadMedian: 220}, BufferbloatGradeD},
+		{"F", &models.LoadedLatencyResult{IdleMedian: 20, UploadMedian: 420}, BufferbloatGradeF},
+		// The worse direction sets the grade
+		{"worse upload", &models.LoadedLatencyResult{IdleMedian: 20, DownloadMedian: 25, UploadMedian: 150}, BufferbloatGradeC},
+		{"worse download", &models.LoadedLatencyResult{IdleMedian: 20, DownloadMedian: 300, UploadMedian: 25}, BufferbloatGradeD},
+	} {
+		if grade := bufferbloatGrade(tc.loaded); grade != tc.want {
+			t.Errorf("%s: graded %q; want %q", tc.name, grade, tc.want)
+		}
+	}
+}
+
+func TestNewLoadedLatency(t *testing.T) {
+	if loaded := newLoadedLatency(ServerLatency{}, []float64{10}, []float64{10}); loaded != nil {
+		t.Fatalf("summarized an unreachable server as %+v", loaded)
+	}
+
+	idle := ServerLatency{MedianRTT: 20, Samples: 5}
+	loaded := newLoadedLatency(idle, []float64{30, 40, 50}, nil)
+	if loaded.IdleMedian != 20 || loaded.DownloadMedian != 40 || loaded.UploadMedian != 0 {
+		t.Fatalf("summarized as %+v", loaded)
+	}
+	if grade := bufferbloatGrade(loaded); grade != BufferbloatGradeA {
+		t.Fatalf("graded a 20ms increase %q", grade)
+	}
+}
+
+// TestLoadedLatencyUsesPrimaryPhases expects the probes of a phase that fell
+// back to the public prober to be left out of the grade
+func TestLoadedLatencyUsesPrimaryPhases(t *testing.T) {
+	server := TestServer{ID: "local", URL: "http://127.0.0.1:9090"}
+	idle := ServerLatency{MedianRTT: 20, Samples: 5}
+	primary := models.Provenance{Source: models.SourcePrimary}
+	fallback := models.Provenance{Source: models.SourceAlternative}
+
+	loaded, provenance := loadedLatency(server, idle, &models.ResultProvenance{Download: primary, Upload: fallback}, []float64{30}, []float64{25})
+	if provenance.Source != models.SourcePrimary || loaded.DownloadMedian != 30 || loaded.UploadMedian != 0 {
+		t.Fatalf("summarized as %+v from %+v", loaded, provenance)
+	}
+
+	loaded, provenance = loadedLatency(server, idle, &models.ResultProvenance{Download: fallback, Upload: fallback}, []float64{21}, []float64{21})
+	if loaded != nil || provenance.Source != models.SourceUnavailable || !strings.Contains(provenance.Error, models.SourceAlternative) {
+		t.Fatalf("summarized fallback phases as %+v from %+v", loaded, provenance)
+	}
+	if grade := bufferbloatGrade(loaded); grade != "" {
+		t.Fatalf("graded fallback phases %q", grade)
+	}
+
+	loaded, provenance = loadedLatency(server, ServerLatency{Error: "refused"}, &models.ResultProvenance{Download: primary}, []float64{30}, nil)
+	if loaded != nil || provenance.Source != models.SourceUnavailable {
+		t.Fatalf("summarized an unreachable server as %+v from %+v", loaded, provenance)
+	}
+}
@@ -0,0 +1,12 @@
+package services
+
+import "github.com/cetinibs/online-speed-test-backend-root/internal/models"
+
+// connectionTimings returns the connection timings of result, creating them
+// if needed
+func connectionTimings(result *models.SpeedTestResult) *models.ConnectionTimings {
+	if result.ConnectionTimings == nil {
+		result.ConnectionTimings = &models.ConnectionTimings{}
+	}
+	return result.ConnectionTimings
+}
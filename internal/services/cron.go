@@ -0,0 +1,148 @@
+package services
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronMacros are the shorthand schedules parseCron accepts
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// cronSearchYears bounds the search for the next run of a schedule, so a
+// day that never comes, such as February 30, ends it
+const cronSearchYears = 5
+
+// cronSpec is a parsed five-field cron expression. Each field is a bit set
+// of the values it matches.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	// anyDOM and anyDOW record a day field starting with "*". As in cron, a
+	// run is due on days matching either day field unless one of them does.
+	anyDOM, anyDOW bool
+}
+
+// parseCron parses a cron expression of the form "minute hour day-of-month
+// month day-of-week". Fields take "*", numbers, ranges "a-b", steps "*/n"
+// or "a-b/n" and comma separated lists of these. Sunday is 0 or 7. The
+// macros @hourly, @daily, @weekly and @monthly are accepted too.
+func parseCron(expr string) (cronSpec, error) {
+	if macro, ok := cronMacros[strings.TrimSpace(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSpec{}, fmt.Errorf("cron expression %q needs 5 fields", expr)
+	}
+
+	var spec cronSpec
+	var err error
+	for i, field := range []struct {
+		name     string
+		set      *uint64
+		min, max int
+	}{
+		{"minute", &spec.minute, 0, 59},
+		{"hour", &spec.hour, 0, 23},
+		{"day of month", &spec.dom, 1, 31},
+		{"month", &spec.month, 1, 12},
+		{"day of week", &spec.dow, 0, 7},
+	} {
+		if *field.set, err = parseCronField(fields[i], field.min, field.max); err != nil {
+			return cronSpec{}, fmt.Errorf("invalid %s field %q: %v", field.name, fields[i], err)
+		}
+	}
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+	spec.anyDOM = strings.HasPrefix(fields[2], "*")
+	spec.anyDOW = strings.HasPrefix(fields[4], "*")
+	return spec, nil
+}
+
+// parseCronField parses one field of a cron expression into the bit set of
+// the values in [min, max] it matches
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		values, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepText)
+			}
+		}
+
+		low, high := min, max
+		if values != "*" {
+			lowText, highText, isRange := strings.Cut(values, "-")
+			var err error
+			if low, err = strconv.Atoi(lowText); err != nil {
+				return 0, fmt.Errorf("invalid value %q", lowText)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(highText); err != nil {
+					return 0, fmt.Errorf("invalid value %q", highText)
+				}
+			} else if hasStep {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("values must be between %d and %d", min, max)
+		}
+		for v := low; v <= high; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// matchesDay reports whether t falls on a day the schedule runs
+func (c cronSpec) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	if c.anyDOM || c.anyDOW {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first run of the schedule strictly after t, in the
+// location of t, or the zero time if there is none within cronSearchYears
+func (c cronSpec) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronSearchYears, 0, 0)
+
+	// Step to the next matching month, day, hour and minute in turn,
+	// starting over whenever a step rolls a larger unit over
+	for t.Before(limit) {
+		if c.month&(1<<int(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if c.hour&(1<<t.Hour()) == 0 {
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			continue
+		}
+		if c.minute&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
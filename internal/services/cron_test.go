@@ -0,0 +1,82 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// 2026-03-14 is a Saturday
+	from := time.Date(2026, 3, 14, 10, 17, 30, 0, time.UTC)
+	for _, tc := range []struct {
+		expr string
+		want time.Time
+	}{
+		{"0 * * * *", time.Date(2026, 3, 14, 11, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, 3, 14, 11, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2026, 3, 14, 10, 20, 0, 0, time.UTC)},
+		{"17 10 * * *", time.Date(2026, 3, 15, 10, 17, 0, 0, time.UTC)},
+		{"30 2,14 * * *", time.Date(2026, 3, 14, 14, 30, 0, 0, time.UTC)},
+		{"0 9-17/4 * * 1-5", time.Date(2026, 3, 16, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// With both day fields restricted, either one matches
+		{"0 0 20 * 1", time.Date(2026, 3, 16, 0, 0, 0, 0, time.UTC)},
+	} {
+		spec, err := parseCron(tc.expr)
+		if err != nil {
+			t.Errorf("parsing %q: %v", tc.expr, err)
+			continue
+		}
+		if next := spec.next(from); !next.Equal(tc.want) {
+			t.Errorf("next run of %q is %v; want %v", tc.expr, next, tc.want)
+		}
+	}
+}
+
+func TestCronNextInTimeZone(t *testing.T) {
+	istanbul, err := time.LoadLocation("Europe/Istanbul")
+	if err != nil {
+		t.Skip("time zone database not available")
+	}
+	spec, err := parseCron("@daily")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2026, 3, 14, 22, 30, 0, 0, time.UTC).In(istanbul)
+	if next, want := spec.next(from), time.Date(2026, 3, 15, 21, 0, 0, 0, time.UTC); !next.Equal(want) {
+		t.Fatalf("next run is %v; want %v", next, want)
+	}
+}
+
+func TestCronNeverRuns(t *testing.T) {
+	spec, err := parseCron("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := spec.next(time.Now()); !next.IsZero() {
+		t.Fatalf("February 30 came on %v", next)
+	}
+}
+
+func TestParseCronRejectsInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@yearly",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parsed invalid cron expression %q", expr)
+		}
+	}
+}
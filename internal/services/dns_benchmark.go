@@ -0,0 +1,419 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/measure"
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+// Protocols a DNS resolver can be queried over
+const (
+	// DNSProtocolSystem uses the resolver configured on this host
+	DNSProtocolSystem = "system"
+	DNSProtocolUDP    = "udp"
+	DNSProtocolTCP    = "tcp"
+	// DNSProtocolDoH is DNS over HTTPS as defined in RFC 8484
+	DNSProtocolDoH = "doh"
+)
+
+const (
+	dnsMaxResolvers = 20
+	dnsMaxNames     = 50
+	dnsMaxQueries   = 10
+	dnsMaxTimeout   = 10 * time.Second
+
+	// dnsMaxMessageSize is the largest DNS message read from a resolver
+	dnsMaxMessageSize = 65535
+
+	// dnsMaxRecommendedFailureRate is the failure rate, in percent, above
+	// which a resolver is not recommended however fast it is
+	dnsMaxRecommendedFailureRate = 10
+)
+
+// DNSResolver is a resolver benchmarked by the DNS phase
+type DNSResolver struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+	// Address is the host:port of a UDP or TCP resolver or the URL of a DoH
+	// endpoint. The system resolver has none.
+	Address string `json:"address,omitempty"`
+}
+
+// DNSConfig controls the DNS resolver benchmark
+type DNSConfig struct {
+	Resolvers []DNSResolver
+	// Names are the host names looked up with every resolver
+	Names []string
+	// Queries is the number of lookups of each name per resolver
+	Queries int
+	// Timeout bounds a single lookup
+	Timeout time.Duration
+}
+
+// DefaultDNSConfig returns the default DNS benchmark settings
+func DefaultDNSConfig() DNSConfig {
+	return DNSConfig{
+		Resolvers: []DNSResolver{
+			{Name: "System", Protocol: DNSProtocolSystem},
+			{Name: "Cloudflare", Protocol: DNSProtocolUDP, Address: "1.1.1.1:53"},
+			{Name: "Google", Protocol: DNSProtocolUDP, Address: "8.8.8.8:53"},
+			{Name: "Quad9", Protocol: DNSProtocolTCP, Address: "9.9.9.9:53"},
+			{Name: "Cloudflare DoH", Protocol: DNSProtocolDoH, Address: "https://cloudflare-dns.com/dns-query"},
+		},
+		Names:   []string{"www.google.com", "www.cloudflare.com", "www.wikipedia.org", "www.amazon.com", "www.microsoft.com"},
+		Queries: 3,
+		Timeout: 2 * time.Second,
+	}
+}
+
+// validate checks that the configuration is within safe bounds
+func (c DNSConfig) validate() error {
+	if len(c.Resolvers) > dnsMaxResolvers {
+		return fmt.Errorf("at most %d resolvers can be benchmarked", dnsMaxResolvers)
+	}
+	for _, resolver := range c.Resolvers {
+		if err := resolver.validate(); err != nil {
+			return err
+		}
+	}
+	if len(c.Names) == 0 || len(c.Names) > dnsMaxNames {
+		return fmt.Errorf("between 1 and %d names must be looked up", dnsMaxNames)
+	}
+	for _, name := range c.Names {
+		if err := validateDNSName(name); err != nil {
+			return err
+		}
+	}
+	if c.Queries <= 0 || c.Queries > dnsMaxQueries {
+		return fmt.Errorf("queries per name must be between 1 and %d", dnsMaxQueries)
+	}
+	if c.Timeout <= 0 || c.Timeout > dnsMaxTimeout {
+		return fmt.Errorf("lookup timeout must be positive and at most %s", dnsMaxTimeout)
+	}
+	return nil
+}
+
+// validateDNSName checks that name is a host name made of letters, digits
+// and hyphens, with an optional trailing dot
+func validateDNSName(name string) error {
+	labels := strings.TrimSuffix(name, ".")
+	if labels == "" || len(labels) > 253 {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	for _, label := range strings.Split(labels, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid name %q", name)
+		}
+		for _, c := range label {
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+				return fmt.Errorf("invalid name %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks that the resolver can be queried
+func (r DNSResolver) validate() error {
+	switch r.Protocol {
+	case DNSProtocolSystem:
+		return nil
+	case DNSProtocolUDP, DNSProtocolTCP:
+		if _, _, err := net.SplitHostPort(r.Address); err != nil {
+			return fmt.Errorf("invalid address of resolver %q: %w", r.Name, err)
+		}
+		return nil
+	case DNSProtocolDoH:
+		u, err := url.Parse(r.Address)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("invalid DoH URL of resolver %q", r.Name)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown protocol %q of resolver %q", r.Protocol, r.Name)
+}
+
+// ParseDNSResolver parses a resolver given as "system", "udp://host:port",
+// "tcp://host:port" or a DoH URL such as "https://host/dns-query". The port
+// of UDP and TCP resolvers defaults to 53.
+func ParseDNSResolver(spec string) (DNSResolver, error) {
+	if spec == DNSProtocolSystem {
+		return DNSResolver{Name: "System", Protocol: DNSProtocolSystem}, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return DNSResolver{}, err
+	}
+	resolver := DNSResolver{Name: spec}
+	switch u.Scheme {
+	case "udp", "tcp":
+		resolver.Protocol = u.Scheme
+		resolver.Address = u.Host
+		if u.Port() == "" {
+			resolver.Address = net.JoinHostPort(u.Hostname(), "53")
+		}
+	case "https", "http":
+		resolver.Protocol = DNSProtocolDoH
+		resolver.Address = spec
+	default:
+		return DNSResolver{}, fmt.Errorf("unsupported resolver %q", spec)
+	}
+	return resolver, resolver.validate()
+}
+
+// measureDNS benchmarks every configured resolver in parallel and
+// recommends the fastest one that answered reliably
+func (s *SpeedTestService) measureDNS(ctx context.Context) (*models.DNSResult, error) {
+	cfg := s.dns
+	if len(cfg.Resolvers) == 0 {
+		return nil, fmt.Errorf("no DNS resolvers configured")
+	}
+
+	result := &models.DNSResult{Resolvers: make([]models.DNSResolverResult, len(cfg.Resolvers))}
+	var wg sync.WaitGroup
+	for i, resolver := range cfg.Resolvers {
+		wg.Add(1)
+		go func(i int, resolver DNSResolver) {
+			defer wg.Done()
+			result.Resolvers[i] = benchmarkResolver(ctx, sharedClient, resolver, cfg)
+		}(i, resolver)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+
+	var best *models.DNSResolverResult
+	for i := range result.Resolvers {
+		candidate := &result.Resolvers[i]
+		if candidate.Queries == candidate.Failures || candidate.FailureRate > dnsMaxRecommendedFailureRate {
+			continue
+		}
+		if best == nil || candidate.Median < best.Median {
+			best = candidate
+		}
+	}
+	if best == nil {
+		return result, fmt.Errorf("no resolver answered reliably")
+	}
+	result.Recommended = best.Name
+	return result, nil
+}
+
+// resolverNames lists the names of the resolvers for provenance records
+func resolverNames(resolvers []DNSResolver) string {
+	names := make([]string, len(resolvers))
+	for i, resolver := range resolvers {
+		names[i] = resolver.Name
+	}
+	return strings.Join(names, ",")
+}
+
+// benchmarkResolver looks up every name cfg.Queries times with resolver.
+// DoH queries are sent through client and reuse its connections, like a
+// browser would.
+func benchmarkResolver(ctx context.Context, client *http.Client, resolver DNSResolver, cfg DNSConfig) models.DNSResolverResult {
+	result := models.DNSResolverResult{Name: resolver.Name, Protocol: resolver.Protocol, Address: resolver.Address}
+	var times []float64
+	for i := 0; i < cfg.Queries; i++ {
+		for _, name := range cfg.Names {
+			if ctx.Err() != nil {
+				break
+			}
+			lookupCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+			start := time.Now()
+			err := lookup(lookupCtx, client, resolver, name)
+			elapsed := time.Since(start)
+			cancel()
+
+			result.Queries++
+			if err != nil {
+				result.Failures++
+				result.Error = err.Error()
+				continue
+			}
+			times = append(times, measure.Millis(elapsed))
+		}
+	}
+
+	if result.Queries > 0 {
+		result.FailureRate = float64(result.Failures) / float64(result.Queries) * 100
+	}
+	result.Median = measure.Median(times)
+	result.P95 = measure.Percentile(times, 95)
+	return result
+}
+
+// lookup resolves the A records of name with resolver
+func lookup(ctx context.Context, client *http.Client, resolver DNSResolver, name string) error {
+	switch resolver.Protocol {
+	case DNSProtocolSystem:
+		_, err := net.DefaultResolver.LookupIP(ctx, "ip4", name)
+		return err
+	case DNSProtocolUDP:
+		return lookupUDP(ctx, resolver.Address, name)
+	case DNSProtocolTCP:
+		return lookupTCP(ctx, resolver.Address, name)
+	case DNSProtocolDoH:
+		return lookupDoH(ctx, client, resolver.Address, name)
+	}
+	return fmt.Errorf("unknown resolver protocol %q", resolver.Protocol)
+}
+
+// lookupUDP sends a query datagram and waits for the matching response
+func lookupUDP(ctx context.Context, addr string, name string) error {
+	id := uint16(rand.Intn(1 << 16))
+	query, err := newDNSQuery(id, name)
+	if err != nil {
+		return err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if _, err := conn.Write(query); err != nil {
+		return err
+	}
+	buf := make([]byte, dnsMaxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		// Stray datagrams, e.g. late answers to an earlier query, are skipped
+		if err := checkDNSResponse(buf[:n], id); !errors.Is(err, errDNSMismatch) {
+			return err
+		}
+	}
+}
+
+// lookupTCP sends a length-prefixed query over a new TCP connection
+func lookupTCP(ctx context.Context, addr string, name string) error {
+	id := uint16(rand.Intn(1 << 16))
+	query, err := newDNSQuery(id, name)
+	if err != nil {
+		return err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(framed, query...)); err != nil {
+		return err
+	}
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return err
+	}
+	response := make([]byte, length)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return err
+	}
+	return checkDNSResponse(response, id)
+}
+
+// lookupDoH posts a query to a DNS over HTTPS endpoint. The ID is zero, as
+// RFC 8484 recommends for cache friendliness.
+func lookupDoH(ctx context.Context, client *http.Client, endpoint string, name string) error {
+	query, err := newDNSQuery(0, name)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(query))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("DoH endpoint returned status %d", resp.StatusCode)
+	}
+	response, err := io.ReadAll(io.LimitReader(resp.Body, dnsMaxMessageSize))
+	if err != nil {
+		return err
+	}
+	return checkDNSResponse(response, 0)
+}
+
+// newDNSQuery builds a recursive query for the A records of name
+func newDNSQuery(id uint16, name string) ([]byte, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: qname, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	return builder.Finish()
+}
+
+// errDNSMismatch is returned for a response to a different query
+var errDNSMismatch = errors.New("DNS response does not match the query")
+
+// checkDNSResponse checks that msg answers the query with the given ID
+// successfully
+func checkDNSResponse(msg []byte, id uint16) error {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(msg)
+	if err != nil {
+		return fmt.Errorf("invalid DNS response: %w", err)
+	}
+	if !header.Response || header.ID != id {
+		return errDNSMismatch
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return fmt.Errorf("resolver answered %s", header.RCode)
+	}
+	return nil
+}
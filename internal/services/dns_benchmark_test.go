@@ -0,0 +1,168 @@
+package services
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubAnswer answers a DNS query with the address 192.0.2.1, or with
+// NXDOMAIN for names under "missing."
+func stubAnswer(query []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	header.Response = true
+	missing := strings.HasPrefix(question.Name.String(), "missing.")
+	if missing {
+		header.RCode = dnsmessage.RCodeNameError
+	}
+	builder := dnsmessage.NewBuilder(nil, header)
+	builder.StartQuestions()
+	builder.Question(question)
+	if !missing {
+		builder.StartAnswers()
+		builder.AResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60},
+			dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+	}
+	return builder.Finish()
+}
+
+// stubDNSServer serves stubAnswer over UDP and TCP on one loopback port and
+// over DoH, and returns a resolver for each
+func stubDNSServer(t *testing.T) []DNSResolver {
+	t.Helper()
+	packets, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { packets.Close() })
+	go func() {
+		buf := make([]byte, dnsMaxMessageSize)
+		for {
+			n, addr, err := packets.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if answer, err := stubAnswer(buf[:n]); err == nil {
+				packets.WriteTo(answer, addr)
+			}
+		}
+	}()
+
+	streams, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { streams.Close() })
+	go func() {
+		for {
+			conn, err := streams.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length uint16
+				if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+					return
+				}
+				query := make([]byte, length)
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				if answer, err := stubAnswer(query); err == nil {
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(answer))), answer...))
+				}
+			}()
+		}
+	}()
+
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, err := io.ReadAll(r.Body)
+		if err != nil || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		answer, err := stubAnswer(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(answer)
+	}))
+	t.Cleanup(doh.Close)
+
+	return []DNSResolver{
+		{Name: "udp", Protocol: DNSProtocolUDP, Address: packets.LocalAddr().String()},
+		{Name: "tcp", Protocol: DNSProtocolTCP, Address: streams.Addr().String()},
+		{Name: "doh", Protocol: DNSProtocolDoH, Address: doh.URL + "/dns-query"},
+	}
+}
+
+func TestMeasureDNSAgainstStubServer(t *testing.T) {
+	resolvers := stubDNSServer(t)
+	service := NewSpeedTestService(nil, nil, NewInMemoryTestServerRegistry())
+	if err := service.SetDNSConfig(DNSConfig{
+		Resolvers: resolvers,
+		Names:     []string{"one.example", "two.example."},
+		Queries:   2,
+		Timeout:   time.Second,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := service.measureDNS(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, resolver := range result.Resolvers {
+		if resolver.Queries != 4 || resolver.Failures != 0 || resolver.Median <= 0 {
+			t.Errorf("resolver %s measured %+v", resolver.Name, resolver)
+		}
+	}
+	if result.Recommended == "" {
+		t.Fatal("no resolver recommended")
+	}
+}
+
+func TestBenchmarkResolverCountsFailedAnswers(t *testing.T) {
+	cfg := DNSConfig{Names: []string{"missing.example"}, Queries: 2, Timeout: time.Second}
+	for _, resolver := range stubDNSServer(t) {
+		result := benchmarkResolver(context.Background(), http.DefaultClient, resolver, cfg)
+		if result.Queries != 2 || result.Failures != 2 || result.FailureRate != 100 {
+			t.Errorf("resolver %s measured %+v", resolver.Name, result)
+		}
+	}
+}
+
+func TestDNSConfigRejectsInvalidNames(t *testing.T) {
+	for _, name := range []string{"", ".", "a..b", "-a.example", "a-.example", "a b.example", "a_b.example", strings.Repeat("a", 64) + ".example"} {
+		cfg := DefaultDNSConfig()
+		cfg.Names = []string{name}
+		if err := cfg.validate(); err == nil {
+			t.Errorf("accepted name %q", name)
+		}
+	}
+	cfg := DefaultDNSConfig()
+	cfg.Names = []string{"www.example.com", "example.com.", "xn--bcher-kva.example"}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+}
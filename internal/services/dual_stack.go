@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/measure"
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+// Address families compared in dual-stack mode
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// dualStackPingCount is the number of connect time samples taken over each
+// address family
+const dualStackPingCount = 10
+
+// familyNetwork restricts a network such as "tcp", "udp" or "ip" to family
+func familyNetwork(network string, family string) string {
+	switch family {
+	case FamilyIPv4:
+		return network + "4"
+	case FamilyIPv6:
+		return network + "6"
+	}
+	return network
+}
+
+// performDualStack repeats the latency and throughput phases of plan over
+// IPv4 and then IPv6 and records both on result. A family the server cannot
+// be reached over is reported as unavailable rather than failing the test.
+func (s *SpeedTestService) performDualStack(ctx context.Context, server TestServer, plan testPlan, progress ProgressFunc, result *models.SpeedTestResult) error {
+	progress.emit(ProgressEvent{Type: EventPhase, Phase: PhaseDualStack, Server: &result.Server})
+	result.DualStack = &models.DualStackResult{}
+	result.DualStack.IPv4 = s.measureFamily(ctx, server, plan, FamilyIPv4, progress)
+	if ctx.Err() == nil {
+		result.DualStack.IPv6 = s.measureFamily(ctx, server, plan, FamilyIPv6, progress)
+	}
+	if ctx.Err() != nil {
+		return abortTest(ctx, PhaseDualStack, result)
+	}
+	return nil
+}
+
+// measureFamily measures latency and throughput to the server over one
+// address family. Progress events of its phases carry the family.
+func (s *SpeedTestService) measureFamily(ctx context.Context, server TestServer, plan testPlan, family string, progress ProgressFunc) models.FamilyResult {
+	var result models.FamilyResult
+	info := server.info()
+
+	addr, err := measure.ServerAddress(server.URL)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	ips, err := net.DefaultResolver.LookupIP(ctx, familyNetwork("ip", family), host)
+	if err != nil || len(ips) == 0 {
+		result.Error = fmt.Sprintf("test server has no %s address", family)
+		if err != nil {
+			result.Error += ": " + err.Error()
+		}
+		return result
+	}
+	result.Address = ips[0].String()
+
+	client, err := newProtocolClient(plan.Protocol, family, server)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer client.close()
+
+	familyProgress := ProgressFunc(func(event ProgressEvent) {
+		event.Family = family
+		progress.emit(event)
+	})
+	prober := s.serverProber(server, client, plan, familyProgress)
+	pinger := serverPinger(dualStackPingCount)
+	pinger.Dialer = familyDialer{dialer: &net.Dialer{Timeout: serverProbeTimeout}, family: family}
+	prober.Pinger = pinger
+
+	// The connect times double as the reachability check of the family
+	latency, err := prober.Latency(ctx)
+	if err != nil {
+		result.Error = fmt.Sprintf("%s: %v", family, err)
+		return result
+	}
+	result.Available = true
+	if plan.runs(PhaseLatency) {
+		result.Ping, result.Jitter, result.PingMedian = latency.Mean, latency.Jitter, latency.Median
+	}
+
+	fail := func(phase string, err error) {
+		if result.Error == "" {
+			result.Error = fmt.Sprintf("%s phase failed: %v", phase, err)
+		}
+	}
+	if plan.runs(PhaseDownload) && ctx.Err() == nil {
+		familyProgress.emit(ProgressEvent{Type: EventPhase, Phase: PhaseDownload, Server: &info})
+		download, err := prober.Download(ctx)
+		if err != nil {
+			fail(PhaseDownload, err)
+		}
+		result.DownloadSpeed = download.Mbps
+	}
+	if plan.runs(PhaseUpload) && ctx.Err() == nil {
+		familyProgress.emit(ProgressEvent{Type: EventPhase, Phase: PhaseUpload, Server: &info})
+		upload, err := prober.Upload(ctx)
+		if err != nil {
+			fail(PhaseUpload, err)
+		}
+		result.UploadSpeed = upload.Mbps
+	}
+	return result
+}
+
+// familyDialer dials every connection over one address family
+type familyDialer struct {
+	dialer *net.Dialer
+	family string
+}
+
+func (d familyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.dialer.DialContext(ctx, familyNetwork(network, d.family), addr)
+}
+
+// familyQUICDialer dials the QUIC connections of an HTTP/3 client over one
+// address family. Each connection gets its own UDP socket, and close closes
+// them all.
+type familyQUICDialer struct {
+	family string
+
+	mu    sync.Mutex
+	conns []net.PacketConn
+}
+
+func (d *familyQUICDialer) dial(ctx context.Context, addr string, tlsConfig *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, familyNetwork("ip", d.family), host)
+	if err != nil {
+		return nil, err
+	}
+	network := familyNetwork("udp", d.family)
+	udpAddr, err := net.ResolveUDPAddr(network, net.JoinHostPort(ips[0].String(), port))
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.conns = append(d.conns, conn)
+	d.mu.Unlock()
+	return quic.DialEarly(ctx, conn, udpAddr, tlsConfig, cfg)
+}
+
+func (d *familyQUICDialer) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, conn := range d.conns {
+		conn.Close()
+	}
+	d.conns = nil
+}
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+// dualStackServer is a test server listening on IPv4 and IPv6 loopback that
+// records the address family of every request
+type dualStackServer struct {
+	port string
+
+	mu       sync.Mutex
+	families map[string]int
+}
+
+// newDualStackServer starts a dual-stack download and upload server, or
+// skips the test where the host has no IPv6 loopback
+func newDualStackServer(t *testing.T) *dualStackServer {
+	t.Helper()
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	} else {
+		l.Close()
+	}
+	listener, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Skipf("no dual-stack socket: %v", err)
+	}
+
+	d := &dualStackServer{families: map[string]int{}}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.record(r.RemoteAddr)
+		switch r.URL.Path {
+		case "/__down":
+			n, _ := strconv.Atoi(r.URL.Query().Get("bytes"))
+			w.Write(make([]byte, n))
+		case "/__up":
+			io.Copy(io.Discard, r.Body)
+		}
+	}))
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	_, d.port, _ = net.SplitHostPort(listener.Addr().String())
+	return d
+}
+
+func (d *dualStackServer) record(remoteAddr string) {
+	host, _, _ := net.SplitHostPort(remoteAddr)
+	family := FamilyIPv6
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		family = FamilyIPv4
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.families[family]++
+}
+
+// requests returns the number of requests received over each family
+func (d *dualStackServer) requests() map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return map[string]int{FamilyIPv4: d.families[FamilyIPv4], FamilyIPv6: d.families[FamilyIPv6]}
+}
+
+// server returns the test server as reached through host
+func (d *dualStackServer) server(host string) TestServer {
+	return TestServer{ID: "dual", Name: "Dual", URL: "http://" + net.JoinHostPort(host, d.port)}
+}
+
+// newDualStackPlan returns a short plan of all dual-stack phases
+func newDualStackPlan(t *testing.T, service *SpeedTestService) testPlan {
+	t.Helper()
+	if err := service.SetThroughputConfig(testThroughputConfig); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := service.resolveOptions(TestOptions{
+		Phases:               []string{PhaseLatency, PhaseDownload, PhaseUpload},
+		DownloadStreams:      2,
+		UploadStreams:        2,
+		DownloadRequestBytes: 1 << 20,
+		UploadRequestBytes:   1 << 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+func TestFamilyDialerKeepsFamily(t *testing.T) {
+	d := newDualStackServer(t)
+	for _, tc := range []struct {
+		family string
+		host   string
+		ok     bool
+	}{
+		{FamilyIPv4, "127.0.0.1", true},
+		{FamilyIPv4, "::1", false},
+		{FamilyIPv6, "::1", true},
+		{FamilyIPv6, "127.0.0.1", false},
+	} {
+		dialer := familyDialer{dialer: &net.Dialer{}, family: tc.family}
+		conn, err := dialer.DialContext(context.Background(), "tcp", net.JoinHostPort(tc.host, d.port))
+		if (err == nil) != tc.ok {
+			t.Errorf("%s dialer reaching %s: %v", tc.family, tc.host, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestMeasureFamily(t *testing.T) {
+	service := NewSpeedTestService(&memoryResults{}, nil, NewInMemoryTestServerRegistry())
+	plan := newDualStackPlan(t, service)
+
+	for _, tc := range []struct {
+		family string
+		host   string
+	}{
+		{FamilyIPv4, "127.0.0.1"},
+		{FamilyIPv6, "::1"},
+	} {
+		d := newDualStackServer(t)
+		var events []ProgressEvent
+		result := service.measureFamily(context.Background(), d.server(tc.host), plan, tc.family, func(event ProgressEvent) {
+			events = append(events, event)
+		})
+		if !result.Available || result.Error != "" || result.Address != tc.host {
+			t.Fatalf("%s: measured %+v", tc.family, result)
+		}
+		if result.Ping <= 0 || result.DownloadSpeed <= 0 || result.UploadSpeed <= 0 {
+			t.Errorf("%s: measured %+v", tc.family, result)
+		}
+		// Every request of the family went over it
+		for family, n := range d.requests() {
+			if (n > 0) != (family == tc.family) {
+				t.Errorf("%s: %d requests over %s", tc.family, n, family)
+			}
+		}
+		for _, event := range events {
+			if event.Family != tc.family {
+				t.Errorf("%s: event %+v carries another family", tc.family, event)
+			}
+		}
+	}
+}
+
+func TestDualStackWithOneFamilyUnreachable(t *testing.T) {
+	d := newDualStackServer(t)
+	service := NewSpeedTestService(&memoryResults{}, nil, NewInMemoryTestServerRegistry())
+	plan := newDualStackPlan(t, service)
+
+	// An address literal can only be reached over its own family
+	for _, tc := range []struct {
+		host        string
+		unreachable string
+	}{
+		{"127.0.0.1", FamilyIPv6},
+		{"::1", FamilyIPv4},
+	} {
+		server := d.server(tc.host)
+		result := &models.SpeedTestResult{Server: server.info()}
+		if err := service.performDualStack(context.Background(), server, plan, nil, result); err != nil {
+			t.Fatal(err)
+		}
+		families := map[string]models.FamilyResult{FamilyIPv4: result.DualStack.IPv4, FamilyIPv6: result.DualStack.IPv6}
+		for family, got := range families {
+			if family == tc.unreachable {
+				if got.Available || got.DownloadSpeed != 0 || !strings.Contains(got.Error, fmt.Sprintf("no %s address", family)) {
+					t.Errorf("%s over %s: %+v", tc.host, family, got)
+				}
+			} else if !got.Available || got.DownloadSpeed <= 0 {
+				t.Errorf("%s over %s: %+v", tc.host, family, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/netem"
+)
+
+// NoLinkProfile selects an unshaped link for one request even when a
+// default link profile is set
+const NoLinkProfile = "none"
+
+const (
+	// linkPathIdleTimeout is how long the emulated link of a test is kept
+	// after its last request. Requests within it share the link, like the
+	// parallel streams of one test.
+	linkPathIdleTimeout = time.Minute
+
+	// maxLinkPathsPerClient caps the emulated links of one client address.
+	// Test IDs are chosen by the client, so without it every new one would
+	// hold another link until it idles out.
+	maxLinkPathsPerClient = 8
+)
+
+var (
+	// ErrLinkProfileNotFound is returned when a link profile name is not
+	// registered
+	ErrLinkProfileNotFound = errors.New("link profile not found")
+
+	// ErrLinkProfileInUse is returned when removing the default link profile
+	ErrLinkProfileInUse = errors.New("the default link profile cannot be removed")
+)
+
+// LinkProfile is a named set of link conditions the backend's own
+// measurement endpoints can emulate, so clients can be tried against slow
+// or unreliable lines without one
+type LinkProfile struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// DownMbps and UpMbps cap the throughput of each direction. Zero leaves
+	// a direction uncapped.
+	DownMbps float64 `json:"down_mbps,omitempty"`
+	UpMbps   float64 `json:"up_mbps,omitempty"`
+	// DelayMs is the round-trip delay added to every exchange
+	DelayMs int `json:"delay_ms,omitempty"`
+	// JitterMs is the largest random deviation of each one-way delay
+	JitterMs int `json:"jitter_ms,omitempty"`
+	// StallsPerMinute is the mean number of random stalls per minute of
+	// transfer, each holding the transfer for StallMs. Only capped
+	// directions stall.
+	StallsPerMinute float64 `json:"stalls_per_minute,omitempty"`
+	StallMs         int     `json:"stall_ms,omitempty"`
+}
+
+// DefaultLinkProfiles returns the built-in link profiles
+func DefaultLinkProfiles() []LinkProfile {
+	return []LinkProfile{
+		{Name: "slow-dsl", Description: "Long ADSL line far from the exchange",
+			DownMbps: 2, UpMbps: 0.5, DelayMs: 60, JitterMs: 10},
+		{Name: "dsl", Description: "Typical ADSL2+ line",
+			DownMbps: 16, UpMbps: 1, DelayMs: 30, JitterMs: 5},
+		{Name: "cable", Description: "DOCSIS cable connection",
+			DownMbps: 100, UpMbps: 10, DelayMs: 15, JitterMs: 3},
+		{Name: "4g", Description: "4G mobile connection with good coverage",
+			DownMbps: 30, UpMbps: 10, DelayMs: 50, JitterMs: 15},
+		{Name: "congested-4g", Description: "Crowded 4G cell with frequent stalls",
+			DownMbps: 3, UpMbps: 1, DelayMs: 150, JitterMs: 80, StallsPerMinute: 12, StallMs: 800},
+		{Name: "satellite", Description: "Geostationary satellite link",
+			DownMbps: 25, UpMbps: 3, DelayMs: 600, JitterMs: 30},
+	}
+}
+
+// validate checks that the profile describes a usable link
+func (p LinkProfile) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("link profile name is required")
+	}
+	if p.Name == NoLinkProfile {
+		return fmt.Errorf("link profile name %q is reserved", NoLinkProfile)
+	}
+	if p.DownMbps < 0 || p.UpMbps < 0 || p.DelayMs < 0 || p.JitterMs < 0 || p.StallsPerMinute < 0 || p.StallMs < 0 {
+		return fmt.Errorf("link profile values must not be negative")
+	}
+	return nil
+}
+
+// emulation returns the link the profile describes
+func (p LinkProfile) emulation() netem.Profile {
+	link := func(mbps float64) netem.Link {
+		return netem.Link{
+			Rate:      int64(mbps * 1000000),
+			Delay:     time.Duration(p.DelayMs) * time.Millisecond / 2,
+			Jitter:    time.Duration(p.JitterMs) * time.Millisecond,
+			Stalls:    p.StallsPerMinute / 60,
+			StallTime: time.Duration(p.StallMs) * time.Millisecond,
+		}
+	}
+	return netem.Profile{Down: link(p.DownMbps), Up: link(p.UpMbps)}
+}
+
+// linkPathKey identifies the emulated link of one test of a client under
+// one profile
+type linkPathKey struct {
+	profile string
+	client  string
+	testID  string
+}
+
+// linkPath is an emulated link and when a request last used it
+type linkPath struct {
+	path     *netem.Path
+	lastUsed time.Time
+}
+
+// LinkEmulator holds the link profiles and the emulated links of the
+// clients using them. A request selects a profile by name; without one the
+// default profile, if set, applies. If the emulator has a path, every
+// change to the profiles or the default is written back to a JSON file so
+// it survives restarts.
+type LinkEmulator struct {
+	mu             sync.Mutex
+	path           string
+	profiles       map[string]LinkProfile
+	defaultProfile string
+	paths          map[linkPathKey]*linkPath
+	// clients lists the links of each client address, oldest first
+	clients map[string][]linkPathKey
+	// pruning drops idle links while there are any
+	pruning *time.Timer
+}
+
+// linkProfileFile is the JSON file the link profiles are kept in
+type linkProfileFile struct {
+	Default  string        `json:"default,omitempty"`
+	Profiles []LinkProfile `json:"profiles"`
+}
+
+// NewLinkEmulator creates a link emulator with the given profiles and no
+// default profile
+func NewLinkEmulator(profiles []LinkProfile) *LinkEmulator {
+	e := &LinkEmulator{
+		profiles: make(map[string]LinkProfile),
+		paths:    make(map[linkPathKey]*linkPath),
+		clients:  make(map[string][]linkPathKey),
+	}
+	for _, profile := range profiles {
+		e.profiles[profile.Name] = profile
+	}
+	return e
+}
+
+// LoadProfiles keeps the link profiles and the default profile in the JSON
+// file at path. If the file does not exist it is created with the current
+// profiles.
+func (e *LinkEmulator) LoadProfiles(path string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		var file linkProfileFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			return fmt.Errorf("failed to parse link profile file %s: %w", path, err)
+		}
+		profiles := make(map[string]LinkProfile, len(file.Profiles))
+		for _, profile := range file.Profiles {
+			if err := profile.validate(); err != nil {
+				return fmt.Errorf("link profile file %s: %w", path, err)
+			}
+			profiles[profile.Name] = profile
+		}
+		if _, ok := profiles[file.Default]; file.Default != "" && !ok {
+			return fmt.Errorf("link profile file %s: %w: %s", path, ErrLinkProfileNotFound, file.Default)
+		}
+		e.path, e.profiles, e.defaultProfile = path, profiles, file.Default
+		clear(e.paths)
+		clear(e.clients)
+	case errors.Is(err, os.ErrNotExist):
+		e.path = path
+		if err := e.write(e.profiles, e.defaultProfile); err != nil {
+			e.path = ""
+			return err
+		}
+	default:
+		return fmt.Errorf("failed to read link profile file %s: %w", path, err)
+	}
+	return nil
+}
+
+// ListProfiles returns every link profile ordered by name
+func (e *LinkEmulator) ListProfiles() []LinkProfile {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return sortedLinkProfiles(e.profiles)
+}
+
+// sortedLinkProfiles returns the profiles ordered by name
+func sortedLinkProfiles(profiles map[string]LinkProfile) []LinkProfile {
+	list := make([]LinkProfile, 0, len(profiles))
+	for _, profile := range profiles {
+		list = append(list, profile)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// SaveProfile adds a link profile or replaces the one with the same name.
+// Clients already on a replaced profile get the new conditions with their
+// next request.
+func (e *LinkEmulator) SaveProfile(profile LinkProfile) error {
+	if err := profile.validate(); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	profiles := maps.Clone(e.profiles)
+	profiles[profile.Name] = profile
+	if err := e.write(profiles, e.defaultProfile); err != nil {
+		return err
+	}
+	e.profiles = profiles
+	e.dropPaths(profile.Name)
+	return nil
+}
+
+// RemoveProfile deletes a link profile. The default profile cannot be
+// removed until another one, or none, is the default.
+func (e *LinkEmulator) RemoveProfile(name string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.profiles[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrLinkProfileNotFound, name)
+	}
+	if name == e.defaultProfile {
+		return ErrLinkProfileInUse
+	}
+	profiles := maps.Clone(e.profiles)
+	delete(profiles, name)
+	if err := e.write(profiles, e.defaultProfile); err != nil {
+		return err
+	}
+	e.profiles = profiles
+	e.dropPaths(name)
+	return nil
+}
+
+// DefaultProfile returns the name of the profile applied to requests that
+// do not select one, or "" if they are not shaped
+func (e *LinkEmulator) DefaultProfile() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.defaultProfile
+}
+
+// SetDefaultProfile sets the profile applied to requests that do not select
+// one. An empty name or NoLinkProfile leaves them unshaped.
+func (e *LinkEmulator) SetDefaultProfile(name string) error {
+	if name == NoLinkProfile {
+		name = ""
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.profiles[name]; name != "" && !ok {
+		return fmt.Errorf("%w: %s", ErrLinkProfileNotFound, name)
+	}
+	if err := e.write(e.profiles, name); err != nil {
+		return err
+	}
+	e.defaultProfile = name
+	return nil
+}
+
+// write saves the profiles and the default profile to the emulator's file,
+// if it has one. The caller holds e.mu.
+func (e *LinkEmulator) write(profiles map[string]LinkProfile, defaultProfile string) error {
+	if e.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(linkProfileFile{Default: defaultProfile, Profiles: sortedLinkProfiles(profiles)}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(e.path, data); err != nil {
+		return fmt.Errorf("failed to save link profiles: %w", err)
+	}
+	return nil
+}
+
+// Path returns the emulated link of one test of client under the profile
+// called name, or under the default profile if name is empty, along with
+// the name of the profile applied. It returns a nil path if no profile
+// applies. Requests with the same test ID, which may be empty, share a link;
+// a client holding too many links loses its oldest.
+func (e *LinkEmulator) Path(name, client, testID string) (*netem.Path, string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if name == "" {
+		name = e.defaultProfile
+	}
+	if name == "" || name == NoLinkProfile {
+		return nil, "", nil
+	}
+	profile, ok := e.profiles[name]
+	if !ok {
+		return nil, "", fmt.Errorf("%w: %s", ErrLinkProfileNotFound, name)
+	}
+
+	key := linkPathKey{profile: name, client: client, testID: testID}
+	path, ok := e.paths[key]
+	if !ok {
+		if keys := e.clients[client]; len(keys) >= maxLinkPathsPerClient {
+			e.removePath(keys[0])
+		}
+		path = &linkPath{path: netem.NewPath(profile.emulation())}
+		e.paths[key] = path
+		e.clients[client] = append(e.clients[client], key)
+		if e.pruning == nil {
+			e.pruning = time.AfterFunc(linkPathIdleTimeout, e.prune)
+		}
+	}
+	path.lastUsed = time.Now()
+	return path.path, name, nil
+}
+
+// prune drops the links that have been idle for linkPathIdleTimeout and
+// runs again later while links are left
+func (e *LinkEmulator) prune() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	for key, path := range e.paths {
+		if now.Sub(path.lastUsed) > linkPathIdleTimeout {
+			e.removePath(key)
+		}
+	}
+	if len(e.paths) > 0 {
+		e.pruning.Reset(linkPathIdleTimeout)
+	} else {
+		e.pruning = nil
+	}
+}
+
+// removePath forgets one link. The caller holds e.mu.
+func (e *LinkEmulator) removePath(key linkPathKey) {
+	delete(e.paths, key)
+	keys := slices.DeleteFunc(e.clients[key.client], func(k linkPathKey) bool { return k == key })
+	if len(keys) == 0 {
+		delete(e.clients, key.client)
+	} else {
+		e.clients[key.client] = keys
+	}
+}
+
+// dropPaths forgets the emulated links of a profile. The caller holds e.mu.
+func (e *LinkEmulator) dropPaths(name string) {
+	for key := range e.paths {
+		if key.profile == name {
+			e.removePath(key)
+		}
+	}
+}
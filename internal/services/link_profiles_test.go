@@ -0,0 +1,189 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLinkEmulatorSelectsProfile(t *testing.T) {
+	e := NewLinkEmulator(DefaultLinkProfiles())
+
+	path, name, err := e.Path("", "10.0.0.1", "")
+	if err != nil || path != nil || name != "" {
+		t.Fatalf("got %v, %q, %v without a default profile; want no path", path, name, err)
+	}
+	if _, _, err := e.Path("dial-up", "10.0.0.1", ""); !errors.Is(err, ErrLinkProfileNotFound) {
+		t.Fatalf("selecting an unknown profile returned %v", err)
+	}
+
+	if err := e.SetDefaultProfile("dsl"); err != nil {
+		t.Fatal(err)
+	}
+	path, name, err = e.Path("", "10.0.0.1", "")
+	if err != nil || path == nil || name != "dsl" {
+		t.Fatalf("got %v, %q, %v; want the default dsl path", path, name, err)
+	}
+	if path, _, _ := e.Path(NoLinkProfile, "10.0.0.1", ""); path != nil {
+		t.Fatal("the none profile returned a path")
+	}
+	if _, name, _ := e.Path("cable", "10.0.0.1", ""); name != "cable" {
+		t.Fatalf("selected %q; want cable over the default", name)
+	}
+}
+
+// TestLinkEmulatorSharesPaths expects the requests of one client to share
+// its link and other clients to get their own
+func TestLinkEmulatorSharesPaths(t *testing.T) {
+	e := NewLinkEmulator(DefaultLinkProfiles())
+
+	first, _, _ := e.Path("dsl", "10.0.0.1", "")
+	again, _, _ := e.Path("dsl", "10.0.0.1", "")
+	other, _, _ := e.Path("dsl", "10.0.0.2", "")
+	if first != again {
+		t.Fatal("requests of one client got different links")
+	}
+	if first == other {
+		t.Fatal("two clients share a link")
+	}
+
+	if err := e.SaveProfile(LinkProfile{Name: "dsl", DownMbps: 8, UpMbps: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if replaced, _, _ := e.Path("dsl", "10.0.0.1", ""); replaced == first {
+		t.Fatal("replacing the profile kept the old link")
+	}
+}
+
+// TestLinkEmulatorLimitsPathsPerClient expects tests behind one address to
+// get links of their own, up to a limit beyond which the oldest is dropped
+func TestLinkEmulatorLimitsPathsPerClient(t *testing.T) {
+	e := NewLinkEmulator(DefaultLinkProfiles())
+
+	first, _, _ := e.Path("dsl", "10.0.0.1", "test-0")
+	if other, _, _ := e.Path("dsl", "10.0.0.1", "test-1"); other == first {
+		t.Fatal("two tests behind one address share a link")
+	}
+	for i := 2; i <= maxLinkPathsPerClient; i++ {
+		e.Path("dsl", "10.0.0.1", fmt.Sprint("test-", i))
+	}
+	e.Path("dsl", "10.0.0.2", "test-0")
+
+	e.mu.Lock()
+	paths, clientPaths := len(e.paths), len(e.clients["10.0.0.1"])
+	e.mu.Unlock()
+	if paths != maxLinkPathsPerClient+1 || clientPaths != maxLinkPathsPerClient {
+		t.Fatalf("holding %d links, %d of one client; want %d and %d", paths, clientPaths, maxLinkPathsPerClient+1, maxLinkPathsPerClient)
+	}
+	if again, _, _ := e.Path("dsl", "10.0.0.1", "test-0"); again == first {
+		t.Fatal("the oldest link of a client over the limit was kept")
+	}
+}
+
+func TestLinkEmulatorPrunesIdlePaths(t *testing.T) {
+	e := NewLinkEmulator(DefaultLinkProfiles())
+	idle, _, _ := e.Path("dsl", "10.0.0.1", "")
+	busy, _, _ := e.Path("dsl", "10.0.0.2", "")
+
+	e.mu.Lock()
+	for key, path := range e.paths {
+		if key.client == "10.0.0.1" {
+			path.lastUsed = path.lastUsed.Add(-2 * linkPathIdleTimeout)
+		}
+	}
+	e.mu.Unlock()
+	e.prune()
+
+	if again, _, _ := e.Path("dsl", "10.0.0.1", ""); again == idle {
+		t.Fatal("an idle link was kept")
+	}
+	if again, _, _ := e.Path("dsl", "10.0.0.2", ""); again != busy {
+		t.Fatal("a link in use was dropped")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pruning == nil {
+		t.Fatal("pruning stopped with links left")
+	}
+}
+
+func TestLinkEmulatorManagesProfiles(t *testing.T) {
+	e := NewLinkEmulator(nil)
+
+	for _, invalid := range []LinkProfile{
+		{},
+		{Name: NoLinkProfile},
+		{Name: "broken", DownMbps: -1},
+	} {
+		if err := e.SaveProfile(invalid); err == nil {
+			t.Errorf("saved invalid profile %+v", invalid)
+		}
+	}
+
+	if err := e.SaveProfile(LinkProfile{Name: "lab", DownMbps: 50, UpMbps: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetDefaultProfile("lab"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RemoveProfile("lab"); !errors.Is(err, ErrLinkProfileInUse) {
+		t.Fatalf("removing the default profile returned %v", err)
+	}
+	if err := e.SetDefaultProfile(NoLinkProfile); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RemoveProfile("lab"); err != nil {
+		t.Fatal(err)
+	}
+	if profiles := e.ListProfiles(); len(profiles) != 0 {
+		t.Fatalf("listed %d profiles after removing the only one", len(profiles))
+	}
+	if err := e.RemoveProfile("lab"); !errors.Is(err, ErrLinkProfileNotFound) {
+		t.Fatalf("removing a missing profile returned %v", err)
+	}
+}
+
+func TestLinkEmulatorPersistsProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "link-profiles.json")
+
+	e := NewLinkEmulator(DefaultLinkProfiles())
+	if err := e.LoadProfiles(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SaveProfile(LinkProfile{Name: "lab", DownMbps: 50, UpMbps: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RemoveProfile("satellite"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetDefaultProfile("lab"); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewLinkEmulator(DefaultLinkProfiles())
+	if err := restarted.LoadProfiles(path); err != nil {
+		t.Fatal(err)
+	}
+	if name := restarted.DefaultProfile(); name != "lab" {
+		t.Fatalf("reloaded default %q; want lab", name)
+	}
+	if _, _, err := restarted.Path("satellite", "10.0.0.1", ""); !errors.Is(err, ErrLinkProfileNotFound) {
+		t.Fatalf("removed profile is back: %v", err)
+	}
+	if len(restarted.ListProfiles()) != len(DefaultLinkProfiles()) {
+		t.Fatalf("reloaded %d profiles", len(restarted.ListProfiles()))
+	}
+
+	// A change that cannot be saved is not applied
+	if err := os.RemoveAll(filepath.Dir(path)); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.SetDefaultProfile(NoLinkProfile); err == nil {
+		t.Fatal("changed the default without saving it")
+	}
+	if name := restarted.DefaultProfile(); name != "lab" {
+		t.Fatalf("default %q after a failed save; want lab", name)
+	}
+}
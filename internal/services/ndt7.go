@@ -0,0 +1,289 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/measure"
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+const (
+	// NDT7Subprotocol is the WebSocket subprotocol required by ndt7
+	NDT7Subprotocol = "net.measurementlab.ndt.v7"
+
+	// NDT7ReadLimit is the largest message an ndt7 client may send
+	NDT7ReadLimit = 1 << 24
+
+	// ndt7TestDuration is how long the server runs a download or upload
+	// test, as the spec sets it
+	ndt7TestDuration = 10 * time.Second
+
+	// ndt7MeasurementInterval is the spacing of server measurement messages
+	ndt7MeasurementInterval = 250 * time.Millisecond
+
+	// ndt7MinMessageSize and ndt7MaxMessageSize bound the binary messages
+	// sent during a download. The size doubles once the bytes sent so far
+	// exceed sixteen times the current size, as the spec recommends.
+	ndt7MinMessageSize = 1 << 13
+	ndt7MaxMessageSize = 1 << 20
+)
+
+// ndt7AppInfo contains the application level measurement
+type ndt7AppInfo struct {
+	ElapsedTime int64 // microseconds since the test started
+	NumBytes    int64
+}
+
+// ndt7ConnectionInfo identifies the connection a test runs on
+type ndt7ConnectionInfo struct {
+	Client string
+	Server string
+	UUID   string
+}
+
+// tcpInfo contains kernel TCP statistics. RTT values are in microseconds.
+type tcpInfo struct {
+	BytesAcked    int64
+	BytesReceived int64
+	BytesSent     int64
+	BytesRetrans  int64
+	MinRTT        int64
+	RTT           int64
+	RTTVar        int64
+	ElapsedTime   int64
+}
+
+// ndt7Measurement is the JSON measurement message defined by the ndt7 spec
+type ndt7Measurement struct {
+	AppInfo        *ndt7AppInfo        `json:",omitempty"`
+	ConnectionInfo *ndt7ConnectionInfo `json:",omitempty"`
+	Origin         string              `json:",omitempty"`
+	Test           string              `json:",omitempty"`
+	TCPInfo        *tcpInfo            `json:",omitempty"`
+}
+
+// ndt7Session holds the state of one ndt7 download or upload test
+type ndt7Session struct {
+	conn     *websocket.Conn
+	cfg      ThroughputConfig
+	test     string
+	duration time.Duration
+	uuid     string
+	start    time.Time
+	received *measure.Meter
+	sampler  *measure.IntervalSampler
+	lastInfo *tcpInfo
+}
+
+// RunNDT7Download runs an ndt7 download test over conn and saves the result
+func (s *SpeedTestService) RunNDT7Download(ctx context.Context, conn *websocket.Conn, userID string, ipInfo map[string]string) (*models.SpeedTestResult, error) {
+	return s.runNDT7(ctx, conn, PhaseDownload, userID, ipInfo)
+}
+
+// RunNDT7Upload runs an ndt7 upload test over conn and saves the result
+func (s *SpeedTestService) RunNDT7Upload(ctx context.Context, conn *websocket.Conn, userID string, ipInfo map[string]string) (*models.SpeedTestResult, error) {
+	return s.runNDT7(ctx, conn, PhaseUpload, userID, ipInfo)
+}
+
+// runNDT7 runs one ndt7 test and stores it like a native test, with only the
+// measured direction filled in
+func (s *SpeedTestService) runNDT7(ctx context.Context, conn *websocket.Conn, test string, userID string, ipInfo map[string]string) (*models.SpeedTestResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	session := &ndt7Session{
+		conn:     conn,
+		cfg:      s.throughput,
+		test:     test,
+		duration: s.ndt7Duration,
+		uuid:     newNDT7UUID(),
+		start:    time.Now(),
+		received: &measure.Meter{},
+	}
+	session.sampler = measure.NewIntervalSampler(session.start, ndt7MeasurementInterval)
+
+	// A failed read means the client closed the connection
+	go func() {
+		session.readLoop()
+		cancel()
+	}()
+
+	var speed float64
+	var err error
+	if test == PhaseDownload {
+		speed, err = session.download(ctx)
+	} else {
+		speed, err = session.upload(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ndt7 %s failed: %w", test, err)
+	}
+
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+
+	result := &models.SpeedTestResult{
+		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+		UserID:    userID,
+		ISP:       ipInfo["isp"],
+		IPAddress: ipInfo["ip"],
+		Country:   ipInfo["country"],
+		Region:    ipInfo["region"],
+		Server:    selfServer,
+		TestType:  models.TestTypeNDT7Download,
+		CreatedAt: time.Now(),
+	}
+	// Only the tested direction is measured
+	notMeasured := unavailable(MethodNDT7, selfServer.ID, fmt.Errorf("not measured by an ndt7 %s test", test))
+	result.Provenance = &models.ResultProvenance{
+		Latency:  unavailable(MethodKernelTCPInfo, selfServer.ID, fmt.Errorf("kernel TCP statistics are not available")),
+		Download: notMeasured,
+		Upload:   notMeasured,
+	}
+	if test == PhaseDownload {
+		result.DownloadSpeed = speed
+		result.Provenance.Download = measured(models.SourcePrimary, MethodNDT7, selfServer.ID)
+	} else {
+		result.UploadSpeed = speed
+		result.TestType = models.TestTypeNDT7Upload
+		result.Provenance.Upload = measured(models.SourcePrimary, MethodNDT7, selfServer.ID)
+	}
+	if session.lastInfo != nil {
+		result.Provenance.Latency = measured(models.SourcePrimary, MethodKernelTCPInfo, selfServer.ID)
+		// The ping is the kernel's minimum RTT, as ndt7 clients report it.
+		// Its smoothed RTT samples are taken under load and would not match
+		// it, so jitter and the percentiles are left unset.
+		result.Ping = float64(session.lastInfo.MinRTT) / 1000
+		result.PingMin = result.Ping
+	}
+
+	// Save the result to the database
+	if err := s.speedTestRepo.SaveResult(ctx, result); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// readLoop counts binary bytes sent by the client and discards its
+// measurement messages until the connection fails
+func (n *ndt7Session) readLoop() {
+	for {
+		messageType, r, err := n.conn.NextReader()
+		if err != nil {
+			return
+		}
+		// Binary messages are counted as they arrive, the rest discarded
+		var w io.Writer = io.Discard
+		if messageType == websocket.BinaryMessage {
+			w = n.received
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			return
+		}
+	}
+}
+
+// download sends binary messages of growing size for the test duration
+func (n *ndt7Session) download(ctx context.Context) (float64, error) {
+	payload := make([]byte, ndt7MaxMessageSize)
+	rand.Read(payload)
+
+	deadline := n.start.Add(n.duration)
+	size := ndt7MinMessageSize
+	var sent int64
+
+	for time.Now().Before(deadline) {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+
+		n.conn.SetWriteDeadline(deadline.Add(browserWriteSlack))
+		if err := n.conn.WriteMessage(websocket.BinaryMessage, payload[:size]); err != nil {
+			return 0, err
+		}
+		sent += int64(size)
+		if size < ndt7MaxMessageSize && int64(size) <= sent/16 {
+			size *= 2
+		}
+
+		if err := n.maybeSendMeasurement(time.Now(), sent); err != nil {
+			return 0, err
+		}
+	}
+
+	return n.speed(sent)
+}
+
+// upload receives binary messages for the test duration
+func (n *ndt7Session) upload(ctx context.Context) (float64, error) {
+	ticker := time.NewTicker(ndt7MeasurementInterval)
+	defer ticker.Stop()
+	timeout := time.NewTimer(n.duration)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-timeout.C:
+			return n.speed(n.received.Total())
+		case now := <-ticker.C:
+			if err := n.maybeSendMeasurement(now, n.received.Total()); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// maybeSendMeasurement sends a measurement message once per interval
+func (n *ndt7Session) maybeSendMeasurement(now time.Time, numBytes int64) error {
+	if _, ok := n.sampler.Observe(now, numBytes); !ok {
+		return nil
+	}
+
+	elapsed := now.Sub(n.start).Microseconds()
+	msg := ndt7Measurement{
+		AppInfo: &ndt7AppInfo{ElapsedTime: elapsed, NumBytes: numBytes},
+		Origin:  "server",
+		Test:    n.test,
+	}
+
+	// Connection info is only sent with the first measurement
+	if len(n.sampler.Samples) == 1 {
+		msg.ConnectionInfo = &ndt7ConnectionInfo{
+			Client: n.conn.RemoteAddr().String(),
+			Server: n.conn.LocalAddr().String(),
+			UUID:   n.uuid,
+		}
+	}
+
+	if info, err := readTCPInfo(n.conn.UnderlyingConn()); err == nil {
+		info.ElapsedTime = elapsed
+		msg.TCPInfo = info
+		n.lastInfo = info
+	}
+
+	n.conn.SetWriteDeadline(now.Add(browserWriteSlack))
+	return n.conn.WriteJSON(msg)
+}
+
+// speed returns the steady-state speed of the test
+func (n *ndt7Session) speed(numBytes int64) (float64, error) {
+	if numBytes == 0 {
+		return 0, fmt.Errorf("no data transferred")
+	}
+	return measure.SteadyStateSpeed(n.sampler.Samples, n.cfg.WarmUp, n.cfg.TrimFraction), nil
+}
+
+// newNDT7UUID returns a random identifier for an ndt7 connection
+func newNDT7UUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,145 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+// newNDT7Service returns a service whose ndt7 tests are short and whose
+// results are kept in repo
+func newNDT7Service(repo *memoryResults) *SpeedTestService {
+	service := NewSpeedTestService(repo, nil, NewInMemoryTestServerRegistry())
+	service.SetThroughputConfig(testThroughputConfig)
+	service.ndt7Duration = 600 * time.Millisecond
+	return service
+}
+
+// dialNDT7 connects to an ndt7 test server as an ndt7 client does
+func dialNDT7(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: []string{NDT7Subprotocol}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// checkNDT7Latency checks that the ping of an ndt7 result is the minimum
+// RTT of the last server measurement, and that no statistic of the RTTs
+// under load is mixed in
+func checkNDT7Latency(t *testing.T, result *models.SpeedTestResult, last ndt7Measurement) {
+	t.Helper()
+	if last.TCPInfo == nil {
+		if result.Ping != 0 || result.Provenance.Latency.Source != models.SourceUnavailable {
+			t.Errorf("reported ping %v without kernel TCP statistics", result.Ping)
+		}
+		return
+	}
+	if result.Ping != float64(last.TCPInfo.MinRTT)/1000 || result.PingMin != result.Ping {
+		t.Errorf("ping %v, minimum %v; want the minimum RTT %vus", result.Ping, result.PingMin, last.TCPInfo.MinRTT)
+	}
+	if result.Jitter != 0 || result.PingMedian != 0 {
+		t.Errorf("jitter %v and median %v come from other RTT samples than the ping", result.Jitter, result.PingMedian)
+	}
+}
+
+func TestNDT7Download(t *testing.T) {
+	repo := &memoryResults{}
+	service := newNDT7Service(repo)
+	url, results := serveWebSocket(t, []string{NDT7Subprotocol}, func(ctx context.Context, conn *websocket.Conn) (*models.SpeedTestResult, error) {
+		return service.RunNDT7Download(ctx, conn, "user", map[string]string{})
+	})
+	conn := dialNDT7(t, url)
+
+	var received int64
+	var first, last ndt7Measurement
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if messageType == websocket.BinaryMessage {
+			received += int64(len(data))
+			continue
+		}
+		var m ndt7Measurement
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatal(err)
+		}
+		if first.AppInfo == nil {
+			first = m
+		}
+		last = m
+	}
+
+	result := <-results
+	if result == nil || result.DownloadSpeed <= 0 || result.UploadSpeed != 0 || result.TestType != models.TestTypeNDT7Download {
+		t.Fatalf("measured %+v", result)
+	}
+	if first.ConnectionInfo == nil || first.ConnectionInfo.UUID == "" || last.Origin != "server" || last.Test != PhaseDownload {
+		t.Errorf("measurements from %+v to %+v", first, last)
+	}
+	if last.AppInfo.NumBytes == 0 || last.AppInfo.NumBytes > received {
+		t.Errorf("server counted %d bytes; the client received %d", last.AppInfo.NumBytes, received)
+	}
+	if result.Provenance.Download.Method != MethodNDT7 || result.Provenance.Upload.Source != models.SourceUnavailable {
+		t.Errorf("provenance %+v", result.Provenance)
+	}
+	checkNDT7Latency(t, result, last)
+	if len(repo.results) != 1 {
+		t.Error("the result was not saved")
+	}
+}
+
+func TestNDT7Upload(t *testing.T) {
+	service := newNDT7Service(&memoryResults{})
+	url, results := serveWebSocket(t, []string{NDT7Subprotocol}, func(ctx context.Context, conn *websocket.Conn) (*models.SpeedTestResult, error) {
+		return service.RunNDT7Upload(ctx, conn, "user", map[string]string{})
+	})
+	conn := dialNDT7(t, url)
+
+	// Upload until the server closes the connection, reading its
+	// measurements alongside
+	var sent atomic.Int64
+	uploadDone := make(chan struct{})
+	go func() {
+		defer close(uploadDone)
+		message := make([]byte, ndt7MinMessageSize)
+		for conn.WriteMessage(websocket.BinaryMessage, message) == nil {
+			sent.Add(int64(len(message)))
+		}
+	}()
+	var last ndt7Measurement
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if err := json.Unmarshal(data, &last); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+	<-uploadDone
+
+	result := <-results
+	if result == nil || result.UploadSpeed <= 0 || result.DownloadSpeed != 0 || result.TestType != models.TestTypeNDT7Upload {
+		t.Fatalf("measured %+v", result)
+	}
+	if last.Test != PhaseUpload || last.AppInfo == nil || last.AppInfo.NumBytes == 0 || last.AppInfo.NumBytes > sent.Load() {
+		t.Errorf("server measured %+v; the client sent %d bytes", last.AppInfo, sent.Load())
+	}
+	if result.Provenance.Upload.Method != MethodNDT7 || result.Provenance.Download.Source != models.SourceUnavailable {
+		t.Errorf("provenance %+v", result.Provenance)
+	}
+	checkNDT7Latency(t, result, last)
+}
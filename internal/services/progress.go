@@ -0,0 +1,41 @@
+package services
+
+import "github.com/cetinibs/online-speed-test-backend-root/internal/models"
+
+// Types of progress events emitted while a speed test runs
+const (
+	// EventPhase is emitted when a measurement phase starts
+	EventPhase = "phase"
+	// EventLatency carries the idle ping and jitter once they are measured
+	EventLatency = "latency"
+	// EventSample carries one throughput sample of the running phase
+	EventSample = "sample"
+	// EventResult carries the final, saved result
+	EventResult = "result"
+)
+
+// ProgressEvent describes the progress of a running speed test
+type ProgressEvent struct {
+	Type  string `json:"type"`
+	Phase string `json:"phase,omitempty"`
+	// Family is set on the events of the per address family phases of a
+	// dual-stack test
+	Family    string                  `json:"family,omitempty"`
+	ElapsedMs float64                 `json:"elapsed_ms,omitempty"`
+	Mbps      float64                 `json:"mbps,omitempty"`
+	Ping      float64                 `json:"ping,omitempty"`
+	Jitter    float64                 `json:"jitter,omitempty"`
+	Server    *models.TestServerInfo  `json:"server,omitempty"`
+	Result    *models.SpeedTestResult `json:"result,omitempty"`
+}
+
+// ProgressFunc receives progress events. It is called synchronously from the
+// goroutine running the test, so it must not block for long.
+type ProgressFunc func(event ProgressEvent)
+
+// emit sends an event to progress if it is set
+func (p ProgressFunc) emit(event ProgressEvent) {
+	if p != nil {
+		p(event)
+	}
+}
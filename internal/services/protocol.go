@@ -0,0 +1,122 @@
+package services
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// protocolRank orders the protocols so a server that speaks a protocol is
+// assumed to speak the older ones too
+var protocolRank = map[string]int{
+	ProtocolHTTP1: 1,
+	ProtocolHTTP2: 2,
+	ProtocolHTTP3: 3,
+}
+
+// speaks reports whether the server can be tested with protocol. An empty
+// protocol negotiates whatever the server offers, so every server speaks it.
+func (t TestServer) speaks(protocol string) bool {
+	if protocol == "" {
+		return true
+	}
+	highest := t.Capabilities.Protocol
+	if highest == "" {
+		highest = ProtocolHTTP1
+	}
+	if protocol == ProtocolHTTP3 {
+		// QUIC always runs TLS, so HTTP/3 needs an https URL
+		if u, err := url.Parse(t.URL); err != nil || u.Scheme != "https" {
+			return false
+		}
+	}
+	return protocolRank[protocol] <= protocolRank[highest]
+}
+
+// transportBufferSize is the read and write buffer of each connection. The
+// 4KB default costs a system call per 4KB at multi-gigabit speeds.
+const transportBufferSize = 256 << 10
+
+// sharedClient sends the requests of the alternative measurements and the
+// DoH lookups, so their connections are reused across tests. Throughput
+// phases get a client of their own so concurrent tests never share a
+// connection.
+var sharedClient = &http.Client{Transport: newTunedTransport(), Timeout: 15 * time.Second}
+
+// newTunedTransport returns a transport for measurements. It uses large
+// buffers, keeps one idle connection per stream so HTTP/1.1 streams reuse
+// their connections between requests, and never asks for compressed
+// responses, which would inflate the measured speed.
+func newTunedTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ReadBufferSize = transportBufferSize
+	transport.WriteBufferSize = transportBufferSize
+	transport.MaxIdleConnsPerHost = maxStreams
+	transport.DisableCompression = true
+	return transport
+}
+
+// protocolClient is the transport shared by every stream of a test. It is
+// pinned to one protocol.
+//
+// With HTTP/1.1 each stream opens its own connection. With HTTP/2 and HTTP/3
+// the streams are multiplexed over a single connection.
+type protocolClient struct {
+	transport http.RoundTripper
+	close     func()
+}
+
+// newProtocolClient returns a client for the server that speaks protocol. An
+// empty protocol uses HTTP/2 when the server offers it over TLS and HTTP/1.1
+// otherwise, like the default client. A non-empty family restricts every
+// connection to IPv4 or IPv6.
+func newProtocolClient(protocol string, family string, server TestServer) (*protocolClient, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: server.InsecureSkipVerify}
+
+	if protocol == ProtocolHTTP3 {
+		if !server.speaks(ProtocolHTTP3) {
+			return nil, fmt.Errorf("HTTP/3 requires an https test server URL")
+		}
+		transport := &http3.Transport{TLSClientConfig: tlsConfig}
+		dialer := &familyQUICDialer{family: family}
+		if family != "" {
+			transport.Dial = dialer.dial
+		}
+		return &protocolClient{
+			transport: transport,
+			close: func() {
+				transport.Close()
+				dialer.close()
+			},
+		}, nil
+	}
+
+	transport := newTunedTransport()
+	transport.TLSClientConfig = tlsConfig
+	if family != "" {
+		dialer := familyDialer{dialer: &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}, family: family}
+		transport.DialContext = dialer.DialContext
+	}
+	switch protocol {
+	case ProtocolHTTP1:
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP1(true)
+	case ProtocolHTTP2:
+		// Plain http:// URLs use HTTP/2 with prior knowledge (h2c)
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	case "":
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", protocol)
+	}
+	return &protocolClient{
+		transport: transport,
+		close:     transport.CloseIdleConnections,
+	}, nil
+}
@@ -0,0 +1,60 @@
+package services
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/measure"
+)
+
+// benchmarkRequestBytes is the body size of each benchmarked request
+const benchmarkRequestBytes = 8 << 20
+
+// benchmarkUpload posts b.N bodies from body to a discarding server
+func benchmarkUpload(b *testing.B, client func() *http.Client, body func() io.Reader) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer server.Close()
+
+	b.SetBytes(benchmarkRequestBytes)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, err := http.NewRequest("POST", server.URL, body())
+		if err != nil {
+			b.Fatal(err)
+		}
+		req.ContentLength = benchmarkRequestBytes
+		resp, err := client().Do(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// BenchmarkUploadFreshClient sends uploads the old way: a new client and
+// transport and a freshly generated body for every request
+func BenchmarkUploadFreshClient(b *testing.B) {
+	benchmarkUpload(b, func() *http.Client {
+		return &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+	}, func() io.Reader {
+		source := rand.New(rand.NewSource(time.Now().UnixNano()))
+		return io.LimitReader(source, benchmarkRequestBytes)
+	})
+}
+
+func BenchmarkUploadTunedClient(b *testing.B) {
+	client := &http.Client{Transport: newTunedTransport()}
+	// Generate the shared payload before the timer starts
+	measure.NewPayloadReader(0)
+	benchmarkUpload(b, func() *http.Client { return client }, func() io.Reader {
+		return measure.NewPayloadReader(benchmarkRequestBytes)
+	})
+}
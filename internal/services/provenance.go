@@ -0,0 +1,67 @@
+package services
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+// Methods used to measure a value, recorded in its provenance
+const (
+	MethodTCPConnect    = "tcp_connect"
+	MethodHTTPHead      = "http_head"
+	MethodHTTPDownload  = "http_download"
+	MethodHTTPUpload    = "http_upload"
+	MethodSmallFiles    = "http_small_files"
+	MethodEchoUpload    = "http_echo_upload"
+	MethodUDPEcho       = "udp_echo"
+	MethodWebSocket     = "websocket"
+	MethodWebSocketPing = "websocket_ping"
+	MethodNDT7          = "ndt7"
+	MethodKernelTCPInfo = "tcp_info"
+	MethodDNSQuery      = "dns_query"
+)
+
+// measurement is one way of measuring a value of type T
+type measurement[T any] struct {
+	method  string
+	server  string
+	measure func(ctx context.Context) (T, error)
+}
+
+// measureWithFallback runs the primary measurement and, if it fails, the
+// alternative one. In strict mode a failed primary measurement fails the
+// phase instead. If both fail the zero value is returned with an unavailable
+// provenance; no value is ever made up. Once ctx is done the alternative is
+// not tried.
+func measureWithFallback[T any](ctx context.Context, strict bool, primary, alternative measurement[T]) (T, models.Provenance, error) {
+	value, err := primary.measure(ctx)
+	if err == nil {
+		return value, measured(models.SourcePrimary, primary.method, primary.server), nil
+	}
+	if strict || ctx.Err() != nil {
+		var zero T
+		return zero, unavailable(primary.method, primary.server, err), err
+	}
+
+	value, altErr := alternative.measure(ctx)
+	if altErr == nil {
+		provenance := measured(models.SourceAlternative, alternative.method, alternative.server)
+		provenance.Error = err.Error()
+		return value, provenance, nil
+	}
+
+	var zero T
+	return zero, unavailable(primary.method, primary.server, fmt.Errorf("%v; alternative %s: %v", err, alternative.method, altErr)), nil
+}
+
+// measured returns the provenance of a successfully measured value
+func measured(source, method, server string) models.Provenance {
+	return models.Provenance{Source: source, Method: method, Server: server}
+}
+
+// unavailable returns the provenance of a value that could not be measured
+func unavailable(method, server string, err error) models.Provenance {
+	return models.Provenance{Source: models.SourceUnavailable, Method: method, Server: server, Error: err.Error()}
+}
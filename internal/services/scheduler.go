@@ -0,0 +1,592 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	mathrand "math/rand/v2"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+// Policies for the runs a schedule missed while the backend was down
+const (
+	// MissedRunOnce makes up for missed runs with a single run as soon as
+	// the backend is back
+	MissedRunOnce = "run_once"
+	// MissedRunSkip drops missed runs and waits for the next one
+	MissedRunSkip = "skip"
+)
+
+const (
+	// maxSchedulesPerUser limits the schedules of one user across devices
+	maxSchedulesPerUser = 10
+
+	// scheduledTestTimeout bounds a scheduled test, including the wait for
+	// the latency probes and fallbacks of a slow line
+	scheduledTestTimeout = 5 * time.Minute
+
+	// missedRunGrace is how late the backend may come back for a run before
+	// the run counts as missed
+	missedRunGrace = time.Minute
+
+	// intervalChecks is how many upcoming runs of a schedule are checked
+	// against the minimum interval
+	intervalChecks = 100
+)
+
+var (
+	// ErrScheduleNotFound is returned when a schedule ID is not registered
+	// for the user
+	ErrScheduleNotFound = errors.New("schedule not found")
+
+	// ErrTooManySchedules is returned when a user, the client saving a
+	// schedule or the backend as a whole already has the most schedules
+	// allowed
+	ErrTooManySchedules = errors.New("too many schedules")
+
+	// ErrScheduleTokenMismatch is returned when a request for the schedules
+	// of a user does not give their schedule token
+	ErrScheduleTokenMismatch = errors.New("schedule token does not match")
+)
+
+// Schedule runs a speed test for a user or one of their devices at the
+// times of a cron expression
+type Schedule struct {
+	ID     string `json:"id"`
+	UserID string `json:"user_id"`
+	// Token is the secret issued with the first schedule of a user. Every
+	// later request for the user's schedules must give it.
+	Token string `json:"token,omitempty"`
+	// Client is the address of the client that created the schedule, whose
+	// schedules are limited across users
+	Client string `json:"client,omitempty"`
+	// DeviceID tells the devices of a user apart. Empty means the schedule
+	// belongs to the user as a whole.
+	DeviceID string `json:"device_id,omitempty"`
+	// Cron is a five-field cron expression such as "0 * * * *" for every
+	// hour, or one of @hourly, @daily, @weekly and @monthly
+	Cron string `json:"cron"`
+	// Timezone is the IANA time zone Cron is read in. Empty means UTC.
+	Timezone string      `json:"timezone,omitempty"`
+	Options  TestOptions `json:"options"`
+	// OnMissed is MissedRunOnce or MissedRunSkip
+	OnMissed string `json:"on_missed,omitempty"`
+	Paused   bool   `json:"paused,omitempty"`
+	// ClientInfo is the client information of the request that saved the
+	// schedule, recorded on its results
+	ClientInfo map[string]string `json:"client_info,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+
+	// NextRun is the time of the next run, before jitter. It stays in the
+	// past while a due run waits or runs, so a restart finds it missed.
+	NextRun      time.Time  `json:"next_run"`
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastResultID string     `json:"last_result_id,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	// MissedRuns counts the runs skipped because the backend was down at
+	// their time
+	MissedRuns int `json:"missed_runs"`
+}
+
+// SchedulerConfig limits how scheduled tests run
+type SchedulerConfig struct {
+	// MaxConcurrent is how many scheduled tests run at the same time. Tests
+	// on one backend share its link, so more than one skews their results.
+	MaxConcurrent int
+	// MaxJitter is the longest random delay added to each run, so that
+	// schedules set to the same minute do not all start at once
+	MaxJitter time.Duration
+	// MinInterval is the shortest time allowed between two runs of a
+	// schedule
+	MinInterval time.Duration
+	// MaxSchedules limits the schedules of all users together, and
+	// MaxSchedulesPerClient those one client address creates. User IDs are
+	// chosen by the client, so the limit per user alone bounds nothing.
+	MaxSchedules          int
+	MaxSchedulesPerClient int
+}
+
+// DefaultSchedulerConfig returns the scheduler settings used unless
+// configured otherwise
+func DefaultSchedulerConfig() SchedulerConfig {
+	return SchedulerConfig{
+		MaxConcurrent:         1,
+		MaxJitter:             2 * time.Minute,
+		MinInterval:           15 * time.Minute,
+		MaxSchedules:          1000,
+		MaxSchedulesPerClient: 20,
+	}
+}
+
+// validate checks that the settings can be used
+func (c SchedulerConfig) validate() error {
+	if c.MaxConcurrent <= 0 {
+		return fmt.Errorf("scheduled test concurrency must be positive")
+	}
+	if c.MaxJitter < 0 || c.MinInterval < 0 {
+		return fmt.Errorf("schedule jitter and interval must not be negative")
+	}
+	if c.MaxSchedules <= 0 || c.MaxSchedulesPerClient <= 0 {
+		return fmt.Errorf("schedule limits must be positive")
+	}
+	return nil
+}
+
+// scheduledTest is a schedule and the state of its runs
+type scheduledTest struct {
+	Schedule
+	spec cronSpec
+	loc  *time.Location
+	// runAt is NextRun plus jitter, or zero while the schedule is paused
+	runAt   time.Time
+	running bool
+}
+
+// Scheduler runs the speed tests of schedules in the background. Schedules
+// are kept in a JSON file when one is configured, so they survive restarts.
+type Scheduler struct {
+	service *SpeedTestService
+	// run runs the test of a schedule; it is replaced in tests
+	run  func(ctx context.Context, schedule Schedule) (*models.SpeedTestResult, error)
+	cfg  SchedulerConfig
+	path string
+
+	mu        sync.Mutex
+	schedules map[string]*scheduledTest
+	// wake interrupts the wait for the next run after schedules change or
+	// a test finishes
+	wake chan struct{}
+	// slots holds a token for every running test
+	slots chan struct{}
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewScheduler creates a scheduler running tests with service. If path is
+// set, schedules are loaded from and saved to that file, and runs missed
+// while the backend was down are handled as each schedule asks.
+func NewScheduler(service *SpeedTestService, path string, cfg SchedulerConfig) (*Scheduler, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	s := &Scheduler{
+		service:   service,
+		run:       service.RunScheduledTest,
+		cfg:       cfg,
+		path:      path,
+		schedules: make(map[string]*scheduledTest),
+		wake:      make(chan struct{}, 1),
+		slots:     make(chan struct{}, cfg.MaxConcurrent),
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schedule file %s: %w", path, err)
+	}
+	var schedules []Schedule
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		return nil, fmt.Errorf("failed to parse schedule file %s: %w", path, err)
+	}
+	now := time.Now()
+	for _, schedule := range schedules {
+		st, err := newScheduledTest(schedule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %s in %s: %w", schedule.ID, path, err)
+		}
+		s.catchUp(st, now)
+		s.schedules[st.ID] = st
+	}
+	if err := s.write(s.schedules); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newScheduledTest parses the cron expression and time zone of schedule
+func newScheduledTest(schedule Schedule) (*scheduledTest, error) {
+	spec, err := parseCron(schedule.Cron)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", schedule.Timezone)
+	}
+	return &scheduledTest{Schedule: schedule, spec: spec, loc: loc}, nil
+}
+
+// Start runs the due tests in the background until Close is called
+func (s *Scheduler) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.wg.Add(1)
+	go s.loop(ctx)
+}
+
+// Close stops the scheduler and waits for the running tests, which are
+// aborted. Their runs are made up after a restart like missed ones.
+func (s *Scheduler) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+	return nil
+}
+
+// userToken returns the schedule token of a user, or "" if the user has no
+// schedules. The caller holds s.mu.
+func (s *Scheduler) userToken(userID string) string {
+	for _, st := range s.schedules {
+		if st.UserID == userID {
+			return st.Token
+		}
+	}
+	return ""
+}
+
+// authorize checks that token is the schedule token of a user who has
+// schedules. The caller holds s.mu.
+func (s *Scheduler) authorize(userID, token string) error {
+	if subtle.ConstantTimeCompare([]byte(s.userToken(userID)), []byte(token)) != 1 {
+		return ErrScheduleTokenMismatch
+	}
+	return nil
+}
+
+// ListSchedules returns the schedules of a user, only those of one device if
+// deviceID is set, in the order they were created
+func (s *Scheduler) ListSchedules(userID, token, deviceID string) ([]Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.authorize(userID, token); err != nil {
+		return nil, err
+	}
+	schedules := []Schedule{}
+	for _, st := range s.schedules {
+		if st.UserID == userID && (deviceID == "" || st.DeviceID == deviceID) {
+			schedules = append(schedules, st.Schedule)
+		}
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].ID < schedules[j].ID })
+	return schedules, nil
+}
+
+// GetSchedule returns the schedule of a user with the given ID
+func (s *Scheduler) GetSchedule(userID, token, id string) (Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.authorize(userID, token); err != nil {
+		return Schedule{}, err
+	}
+	st, ok := s.schedules[id]
+	if !ok || st.UserID != userID {
+		return Schedule{}, fmt.Errorf("%w: %s", ErrScheduleNotFound, id)
+	}
+	return st.Schedule, nil
+}
+
+// SaveSchedule creates a schedule, or replaces the one of the same user with
+// its ID. Only the fields a user chooses are taken from schedule; the run
+// history is kept. Once a user has schedules, token must be their schedule
+// token. It returns the schedule as saved, with the token.
+func (s *Scheduler) SaveSchedule(schedule Schedule, token string) (Schedule, error) {
+	if schedule.UserID == "" {
+		return Schedule{}, fmt.Errorf("user id is required")
+	}
+	switch schedule.OnMissed {
+	case "":
+		schedule.OnMissed = MissedRunOnce
+	case MissedRunOnce, MissedRunSkip:
+	default:
+		return Schedule{}, fmt.Errorf("unknown missed run policy %q", schedule.OnMissed)
+	}
+	if _, err := s.service.resolveOptions(schedule.Options); err != nil {
+		return Schedule{}, err
+	}
+	st, err := newScheduledTest(schedule)
+	if err != nil {
+		return Schedule{}, err
+	}
+	now := time.Now()
+	if err := s.checkInterval(st, now); err != nil {
+		return Schedule{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.authorize(st.UserID, token); err != nil {
+		return Schedule{}, err
+	}
+	st.Token = s.userToken(st.UserID)
+	if st.Token == "" {
+		st.Token = rand.Text()
+	}
+	if st.ID == "" {
+		if err := s.checkLimits(st); err != nil {
+			return Schedule{}, err
+		}
+		st.ID = fmt.Sprintf("%d", now.UnixNano())
+		st.CreatedAt = now
+		st.LastRun, st.LastResultID, st.LastError, st.MissedRuns = nil, "", "", 0
+	} else {
+		old, ok := s.schedules[st.ID]
+		if !ok || old.UserID != st.UserID {
+			return Schedule{}, fmt.Errorf("%w: %s", ErrScheduleNotFound, st.ID)
+		}
+		st.Client = old.Client
+		st.CreatedAt = old.CreatedAt
+		st.LastRun, st.LastResultID, st.LastError, st.MissedRuns = old.LastRun, old.LastResultID, old.LastError, old.MissedRuns
+		st.running = old.running
+	}
+	st.NextRun = st.spec.next(now.In(st.loc))
+	s.arm(st)
+
+	schedules := maps.Clone(s.schedules)
+	schedules[st.ID] = st
+	if err := s.write(schedules); err != nil {
+		return Schedule{}, err
+	}
+	s.schedules = schedules
+	s.notify()
+	return st.Schedule, nil
+}
+
+// checkLimits checks that a new schedule keeps its user, its client and the
+// backend within their schedule limits. The caller holds s.mu.
+func (s *Scheduler) checkLimits(st *scheduledTest) error {
+	if len(s.schedules) >= s.cfg.MaxSchedules {
+		return fmt.Errorf("%w: the backend runs at most %d", ErrTooManySchedules, s.cfg.MaxSchedules)
+	}
+	users, clients := 0, 0
+	for _, other := range s.schedules {
+		if other.UserID == st.UserID {
+			users++
+		}
+		if other.Client == st.Client {
+			clients++
+		}
+	}
+	if users >= maxSchedulesPerUser {
+		return fmt.Errorf("%w: a user may have at most %d", ErrTooManySchedules, maxSchedulesPerUser)
+	}
+	if clients >= s.cfg.MaxSchedulesPerClient {
+		return fmt.Errorf("%w: a client may create at most %d", ErrTooManySchedules, s.cfg.MaxSchedulesPerClient)
+	}
+	return nil
+}
+
+// RemoveSchedule deletes the schedule of a user with the given ID. A test
+// it is running is left to finish.
+func (s *Scheduler) RemoveSchedule(userID, token, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.authorize(userID, token); err != nil {
+		return err
+	}
+	st, ok := s.schedules[id]
+	if !ok || st.UserID != userID {
+		return fmt.Errorf("%w: %s", ErrScheduleNotFound, id)
+	}
+	schedules := maps.Clone(s.schedules)
+	delete(schedules, id)
+	if err := s.write(schedules); err != nil {
+		return err
+	}
+	s.schedules = schedules
+	return nil
+}
+
+// checkInterval checks that the schedule runs and that its upcoming runs
+// are at least the minimum interval apart
+func (s *Scheduler) checkInterval(st *scheduledTest, now time.Time) error {
+	run := st.spec.next(now.In(st.loc))
+	if run.IsZero() {
+		return fmt.Errorf("cron expression %q never runs", st.Cron)
+	}
+	for i := 0; i < intervalChecks; i++ {
+		next := st.spec.next(run)
+		if next.IsZero() {
+			break
+		}
+		if next.Sub(run) < s.cfg.MinInterval {
+			return fmt.Errorf("schedules must not run more often than every %s", s.cfg.MinInterval)
+		}
+		run = next
+	}
+	return nil
+}
+
+// catchUp handles the runs a loaded schedule missed while the backend was
+// down and arms it
+func (s *Scheduler) catchUp(st *scheduledTest, now time.Time) {
+	if st.Paused || st.NextRun.IsZero() || now.Sub(st.NextRun) <= missedRunGrace {
+		s.arm(st)
+		return
+	}
+
+	missed := 0
+	for run := st.NextRun.In(st.loc); !run.IsZero() && run.Before(now); run = st.spec.next(run) {
+		missed++
+	}
+	if st.OnMissed == MissedRunSkip {
+		st.MissedRuns += missed
+		st.NextRun = st.spec.next(now.In(st.loc))
+		s.arm(st)
+		return
+	}
+	st.MissedRuns += missed - 1
+	st.runAt = now.Add(s.jitter())
+}
+
+// arm sets when the schedule next runs from NextRun
+func (s *Scheduler) arm(st *scheduledTest) {
+	st.runAt = time.Time{}
+	if !st.Paused && !st.NextRun.IsZero() {
+		st.runAt = st.NextRun.Add(s.jitter())
+	}
+}
+
+// jitter returns a random delay of up to the configured jitter
+func (s *Scheduler) jitter() time.Duration {
+	if s.cfg.MaxJitter <= 0 {
+		return 0
+	}
+	return mathrand.N(s.cfg.MaxJitter)
+}
+
+// notify wakes the scheduler loop to look at the schedules again
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// loop starts the tests of schedules as they become due
+func (s *Scheduler) loop(ctx context.Context) {
+	defer s.wg.Done()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		timer.Reset(s.startDue(ctx, time.Now()))
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// startDue starts the tests that are due at now and returns how long until
+// the next one is
+func (s *Scheduler) startDue(ctx context.Context, now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wait := time.Hour
+	var due []*scheduledTest
+	for _, st := range s.schedules {
+		if st.running || st.runAt.IsZero() {
+			continue
+		}
+		if until := st.runAt.Sub(now); until > 0 {
+			wait = min(wait, until)
+			continue
+		}
+		due = append(due, st)
+	}
+
+	// Start the longest waiting tests first. Those left without a slot stay
+	// due until a running test finishes and wakes the loop.
+	sort.Slice(due, func(i, j int) bool { return due[i].runAt.Before(due[j].runAt) })
+	for _, st := range due {
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			return wait
+		}
+		st.running = true
+		s.wg.Add(1)
+		go s.execute(ctx, st.Schedule)
+	}
+	return wait
+}
+
+// execute runs the test of a due schedule in the slot startDue took for it
+func (s *Scheduler) execute(ctx context.Context, schedule Schedule) {
+	defer s.wg.Done()
+	runCtx, cancel := context.WithTimeout(ctx, scheduledTestTimeout)
+	result, err := s.run(runCtx, schedule)
+	cancel()
+	<-s.slots
+	s.finish(ctx, schedule.ID, result, err)
+}
+
+// finish records the outcome of a run and arms the next one. Runs cut
+// short by Close are not recorded, so they count as missed after a restart.
+func (s *Scheduler) finish(ctx context.Context, id string, result *models.SpeedTestResult, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.schedules[id]
+	if !ok {
+		return
+	}
+	st.running = false
+	if ctx.Err() != nil {
+		return
+	}
+
+	now := time.Now()
+	st.LastRun = &now
+	st.LastResultID, st.LastError = "", ""
+	if result != nil {
+		st.LastResultID = result.ID
+	}
+	if err != nil {
+		st.LastError = err.Error()
+	}
+	st.NextRun = st.spec.next(now.In(st.loc))
+	s.arm(st)
+	if err := s.write(s.schedules); err != nil {
+		log.Printf("Failed to save schedules: %v", err)
+	}
+	s.notify()
+}
+
+// write saves schedules to the schedule file, if there is one. The caller
+// holds s.mu.
+func (s *Scheduler) write(schedules map[string]*scheduledTest) error {
+	if s.path == "" {
+		return nil
+	}
+	list := make([]Schedule, 0, len(schedules))
+	for _, st := range schedules {
+		list = append(list, st.Schedule)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return fmt.Errorf("failed to save schedules: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,358 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+// newTestScheduler creates a scheduler without jitter whose schedules are
+// kept in a file that already holds schedules, if any are given
+func newTestScheduler(t *testing.T, cfg SchedulerConfig, schedules ...Schedule) (*Scheduler, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "schedules.json")
+	if len(schedules) > 0 {
+		data, err := json.Marshal(schedules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	service := NewSpeedTestService(nil, nil, NewInMemoryTestServerRegistry())
+	s, err := NewScheduler(service, path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, path
+}
+
+// testSchedulerConfig runs one test at a time without jitter
+var testSchedulerConfig = SchedulerConfig{MaxConcurrent: 1, MinInterval: 15 * time.Minute, MaxSchedules: 100, MaxSchedulesPerClient: 20}
+
+// missedSchedule is an hourly schedule whose last four runs, including the
+// one of the current hour, were missed
+func missedSchedule(id, onMissed string) Schedule {
+	return Schedule{
+		ID:       id,
+		UserID:   "user",
+		Cron:     "@hourly",
+		OnMissed: onMissed,
+		NextRun:  time.Now().UTC().Truncate(time.Hour).Add(-3 * time.Hour),
+	}
+}
+
+// waitForOutcome waits until the outcome of a run of the schedule of "user"
+// with the given ID is recorded and returns the schedule
+func waitForOutcome(t *testing.T, s *Scheduler, id string) Schedule {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if schedule, _ := s.GetSchedule("user", "", id); schedule.LastRun != nil {
+			return schedule
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("outcome of the run of %q was not recorded", id)
+		}
+	}
+}
+
+func TestSchedulerHandlesMissedRuns(t *testing.T) {
+	s, path := newTestScheduler(t, testSchedulerConfig,
+		missedSchedule("once", MissedRunOnce),
+		missedSchedule("skip", MissedRunSkip),
+	)
+
+	ran := make(chan Schedule, 2)
+	s.run = func(ctx context.Context, schedule Schedule) (*models.SpeedTestResult, error) {
+		ran <- schedule
+		return &models.SpeedTestResult{ID: "result-" + schedule.ID, Origin: models.OriginScheduled}, nil
+	}
+	s.Start()
+
+	select {
+	case schedule := <-ran:
+		if schedule.ID != "once" {
+			t.Fatalf("made up the missed runs of %q", schedule.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("missed run was not made up")
+	}
+	waitForOutcome(t, s, "once")
+	s.Close()
+	select {
+	case schedule := <-ran:
+		t.Fatalf("ran %q a second time", schedule.ID)
+	default:
+	}
+
+	// The outcome must survive a restart
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved []Schedule
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	for _, schedule := range saved {
+		if !schedule.NextRun.After(time.Now()) {
+			t.Errorf("next run of %q is %v, in the past", schedule.ID, schedule.NextRun)
+		}
+		switch schedule.ID {
+		case "once":
+			if schedule.MissedRuns != 3 || schedule.LastResultID != "result-once" || schedule.LastRun == nil {
+				t.Errorf("made up schedule saved as %+v", schedule)
+			}
+		case "skip":
+			if schedule.MissedRuns != 4 || schedule.LastRun != nil {
+				t.Errorf("skipped schedule saved as %+v", schedule)
+			}
+		}
+	}
+}
+
+func TestSchedulerLimitsConcurrency(t *testing.T) {
+	var schedules []Schedule
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		schedules = append(schedules, missedSchedule(id, MissedRunOnce))
+	}
+	s, _ := newTestScheduler(t, SchedulerConfig{MaxConcurrent: 2, MaxSchedules: 100, MaxSchedulesPerClient: 20}, schedules...)
+
+	var mu sync.Mutex
+	running, most := 0, 0
+	done := make(chan struct{}, len(schedules))
+	s.run = func(ctx context.Context, schedule Schedule) (*models.SpeedTestResult, error) {
+		mu.Lock()
+		running++
+		most = max(most, running)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		done <- struct{}{}
+		return nil, errors.New("no test server")
+	}
+	s.Start()
+
+	for range schedules {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("scheduled tests did not all run")
+		}
+	}
+	if most != 2 {
+		t.Fatalf("ran up to %d tests at once; want 2", most)
+	}
+	if schedule := waitForOutcome(t, s, "a"); schedule.LastError != "no test server" {
+		t.Fatalf("recorded error %q", schedule.LastError)
+	}
+}
+
+func TestSchedulerSaveSchedule(t *testing.T) {
+	s, _ := newTestScheduler(t, testSchedulerConfig)
+
+	for _, invalid := range []Schedule{
+		{Cron: "@hourly"},
+		{UserID: "user", Cron: "every hour"},
+		{UserID: "user", Cron: "*/5 * * * *"},
+		{UserID: "user", Cron: "0 0 30 2 *"},
+		{UserID: "user", Cron: "@hourly", Timezone: "Mars/Olympus"},
+		{UserID: "user", Cron: "@hourly", OnMissed: "twice"},
+		{UserID: "user", Cron: "@hourly", Options: TestOptions{Preset: "unknown"}},
+	} {
+		if _, err := s.SaveSchedule(invalid, ""); err == nil {
+			t.Errorf("saved invalid schedule %+v", invalid)
+		}
+	}
+
+	saved, err := s.SaveSchedule(Schedule{UserID: "user", DeviceID: "laptop", Cron: "0 */2 * * *", MissedRuns: 7}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.ID == "" || saved.Token == "" || saved.OnMissed != MissedRunOnce || saved.MissedRuns != 0 || !saved.NextRun.After(time.Now()) {
+		t.Fatalf("created schedule %+v", saved)
+	}
+	token := saved.Token
+	if _, err := s.GetSchedule("other", "", saved.ID); !errors.Is(err, ErrScheduleNotFound) {
+		t.Fatalf("another user got the schedule: %v", err)
+	}
+	if _, err := s.SaveSchedule(Schedule{ID: saved.ID, UserID: "other", Cron: "@daily"}, ""); !errors.Is(err, ErrScheduleNotFound) {
+		t.Fatalf("another user replaced the schedule: %v", err)
+	}
+
+	saved.Cron = "@daily"
+	saved.Paused = true
+	updated, err := s.SaveSchedule(saved, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Cron != "@daily" || updated.Token != token || !updated.CreatedAt.Equal(saved.CreatedAt) {
+		t.Fatalf("updated schedule %+v", updated)
+	}
+	if list, _ := s.ListSchedules("user", token, "phone"); len(list) != 0 {
+		t.Fatalf("listed %d schedules of another device", len(list))
+	}
+
+	for i := 1; i < maxSchedulesPerUser; i++ {
+		if _, err := s.SaveSchedule(Schedule{UserID: "user", Cron: "@weekly"}, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.SaveSchedule(Schedule{UserID: "user", Cron: "@weekly"}, token); !errors.Is(err, ErrTooManySchedules) {
+		t.Fatalf("saving one schedule too many returned %v", err)
+	}
+
+	if err := s.RemoveSchedule("other", "", saved.ID); !errors.Is(err, ErrScheduleNotFound) {
+		t.Fatalf("another user removed the schedule: %v", err)
+	}
+	if err := s.RemoveSchedule("user", token, saved.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetSchedule("user", token, saved.ID); !errors.Is(err, ErrScheduleNotFound) {
+		t.Fatalf("removed schedule is still there: %v", err)
+	}
+}
+
+// TestSchedulerRequiresToken expects the schedules of a user to be out of
+// reach of requests that only know the user ID
+func TestSchedulerRequiresToken(t *testing.T) {
+	s, _ := newTestScheduler(t, testSchedulerConfig)
+
+	saved, err := s.SaveSchedule(Schedule{UserID: "user", DeviceID: "laptop", Cron: "@hourly"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"", "guess", saved.Token + "x"} {
+		if _, err := s.ListSchedules("user", token, ""); !errors.Is(err, ErrScheduleTokenMismatch) {
+			t.Errorf("listed the schedules with token %q: %v", token, err)
+		}
+		if _, err := s.GetSchedule("user", token, saved.ID); !errors.Is(err, ErrScheduleTokenMismatch) {
+			t.Errorf("got the schedule with token %q: %v", token, err)
+		}
+		if _, err := s.SaveSchedule(Schedule{ID: saved.ID, UserID: "user", Cron: "@daily"}, token); !errors.Is(err, ErrScheduleTokenMismatch) {
+			t.Errorf("replaced the schedule with token %q: %v", token, err)
+		}
+		if _, err := s.SaveSchedule(Schedule{UserID: "user", Cron: "@daily"}, token); !errors.Is(err, ErrScheduleTokenMismatch) {
+			t.Errorf("added a schedule with token %q: %v", token, err)
+		}
+		if err := s.RemoveSchedule("user", token, saved.ID); !errors.Is(err, ErrScheduleTokenMismatch) {
+			t.Errorf("removed the schedule with token %q: %v", token, err)
+		}
+	}
+
+	// Every user gets a token of their own
+	other, err := s.SaveSchedule(Schedule{UserID: "other", Cron: "@hourly"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Token == saved.Token {
+		t.Fatal("two users share a schedule token")
+	}
+	if _, err := s.ListSchedules("user", other.Token, ""); !errors.Is(err, ErrScheduleTokenMismatch) {
+		t.Fatalf("listed the schedules with the token of another user: %v", err)
+	}
+}
+
+// TestSchedulerLeavesDueSchedulesWaiting expects due schedules beyond the
+// free slots to wait unstarted rather than each in a goroutine of its own
+func TestSchedulerLeavesDueSchedulesWaiting(t *testing.T) {
+	var schedules []Schedule
+	for _, id := range []string{"a", "b", "c", "d"} {
+		schedules = append(schedules, missedSchedule(id, MissedRunOnce))
+	}
+	s, _ := newTestScheduler(t, testSchedulerConfig, schedules...)
+
+	release := make(chan struct{})
+	started := make(chan string, len(schedules))
+	s.run = func(ctx context.Context, schedule Schedule) (*models.SpeedTestResult, error) {
+		started <- schedule.ID
+		<-release
+		return nil, errors.New("no test server")
+	}
+	s.Start()
+
+	<-started
+	s.mu.Lock()
+	running := 0
+	for _, st := range s.schedules {
+		if st.running {
+			running++
+		}
+	}
+	s.mu.Unlock()
+	if running != 1 {
+		t.Fatalf("started %d tests for one slot", running)
+	}
+
+	close(release)
+	for range schedules[1:] {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("waiting schedules did not run once the slot was free")
+		}
+	}
+}
+
+func TestSchedulerLimitsSchedules(t *testing.T) {
+	s, _ := newTestScheduler(t, SchedulerConfig{MaxConcurrent: 1, MinInterval: time.Minute, MaxSchedules: 5, MaxSchedulesPerClient: 3})
+
+	// Each schedule under a new user ID, as a client dodging the limit per
+	// user would
+	for i := range 3 {
+		if _, err := s.SaveSchedule(Schedule{UserID: fmt.Sprint("user", i), Client: "192.0.2.1", Cron: "@daily"}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.SaveSchedule(Schedule{UserID: "user3", Client: "192.0.2.1", Cron: "@daily"}, ""); !errors.Is(err, ErrTooManySchedules) {
+		t.Fatalf("saving one schedule too many for a client returned %v", err)
+	}
+
+	for i := range 2 {
+		if _, err := s.SaveSchedule(Schedule{UserID: fmt.Sprint("other", i), Client: "192.0.2.2", Cron: "@daily"}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.SaveSchedule(Schedule{UserID: "other2", Client: "192.0.2.3", Cron: "@daily"}, ""); !errors.Is(err, ErrTooManySchedules) {
+		t.Fatalf("saving one schedule too many for the backend returned %v", err)
+	}
+}
+
+// TestSchedulerKeepsSchedulesWhenSaveFails expects a change that cannot be
+// written to the schedule file to be left out of the running schedules too
+func TestSchedulerKeepsSchedulesWhenSaveFails(t *testing.T) {
+	s, path := newTestScheduler(t, testSchedulerConfig)
+	saved, err := s.SaveSchedule(Schedule{UserID: "user", Cron: "@daily"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(filepath.Dir(path)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SaveSchedule(Schedule{UserID: "user", Cron: "@hourly"}, saved.Token); err == nil {
+		t.Fatal("created a schedule without saving it")
+	}
+	if err := s.RemoveSchedule("user", saved.Token, saved.ID); err == nil {
+		t.Fatal("removed a schedule without saving it")
+	}
+	list, err := s.ListSchedules("user", saved.Token, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != saved.ID {
+		t.Fatalf("schedules after failed saves: %+v", list)
+	}
+}
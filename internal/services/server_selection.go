@@ -0,0 +1,182 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/measure"
+)
+
+const (
+	// serverProbeCount is the number of RTT probes sent to each candidate
+	serverProbeCount = 5
+
+	// serverProbeTimeout bounds a single RTT probe
+	serverProbeTimeout = 2 * time.Second
+
+	// serverProbeInterval is the pause between probes to the same server
+	serverProbeInterval = 50 * time.Millisecond
+
+	// serverRankingTTL is how long a ranking of the candidate servers is
+	// reused before they are probed again
+	serverRankingTTL = 30 * time.Second
+)
+
+// ServerLatency is a test server together with its measured round-trip time
+type ServerLatency struct {
+	Server    TestServer `json:"server"`
+	MedianRTT float64    `json:"median_rtt_ms"`
+	Samples   int        `json:"samples"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// reachable reports whether at least one probe to the server succeeded
+func (l ServerLatency) reachable() bool {
+	return l.Samples > 0
+}
+
+// serverRanking caches the last ranking of the candidate servers, so that
+// listing the servers does not probe every one of them on each request
+type serverRanking struct {
+	mu         sync.Mutex
+	candidates []TestServer
+	ranked     []ServerLatency
+	rankedAt   time.Time
+}
+
+// isCandidate reports whether a server can host a full speed test
+func isCandidate(server TestServer) bool {
+	return server.Supports(PhaseLatency) && server.Supports(PhaseDownload) && server.Supports(PhaseUpload)
+}
+
+// candidateServers returns the enabled servers that support every phase
+func (s *SpeedTestService) candidateServers(ctx context.Context) ([]TestServer, error) {
+	servers, err := s.serverRegistry.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []TestServer
+	for _, server := range servers {
+		if isCandidate(server) {
+			candidates = append(candidates, server)
+		}
+	}
+	return candidates, nil
+}
+
+// RankServers probes every candidate server and returns them ordered by
+// median RTT. Unreachable servers are listed last. The ranking is reused for
+// serverRankingTTL unless the candidates change, and concurrent callers
+// wait for a single round of probes.
+func (s *SpeedTestService) RankServers(ctx context.Context) ([]ServerLatency, error) {
+	candidates, err := s.candidateServers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.ranking.mu.Lock()
+	defer s.ranking.mu.Unlock()
+	if slices.Equal(candidates, s.ranking.candidates) && time.Since(s.ranking.rankedAt) < serverRankingTTL {
+		return slices.Clone(s.ranking.ranked), nil
+	}
+
+	ranked := make([]ServerLatency, len(candidates))
+	var wg sync.WaitGroup
+	for i, server := range candidates {
+		wg.Add(1)
+		go func(i int, server TestServer) {
+			defer wg.Done()
+			ranked[i] = s.probeServer(ctx, server)
+		}(i, server)
+	}
+	wg.Wait()
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].reachable() != ranked[j].reachable() {
+			return ranked[i].reachable()
+		}
+		return ranked[i].MedianRTT < ranked[j].MedianRTT
+	})
+
+	// Probes cut short by the caller going away say nothing about the
+	// servers, so they are not kept
+	if ctx.Err() == nil {
+		s.ranking.candidates = candidates
+		s.ranking.ranked = ranked
+		s.ranking.rankedAt = time.Now()
+	}
+	return slices.Clone(ranked), nil
+}
+
+// selectServer returns the requested server, or the candidate with the lowest
+// median RTT when serverID is empty. The server must speak protocol.
+func (s *SpeedTestService) selectServer(ctx context.Context, serverID string, protocol string) (TestServer, error) {
+	if serverID != "" {
+		server, err := s.serverRegistry.Get(ctx, serverID)
+		if err != nil {
+			return TestServer{}, err
+		}
+		if !isCandidate(server) {
+			return TestServer{}, fmt.Errorf("test server %q is disabled or does not support every phase", serverID)
+		}
+		if !server.speaks(protocol) {
+			return TestServer{}, fmt.Errorf("%w: test server %q does not speak %s", ErrInvalidOptions, serverID, protocol)
+		}
+		return server, nil
+	}
+
+	all, err := s.RankServers(ctx)
+	if err != nil {
+		return TestServer{}, err
+	}
+	var ranked []ServerLatency
+	for _, latency := range all {
+		if latency.Server.speaks(protocol) {
+			ranked = append(ranked, latency)
+		}
+	}
+	if len(ranked) == 0 {
+		return TestServer{}, fmt.Errorf("no test servers available")
+	}
+	if !ranked[0].reachable() {
+		return TestServer{}, fmt.Errorf("no test server is reachable")
+	}
+	return ranked[0].Server, nil
+}
+
+// probeServer measures the TCP connect time to a server several times and
+// reports the median
+func (s *SpeedTestService) probeServer(ctx context.Context, server TestServer) ServerLatency {
+	latency := ServerLatency{Server: server}
+
+	addr, err := measure.ServerAddress(server.URL)
+	if err != nil {
+		latency.Error = err.Error()
+		return latency
+	}
+
+	rtts, err := serverPinger(serverProbeCount).RTTs(ctx, "tcp", addr)
+	latency.Samples = len(rtts)
+	if len(rtts) > 0 {
+		latency.MedianRTT = measure.Median(rtts)
+	} else if err != nil {
+		latency.Error = err.Error()
+	}
+	return latency
+}
+
+// serverPinger returns a pinger taking count TCP connect samples of a test
+// server
+func serverPinger(count int) measure.ConnectPinger {
+	return measure.ConnectPinger{
+		Dialer:   &net.Dialer{Timeout: serverProbeTimeout},
+		Count:    count,
+		Interval: serverProbeInterval,
+	}
+}
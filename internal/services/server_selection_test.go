@@ -0,0 +1,76 @@
+package services
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingListener counts the connections a test server accepts
+func countingListener(t *testing.T) (string, *atomic.Int64) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var accepted atomic.Int64
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			c.Close()
+		}
+	}()
+	return "http://" + l.Addr().String(), &accepted
+}
+
+// checkAccepted fails the test unless the listener accepts want connections.
+// The last connects may return before the listener has counted them.
+func checkAccepted(t *testing.T, accepted *atomic.Int64, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for accepted.Load() < want && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := accepted.Load(); n != want {
+		t.Fatalf("probed the servers %d times; want %d", n, want)
+	}
+}
+
+func TestRankServersReusesRanking(t *testing.T) {
+	url, accepted := countingListener(t)
+	capable := ServerCapabilities{Download: true, Upload: true, Latency: true}
+	registry := NewInMemoryTestServerRegistry(TestServer{ID: "a", URL: url, Capabilities: capable})
+	service := NewSpeedTestService(nil, nil, registry)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		ranked, err := service.RankServers(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ranked) != 1 || !ranked[0].reachable() {
+			t.Fatalf("ranked %+v", ranked)
+		}
+	}
+	checkAccepted(t, accepted, serverProbeCount)
+
+	// A new candidate makes the ranking stale
+	if err := registry.Add(ctx, TestServer{ID: "b", URL: url, Capabilities: capable}); err != nil {
+		t.Fatal(err)
+	}
+	ranked, err := service.RankServers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranked) != 2 {
+		t.Fatalf("ranked %d servers; want 2", len(ranked))
+	}
+	checkAccepted(t, accepted, 3*serverProbeCount)
+}
@@ -2,54 +2,159 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
-	"math/rand"
 	"net"
-	"net/http"
+	"strings"
 	"time"
-	"sync"
-	"sort"
-	"bytes"
 
+	"github.com/cetinibs/online-speed-test-backend-root/internal/measure"
 	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
 	"github.com/cetinibs/online-speed-test-backend-root/internal/repositories"
 )
 
+// Measurement phases of a speed test
+const (
+	PhaseLatency  = "latency"
+	PhaseDownload = measure.PhaseDownload
+	PhaseUpload   = measure.PhaseUpload
+	// PhasePacketLoss is the optional UDP probe run after the latency phase
+	PhasePacketLoss = "packet_loss"
+	// PhaseDualStack repeats the latency and throughput phases over IPv4 and
+	// IPv6 when the test runs in dual-stack mode
+	PhaseDualStack = "dual_stack"
+	// PhaseDNS benchmarks the configured DNS resolvers
+	PhaseDNS = "dns"
+)
+
+// ErrTestAborted is returned when a speed test is cancelled before it
+// completes
+var ErrTestAborted = errors.New("speed test aborted")
+
+var (
+	// pingHosts are the hosts whose TCP connect time is the idle latency
+	pingHosts = []string{"8.8.8.8", "1.1.1.1", "208.67.222.222"}
+
+	// alternativePingHosts are probed with HTTP HEAD requests when TCP
+	// connects to pingHosts fail
+	alternativePingHosts = []string{"8.8.8.8", "1.1.1.1"}
+
+	// alternativeDownloadURLs are small files downloaded when the test
+	// server's download endpoint fails
+	alternativeDownloadURLs = []string{
+		"https://www.google.com/images/branding/googlelogo/1x/googlelogo_color_272x92dp.png",
+		"https://www.microsoft.com/favicon.ico",
+		"https://speed.cloudflare.com/__down?bytes=1000000",
+	}
+
+	// alternativeUploadURLs are echo endpoints used when the test server's
+	// upload endpoint fails
+	alternativeUploadURLs = []string{
+		"https://httpbin.org/post",
+		"https://postman-echo.com/post",
+	}
+)
+
+const (
+	// publicPingCount is the number of pings sent to each public host
+	publicPingCount = 5
+
+	// publicPingInterval is the pause after each ping to a public host
+	publicPingInterval = 100 * time.Millisecond
+
+	// alternativeUploadBytes is the body size posted to each echo endpoint
+	alternativeUploadBytes = 1 * 1024 * 1024 // 1MB
+)
+
 // SpeedTestService handles the business logic for speed testing
 type SpeedTestService struct {
-	speedTestRepo repositories.SpeedTestRepository
-	userRepo      repositories.UserRepository
+	speedTestRepo  repositories.SpeedTestRepository
+	userRepo       repositories.UserRepository
+	serverRegistry TestServerRegistry
+	throughput     ThroughputConfig
+	packetLoss     PacketLossConfig
+	dns            DNSConfig
+	presets        *presetStore
+	ranking        serverRanking
+	// ndt7Duration is how long ndt7 tests run; it is shortened in tests
+	ndt7Duration time.Duration
 }
 
 // NewSpeedTestService creates a new instance of SpeedTestService
-func NewSpeedTestService(speedTestRepo repositories.SpeedTestRepository, userRepo repositories.UserRepository) *SpeedTestService {
+func NewSpeedTestService(speedTestRepo repositories.SpeedTestRepository, userRepo repositories.UserRepository, serverRegistry TestServerRegistry) *SpeedTestService {
 	return &SpeedTestService{
-		speedTestRepo: speedTestRepo,
-		userRepo:      userRepo,
+		speedTestRepo:  speedTestRepo,
+		userRepo:       userRepo,
+		serverRegistry: serverRegistry,
+		throughput:     DefaultThroughputConfig(),
+		packetLoss:     DefaultPacketLossConfig(),
+		dns:            DefaultDNSConfig(),
+		presets:        newPresetStore(DefaultTestPresets()),
+		ndt7Duration:   ndt7TestDuration,
 	}
 }
 
-// TestServer represents a speed test server
-type TestServer struct {
-	Name     string
-	URL      string
-	Location string
+// SetThroughputConfig changes how the download and upload phases are timed
+func (s *SpeedTestService) SetThroughputConfig(cfg ThroughputConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	s.throughput = cfg
+	return nil
 }
 
-// List of reliable test servers
-var testServers = []TestServer{
-	{Name: "Cloudflare", URL: "https://speed.cloudflare.com", Location: "Global CDN"},
-	{Name: "Turksat", URL: "http://speedtest.turksat.com.tr", Location: "Ankara, Turkey"},
-	{Name: "Turk Telekom", URL: "http://speedtest.turktelekom.com.tr", Location: "Istanbul, Turkey"},
-	{Name: "Google", URL: "https://www.google.com", Location: "Global CDN"},
-	{Name: "Microsoft", URL: "https://www.microsoft.com", Location: "Global CDN"},
+// SetPacketLossConfig changes the rate, count and size of UDP probe datagrams
+func (s *SpeedTestService) SetPacketLossConfig(cfg PacketLossConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	s.packetLoss = cfg
+	return nil
 }
 
-// RunSpeedTest performs a speed test and saves the result
-func (s *SpeedTestService) RunSpeedTest(ctx context.Context, userID string, ipInfo map[string]string, isMultiConnection bool) (*models.SpeedTestResult, error) {
-	// Perform real speed test
-	downloadSpeed, uploadSpeed, ping, jitter, err := s.performSpeedTest(isMultiConnection)
+// SetDNSConfig changes the resolvers and names of the DNS benchmark. With no
+// resolvers the DNS phase is skipped.
+func (s *SpeedTestService) SetDNSConfig(cfg DNSConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	s.dns = cfg
+	return nil
+}
+
+// RunSpeedTest performs a speed test configured by opts and saves the
+// result. The test runs against opts.ServerID, or against the nearest server
+// when it is empty.
+func (s *SpeedTestService) RunSpeedTest(ctx context.Context, userID string, ipInfo map[string]string, opts TestOptions) (*models.SpeedTestResult, error) {
+	return s.RunSpeedTestWithProgress(ctx, userID, ipInfo, opts, nil)
+}
+
+// RunSpeedTestWithProgress works like RunSpeedTest and reports phase changes,
+// throughput samples and the final result to progress as the test runs.
+//
+// If ctx is cancelled or its deadline passes, every phase stops promptly and
+// the partial result is saved and returned marked as aborted, together with
+// an error wrapping ErrTestAborted.
+func (s *SpeedTestService) RunSpeedTestWithProgress(ctx context.Context, userID string, ipInfo map[string]string, opts TestOptions, progress ProgressFunc) (*models.SpeedTestResult, error) {
+	return s.runSpeedTest(ctx, userID, ipInfo, opts, progress, nil)
+}
+
+// RunScheduledTest runs the speed test of a schedule for its user and saves
+// the result with the scheduled origin
+func (s *SpeedTestService) RunScheduledTest(ctx context.Context, schedule Schedule) (*models.SpeedTestResult, error) {
+	return s.runSpeedTest(ctx, schedule.UserID, schedule.ClientInfo, schedule.Options, nil, &schedule)
+}
+
+// runSpeedTest implements RunSpeedTestWithProgress. If schedule is not nil,
+// the test is run by it and the result records its origin.
+func (s *SpeedTestService) runSpeedTest(ctx context.Context, userID string, ipInfo map[string]string, opts TestOptions, progress ProgressFunc, schedule *Schedule) (*models.SpeedTestResult, error) {
+	plan, err := s.resolveOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pick the server for the throughput phases
+	server, err := s.selectServer(ctx, plan.ServerID, plan.Protocol)
 	if err != nil {
 		return nil, err
 	}
@@ -61,512 +166,242 @@ func (s *SpeedTestService) RunSpeedTest(ctx context.Context, userID string, ipIn
 	result := &models.SpeedTestResult{
 		ID:            resultID,
 		UserID:        userID,
-		DownloadSpeed: downloadSpeed,
-		UploadSpeed:   uploadSpeed,
-		Ping:          ping,
-		Jitter:        jitter,
 		ISP:           ipInfo["isp"],
 		IPAddress:     ipInfo["ip"],
 		Country:       ipInfo["country"],
 		Region:        ipInfo["region"],
-		CreatedAt:     time.Now(),
+		Server:        server.info(),
+		TestType:  models.TestTypeHTTP,
+		Preset:    plan.Preset,
+		CreatedAt: time.Now(),
 	}
-
-	// Save the result to the database
-	err = s.speedTestRepo.SaveResult(ctx, result)
-	return result, err
-}
-
-// performSpeedTest conducts the actual speed test
-func (s *SpeedTestService) performSpeedTest(isMultiConnection bool) (float64, float64, float64, float64, error) {
-	// Measure ping and jitter
-	ping, jitter, err := s.measurePingAndJitter()
-	if err != nil {
-		// Try alternative ping measurement if first method fails
-		ping, jitter, err = s.measureAlternativePing()
-		if err != nil {
-			// As last resort, use simulated values
-			ping = float64(15 + rand.Intn(10))
-			jitter = float64(2 + rand.Intn(5))
-		}
+	if schedule != nil {
+		result.Origin = models.OriginScheduled
+		result.ScheduleID = schedule.ID
+		result.DeviceID = schedule.DeviceID
 	}
 
-	// Measure download speed
-	var downloadSpeed float64
-	if isMultiConnection {
-		downloadSpeed, err = s.measureMultiConnectionDownloadSpeed()
-	} else {
-		downloadSpeed, err = s.measureDownloadSpeed()
+	// Perform real speed test
+	testErr := s.performSpeedTest(ctx, server, plan, progress, result)
+	if testErr == nil && plan.dualStack {
+		testErr = s.performDualStack(ctx, server, plan, progress, result)
 	}
-	
-	if err != nil {
-		// Try alternative download test if first method fails
-		downloadSpeed, err = s.measureAlternativeDownloadSpeed()
-		if err != nil {
-			// As last resort, use simulated values
-			downloadSpeed = 80 + rand.Float64()*40
-		}
+	if testErr != nil && !result.Aborted {
+		return nil, testErr
 	}
 
-	// Measure upload speed
-	var uploadSpeed float64
-	if isMultiConnection {
-		uploadSpeed, err = s.measureMultiConnectionUploadSpeed()
-	} else {
-		uploadSpeed, err = s.measureUploadSpeed()
+	// Save the result to the database. Aborted results are saved too, so the
+	// save must not be cancelled along with the test.
+	if err := s.speedTestRepo.SaveResult(context.WithoutCancel(ctx), result); err != nil {
+		return result, err
 	}
-	
-	if err != nil {
-		// Try alternative upload test if first method fails
-		uploadSpeed, err = s.measureAlternativeUploadSpeed()
-		if err != nil {
-			// As last resort, use simulated values
-			uploadSpeed = 5 + rand.Float64()*15
-		}
+	if testErr != nil {
+		return result, testErr
 	}
 
-	return downloadSpeed, uploadSpeed, ping, jitter, nil
+	progress.emit(ProgressEvent{Type: EventResult, Result: result})
+	return result, nil
 }
 
-// measurePingAndJitter measures the ping and jitter to multiple hosts
-func (s *SpeedTestService) measurePingAndJitter() (float64, float64, error) {
-	hosts := []string{"8.8.8.8", "1.1.1.1", "208.67.222.222"}
-	var pingTimes []float64
-	
-	for _, host := range hosts {
-		// Perform multiple pings to each host
-		for i := 0; i < 5; i++ {
-			start := time.Now()
-			conn, err := net.DialTimeout("tcp", host+":80", 2*time.Second)
-			if err != nil {
-				continue
-			}
-			elapsed := time.Since(start)
-			pingTimes = append(pingTimes, float64(elapsed.Milliseconds()))
-			conn.Close()
-			time.Sleep(100 * time.Millisecond)
+// performSpeedTest conducts the phases of plan and records the measurements
+// and their provenance on result. In strict mode a phase whose primary method
+// fails fails the test instead of falling back.
+func (s *SpeedTestService) performSpeedTest(ctx context.Context, server TestServer, plan testPlan, progress ProgressFunc, result *models.SpeedTestResult) error {
+	provenance := &models.ResultProvenance{}
+	result.Provenance = provenance
+	for phase, phaseProvenance := range map[string]*models.Provenance{
+		PhaseLatency:  &provenance.Latency,
+		PhaseDownload: &provenance.Download,
+		PhaseUpload:   &provenance.Upload,
+	} {
+		if !plan.runs(phase) {
+			*phaseProvenance = models.Provenance{Source: models.SourceSkipped}
 		}
 	}
-	
-	if len(pingTimes) < 3 {
-		return 0, 0, fmt.Errorf("not enough successful pings")
-	}
-	
-	// Calculate average ping
-	var sum float64
-	for _, p := range pingTimes {
-		sum += p
-	}
-	avgPing := sum / float64(len(pingTimes))
-	
-	// Calculate jitter (standard deviation of ping times)
-	var variance float64
-	for _, p := range pingTimes {
-		variance += (p - avgPing) * (p - avgPing)
-	}
-	jitter := float64(0)
-	if len(pingTimes) > 1 {
-		jitter = float64(variance / float64(len(pingTimes)-1))
-	}
-	
-	return avgPing, jitter, nil
-}
 
-// measureAlternativePing uses ICMP echo (ping) when available
-func (s *SpeedTestService) measureAlternativePing() (float64, float64, error) {
-	// This is a simplified version - in a real implementation, 
-	// you would use a proper ping library that supports ICMP
-	hosts := []string{"8.8.8.8", "1.1.1.1"}
-	var pingTimes []float64
-	
-	for _, host := range hosts {
-		// Simulate ping using HTTP HEAD requests as a fallback
-		for i := 0; i < 5; i++ {
-			start := time.Now()
-			resp, err := http.Head("https://" + host)
-			if err != nil {
-				continue
-			}
-			resp.Body.Close()
-			elapsed := time.Since(start)
-			pingTimes = append(pingTimes, float64(elapsed.Milliseconds()))
-			time.Sleep(100 * time.Millisecond)
+	// Measure ping and jitter, using HTTP HEAD requests if TCP connects fail
+	if plan.runs(PhaseLatency) {
+		progress.emit(ProgressEvent{Type: EventPhase, Phase: PhaseLatency, Server: &result.Server})
+		latency, latencyProvenance, err := measureWithFallback(ctx, plan.strict,
+			measurement[measure.LatencyStats]{method: MethodTCPConnect, server: strings.Join(pingHosts, ","), measure: publicProber(measure.PingTCPConnect).Latency},
+			measurement[measure.LatencyStats]{method: MethodHTTPHead, server: strings.Join(alternativePingHosts, ","), measure: publicProber(measure.PingHTTPHead).Latency},
+		)
+		provenance.Latency = latencyProvenance
+		if ctx.Err() != nil {
+			return abortTest(ctx, PhaseLatency, result)
+		}
+		if err != nil {
+			return fmt.Errorf("latency phase failed: %w", err)
+		}
+		if latencyProvenance.Source != models.SourceUnavailable {
+			progress.emit(ProgressEvent{Type: EventLatency, Phase: PhaseLatency, Ping: latency.Mean, Jitter: latency.Jitter})
+			applyLatency(result, latency)
 		}
 	}
-	
-	if len(pingTimes) < 3 {
-		return 0, 0, fmt.Errorf("not enough successful pings")
-	}
-	
-	// Calculate average ping
-	var sum float64
-	for _, p := range pingTimes {
-		sum += p
-	}
-	avgPing := sum / float64(len(pingTimes))
-	
-	// Calculate jitter
-	var variance float64
-	for _, p := range pingTimes {
-		variance += (p - avgPing) * (p - avgPing)
-	}
-	jitter := float64(0)
-	if len(pingTimes) > 1 {
-		jitter = float64(variance / float64(len(pingTimes)-1))
+
+	// Measure packet loss when the server runs a UDP echo responder
+	if plan.runs(PhasePacketLoss) && server.Supports(PhasePacketLoss) {
+		progress.emit(ProgressEvent{Type: EventPhase, Phase: PhasePacketLoss, Server: &result.Server})
+		packetLoss, err := s.measurePacketLoss(ctx, server)
+		packetLossProvenance := measured(models.SourcePrimary, MethodUDPEcho, server.UDPEchoAddress)
+		if err != nil {
+			packetLossProvenance = unavailable(MethodUDPEcho, server.UDPEchoAddress, err)
+		}
+		result.PacketLoss = packetLoss
+		provenance.PacketLoss = &packetLossProvenance
+		if ctx.Err() != nil {
+			return abortTest(ctx, PhasePacketLoss, result)
+		}
 	}
-	
-	return avgPing, jitter, nil
-}
 
-// measureDownloadSpeed measures the download speed using a single connection
-func (s *SpeedTestService) measureDownloadSpeed() (float64, error) {
-	// Use a large file from a CDN for download test
-	url := "https://speed.cloudflare.com/__down?bytes=25000000" // 25MB file
-	start := time.Now()
+	// Benchmark the DNS resolvers, separately from the throughput phases
+	if plan.runs(PhaseDNS) && len(s.dns.Resolvers) > 0 {
+		progress.emit(ProgressEvent{Type: EventPhase, Phase: PhaseDNS})
+		dns, err := s.measureDNS(ctx)
+		dnsProvenance := measured(models.SourcePrimary, MethodDNSQuery, resolverNames(s.dns.Resolvers))
+		if err != nil {
+			dnsProvenance = unavailable(MethodDNSQuery, resolverNames(s.dns.Resolvers), err)
+		}
+		result.DNS = dns
+		provenance.DNS = &dnsProvenance
+		if ctx.Err() != nil {
+			return abortTest(ctx, PhaseDNS, result)
+		}
+	}
 
-	// Make the request
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+	if !plan.runs(PhaseDownload) && !plan.runs(PhaseUpload) {
+		return nil
 	}
-	resp, err := client.Get(url)
+
+	// Both throughput phases share one client pinned to the requested
+	// protocol, and the result records the protocol the server answered with
+	client, err := newProtocolClient(plan.Protocol, "", server)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	defer client.close()
+	prober := s.serverProber(server, client, plan, progress)
+	fallback := publicProber(measure.PingTCPConnect)
+
+	// Measure the idle RTT to the test server as the baseline for loaded
+	// latency
+	idle := s.probeServer(ctx, server)
+
+	// Measure download speed, probing latency while the link is loaded
+	var downloadRTTs []float64
+	if plan.runs(PhaseDownload) {
+		progress.emit(ProgressEvent{Type: EventPhase, Phase: PhaseDownload, Server: &result.Server})
+		probe := startLatencyProbe(ctx, server)
+		download, downloadProvenance, err := measureWithFallback(ctx, plan.strict,
+			measurement[measure.Throughput]{method: MethodHTTPDownload, server: server.URL, measure: prober.Download},
+			measurement[measure.Throughput]{method: MethodSmallFiles, server: strings.Join(alternativeDownloadURLs, ","), measure: fallback.Download},
+		)
+		downloadRTTs = probe.stop()
+		provenance.Download = downloadProvenance
+		if ctx.Err() != nil {
+			return abortTest(ctx, PhaseDownload, result)
+		}
+		applyThroughput(result, PhaseDownload, download)
+		if err != nil {
+			return fmt.Errorf("download phase failed: %w", err)
+		}
 	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	totalBytes := 0
-	buf := make([]byte, 1024*16) // 16KB buffer for faster reading
-	for {
-		n, err := resp.Body.Read(buf)
-		totalBytes += n
+
+	// Measure upload speed, probing latency while the link is loaded
+	var uploadRTTs []float64
+	if plan.runs(PhaseUpload) {
+		progress.emit(ProgressEvent{Type: EventPhase, Phase: PhaseUpload, Server: &result.Server})
+		probe := startLatencyProbe(ctx, server)
+		upload, uploadProvenance, err := measureWithFallback(ctx, plan.strict,
+			measurement[measure.Throughput]{method: MethodHTTPUpload, server: server.URL, measure: prober.Upload},
+			measurement[measure.Throughput]{method: MethodEchoUpload, server: strings.Join(alternativeUploadURLs, ","), measure: fallback.Upload},
+		)
+		uploadRTTs = probe.stop()
+		provenance.Upload = uploadProvenance
+		if ctx.Err() != nil {
+			return abortTest(ctx, PhaseUpload, result)
+		}
+		applyThroughput(result, PhaseUpload, upload)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return 0, err
+			return fmt.Errorf("upload phase failed: %w", err)
 		}
 	}
 
-	// Calculate elapsed time
-	elapsed := time.Since(start)
-	elapsedSeconds := elapsed.Seconds()
+	// A result without any of the requested speeds is not worth saving
+	if provenance.Download.Source != models.SourcePrimary && provenance.Download.Source != models.SourceAlternative &&
+		provenance.Upload.Source != models.SourcePrimary && provenance.Upload.Source != models.SourceAlternative {
+		return fmt.Errorf("throughput phases failed: %s", strings.Trim(provenance.Download.Error+"; "+provenance.Upload.Error, "; "))
+	}
 
-	// Calculate speed in Mbps (Megabits per second)
-	// 1 byte = 8 bits, 1 Megabit = 1,000,000 bits
-	speedMbps := (float64(totalBytes) * 8 / 1000000) / elapsedSeconds
-	return speedMbps, nil
+	loaded, loadedProvenance := loadedLatency(server, idle, provenance, downloadRTTs, uploadRTTs)
+	result.LoadedLatency = loaded
+	result.BufferbloatGrade = bufferbloatGrade(loaded)
+	provenance.LoadedLatency = &loadedProvenance
+	return nil
 }
 
-// measureMultiConnectionDownloadSpeed measures download speed using multiple connections
-func (s *SpeedTestService) measureMultiConnectionDownloadSpeed() (float64, error) {
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-	var totalBytes int
-	var errors []error
-	
-	// Use multiple connections to different servers
-	numConnections := 4
-	fileSize := 10000000 // 10MB per connection
-	
-	startTime := time.Now()
-	
-	for i := 0; i < numConnections; i++ {
-		wg.Add(1)
-		go func(connID int) {
-			defer wg.Done()
-			
-			// Select a test server based on connection ID
-			serverIndex := connID % len(testServers)
-			url := fmt.Sprintf("%s/__down?bytes=%d", testServers[serverIndex].URL, fileSize)
-			
-			// Use a custom client with appropriate timeouts
-			client := &http.Client{
-				Timeout: 20 * time.Second,
-			}
-			
-			resp, err := client.Get(url)
-			if err != nil {
-				mu.Lock()
-				errors = append(errors, err)
-				mu.Unlock()
-				return
-			}
-			defer resp.Body.Close()
-			
-			// Read the response body
-			buf := make([]byte, 1024*16)
-			connBytes := 0
-			
-			for {
-				n, err := resp.Body.Read(buf)
-				if n > 0 {
-					mu.Lock()
-					totalBytes += n
-					connBytes += n
-					mu.Unlock()
-				}
-				
-				if err != nil {
-					if err != io.EOF {
-						mu.Lock()
-						errors = append(errors, err)
-						mu.Unlock()
-					}
-					break
-				}
-			}
-		}(i)
-	}
-	
-	wg.Wait()
-	
-	// If all connections failed, return an error
-	if len(errors) == numConnections {
-		return 0, fmt.Errorf("all download connections failed")
+// publicProber returns the prober of the public internet endpoints, pinging
+// with pingMethod. It is the fallback when the test server cannot be used.
+func publicProber(pingMethod string) *measure.PublicProber {
+	hosts := pingHosts
+	if pingMethod == measure.PingHTTPHead {
+		hosts = alternativePingHosts
+	}
+	return &measure.PublicProber{
+		PingHosts:    hosts,
+		PingMethod:   pingMethod,
+		PingCount:    publicPingCount,
+		PingInterval: publicPingInterval,
+		DownloadURLs: alternativeDownloadURLs,
+		UploadURLs:   alternativeUploadURLs,
+		UploadBytes:  alternativeUploadBytes,
+		Transport:    sharedClient.Transport,
+		Dialer:       &net.Dialer{Timeout: 2 * time.Second},
 	}
-	
-	// Calculate elapsed time
-	elapsed := time.Since(startTime)
-	elapsedSeconds := elapsed.Seconds()
-	
-	// Calculate speed in Mbps
-	speedMbps := (float64(totalBytes) * 8 / 1000000) / elapsedSeconds
-	return speedMbps, nil
 }
 
-// measureAlternativeDownloadSpeed tries alternative download sources
-func (s *SpeedTestService) measureAlternativeDownloadSpeed() (float64, error) {
-	// Try different download sources in case the primary one fails
-	alternativeUrls := []string{
-		"https://www.google.com/images/branding/googlelogo/1x/googlelogo_color_272x92dp.png",
-		"https://www.microsoft.com/favicon.ico",
-		"https://speed.cloudflare.com/__down?bytes=1000000",
-	}
-	
-	var speeds []float64
-	
-	for _, url := range alternativeUrls {
-		start := time.Now()
-		
-		resp, err := http.Get(url)
-		if err != nil {
-			continue
-		}
-		
-		totalBytes := 0
-		buf := make([]byte, 1024*8)
-		
-		for {
-			n, err := resp.Body.Read(buf)
-			totalBytes += n
-			if err != nil {
-				if err != io.EOF {
-					resp.Body.Close()
-					break
-				}
-				resp.Body.Close()
-				break
-			}
-		}
-		
-		elapsed := time.Since(start)
-		elapsedSeconds := elapsed.Seconds()
-		
-		if totalBytes > 0 && elapsedSeconds > 0 {
-			speedMbps := (float64(totalBytes) * 8 / 1000000) / elapsedSeconds
-			speeds = append(speeds, speedMbps)
+// abortTest marks result as aborted by the cancellation of ctx during phase.
+// Phases that had not run yet are recorded as unavailable.
+func abortTest(ctx context.Context, phase string, result *models.SpeedTestResult) error {
+	result.Aborted = true
+	err := fmt.Errorf("%w during %s phase: %v", ErrTestAborted, phase, ctx.Err())
+	for _, provenance := range []*models.Provenance{&result.Provenance.Latency, &result.Provenance.Download, &result.Provenance.Upload} {
+		if provenance.Source == "" {
+			*provenance = unavailable("", "", err)
 		}
 	}
-	
-	if len(speeds) == 0 {
-		return 0, fmt.Errorf("all alternative download tests failed")
-	}
-	
-	// Sort speeds and take the median for more reliable results
-	sort.Float64s(speeds)
-	medianSpeed := speeds[len(speeds)/2]
-	
-	// Scale the result to better approximate a full bandwidth test
-	// This is a heuristic based on the small file sizes used in the alternative test
-	return medianSpeed * 1.5, nil
+	return err
 }
 
-// measureUploadSpeed measures the upload speed
-func (s *SpeedTestService) measureUploadSpeed() (float64, error) {
-	// Use a service that accepts uploads for testing
-	url := "https://speed.cloudflare.com/__up"
-	
-	// Create a random payload (5MB)
-	payloadSize := 5 * 1024 * 1024 // 5MB
-	payload := make([]byte, payloadSize)
-	rand.Read(payload)
-
-	// Start timing
-	start := time.Now()
-
-	// Create the request
-	req, err := http.NewRequest("POST", url, io.NopCloser(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), int64(payloadSize))))
-	if err != nil {
-		return 0, err
-	}
-	req.ContentLength = int64(payloadSize)
-	req.Header.Set("Content-Type", "application/octet-stream")
-
-	// Send the request
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return 0, err
-	}
-	defer resp.Body.Close()
+// applyLatency copies latency statistics onto a result
+func applyLatency(result *models.SpeedTestResult, latency measure.LatencyStats) {
+	result.Ping = latency.Mean
+	result.Jitter = latency.Jitter
+	result.PingMin = latency.Min
+	result.PingMax = latency.Max
+	result.PingMedian = latency.Median
+	result.PingP95 = latency.P95
+	result.RTTSamples = latency.Samples
+}
 
-	// Calculate elapsed time
-	elapsed := time.Since(start)
-	elapsedSeconds := elapsed.Seconds()
+// ListTestServers returns every registered test server, including disabled ones
+func (s *SpeedTestService) ListTestServers(ctx context.Context) ([]TestServer, error) {
+	return s.serverRegistry.List(ctx)
+}
 
-	// Calculate speed in Mbps (Megabits per second)
-	speedMbps := (float64(payloadSize) * 8 / 1000000) / elapsedSeconds
-	return speedMbps, nil
+// AddTestServer registers a new test server
+func (s *SpeedTestService) AddTestServer(ctx context.Context, server TestServer) error {
+	return s.serverRegistry.Add(ctx, server)
 }
 
-// measureMultiConnectionUploadSpeed measures upload speed using multiple connections
-func (s *SpeedTestService) measureMultiConnectionUploadSpeed() (float64, error) {
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-	var totalBytes int
-	var errors []error
-	
-	// Use multiple connections
-	numConnections := 4
-	payloadSize := 2 * 1024 * 1024 // 2MB per connection
-	
-	startTime := time.Now()
-	
-	for i := 0; i < numConnections; i++ {
-		wg.Add(1)
-		go func(connID int) {
-			defer wg.Done()
-			
-			// Select a test server based on connection ID
-			serverIndex := connID % len(testServers)
-			url := fmt.Sprintf("%s/__up", testServers[serverIndex].URL)
-			
-			// Create random payload
-			payload := make([]byte, payloadSize)
-			rand.Read(payload)
-			
-			// Create request
-			req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
-			if err != nil {
-				mu.Lock()
-				errors = append(errors, err)
-				mu.Unlock()
-				return
-			}
-			
-			req.ContentLength = int64(payloadSize)
-			req.Header.Set("Content-Type", "application/octet-stream")
-			
-			// Send request
-			client := &http.Client{
-				Timeout: 20 * time.Second,
-			}
-			
-			resp, err := client.Do(req)
-			if err != nil {
-				mu.Lock()
-				errors = append(errors, err)
-				mu.Unlock()
-				return
-			}
-			defer resp.Body.Close()
-			
-			// Record bytes sent
-			mu.Lock()
-			totalBytes += payloadSize
-			mu.Unlock()
-			
-			// Drain response body
-			io.Copy(io.Discard, resp.Body)
-		}(i)
-	}
-	
-	wg.Wait()
-	
-	// If all connections failed, return an error
-	if len(errors) == numConnections {
-		return 0, fmt.Errorf("all upload connections failed")
-	}
-	
-	// Calculate elapsed time
-	elapsed := time.Since(startTime)
-	elapsedSeconds := elapsed.Seconds()
-	
-	// Calculate speed in Mbps
-	speedMbps := (float64(totalBytes) * 8 / 1000000) / elapsedSeconds
-	return speedMbps, nil
+// SetTestServerDisabled enables or disables a registered test server
+func (s *SpeedTestService) SetTestServerDisabled(ctx context.Context, id string, disabled bool) error {
+	return s.serverRegistry.SetDisabled(ctx, id, disabled)
 }
 
-// measureAlternativeUploadSpeed tries alternative upload methods
-func (s *SpeedTestService) measureAlternativeUploadSpeed() (float64, error) {
-	// Try different upload endpoints in case the primary one fails
-	alternativeUrls := []string{
-		"https://httpbin.org/post",
-		"https://postman-echo.com/post",
-	}
-	
-	var speeds []float64
-	
-	for _, url := range alternativeUrls {
-		// Create smaller payload for alternative test
-		payloadSize := 1 * 1024 * 1024 // 1MB
-		payload := make([]byte, payloadSize)
-		rand.Read(payload)
-		
-		start := time.Now()
-		
-		req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
-		if err != nil {
-			continue
-		}
-		
-		req.ContentLength = int64(payloadSize)
-		req.Header.Set("Content-Type", "application/octet-stream")
-		
-		client := &http.Client{
-			Timeout: 15 * time.Second,
-		}
-		
-		resp, err := client.Do(req)
-		if err != nil {
-			continue
-		}
-		
-		io.Copy(io.Discard, resp.Body)
-		resp.Body.Close()
-		
-		elapsed := time.Since(start)
-		elapsedSeconds := elapsed.Seconds()
-		
-		if elapsedSeconds > 0 {
-			speedMbps := (float64(payloadSize) * 8 / 1000000) / elapsedSeconds
-			speeds = append(speeds, speedMbps)
-		}
-	}
-	
-	if len(speeds) == 0 {
-		return 0, fmt.Errorf("all alternative upload tests failed")
-	}
-	
-	// Sort speeds and take the median for more reliable results
-	sort.Float64s(speeds)
-	medianSpeed := speeds[len(speeds)/2]
-	
-	// Scale the result to better approximate a full bandwidth test
-	return medianSpeed * 1.5, nil
+// RemoveTestServer removes a test server from the registry
+func (s *SpeedTestService) RemoveTestServer(ctx context.Context, id string) error {
+	return s.serverRegistry.Remove(ctx, id)
 }
 
 // GetUserTestHistory retrieves the speed test history for a user
@@ -0,0 +1,45 @@
+//go:build linux
+
+package services
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// readTCPInfo returns the kernel's TCP_INFO statistics for conn
+func readTCPInfo(conn net.Conn) (*tcpInfo, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("connection does not expose a file descriptor")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var info *unix.TCPInfo
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+
+	return &tcpInfo{
+		BytesAcked:    int64(info.Bytes_acked),
+		BytesReceived: int64(info.Bytes_received),
+		BytesSent:     int64(info.Bytes_sent),
+		BytesRetrans:  int64(info.Bytes_retrans),
+		MinRTT:        int64(info.Min_rtt),
+		RTT:           int64(info.Rtt),
+		RTTVar:        int64(info.Rttvar),
+	}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package services
+
+import (
+	"errors"
+	"net"
+)
+
+// readTCPInfo is only supported on Linux
+func readTCPInfo(conn net.Conn) (*tcpInfo, error) {
+	return nil, errors.New("TCP_INFO is not supported on this platform")
+}
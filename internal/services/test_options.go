@@ -0,0 +1,454 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Names of the built-in test presets
+const (
+	PresetQuick    = "quick"
+	PresetStandard = "standard"
+	PresetThorough = "thorough"
+	PresetLite     = "lite"
+)
+
+// Limits on the options a client may request
+const (
+	maxTestDuration     = time.Minute
+	maxStreams          = 16
+	minRequestBytes     = 64 * 1024
+	maxDownloadRequest  = 1 << 30   // 1GB, the /__down limit of this backend
+	maxUploadRequest    = 256 << 20 // 256MB, the /__up limit of this backend
+	defaultStreamsCount = 4
+)
+
+var (
+	// ErrInvalidOptions is returned when test options are out of range or
+	// name an unknown preset
+	ErrInvalidOptions = errors.New("invalid test options")
+
+	// ErrPresetNotFound is returned when a test preset name is not registered
+	ErrPresetNotFound = errors.New("test preset not found")
+
+	// ErrPresetRequired is returned when removing the default preset
+	ErrPresetRequired = errors.New("the standard preset cannot be removed")
+)
+
+// TestOptions configures a single speed test. Zero fields take their value
+// from the preset, and then from the service defaults.
+type TestOptions struct {
+	// Preset is the name of the preset the options start from. Empty means
+	// the standard preset.
+	Preset string `json:"preset,omitempty"`
+	// ServerID is the test server to use. Empty means the nearest server.
+	ServerID string `json:"server,omitempty"`
+	// Strict fails the test instead of falling back to alternative methods.
+	// The flags are pointers so that false can override a preset's true.
+	Strict *bool `json:"strict,omitempty"`
+	// Phases lists the phases to run. Empty means every phase the server
+	// supports except the DNS benchmark, which only runs when listed.
+	Phases []string `json:"phases,omitempty"`
+	// DurationMs and WarmUpMs time each throughput phase
+	DurationMs int `json:"duration_ms,omitempty"`
+	WarmUpMs   int `json:"warmup_ms,omitempty"`
+	// DownloadStreams and UploadStreams are the parallel connections used
+	DownloadStreams int `json:"download_streams,omitempty"`
+	UploadStreams   int `json:"upload_streams,omitempty"`
+	// AdaptiveStreams starts each phase with one stream and adds streams
+	// while the throughput keeps growing, up to MaxStreams. The fixed stream
+	// counts are ignored.
+	AdaptiveStreams *bool `json:"adaptive_streams,omitempty"`
+	MaxStreams      int   `json:"max_streams,omitempty"`
+	// DownloadRequestBytes and UploadRequestBytes size each HTTP request
+	DownloadRequestBytes int64 `json:"download_request_bytes,omitempty"`
+	UploadRequestBytes   int64 `json:"upload_request_bytes,omitempty"`
+	// Protocol pins the throughput phases to ProtocolHTTP1, ProtocolHTTP2 or
+	// ProtocolHTTP3. Empty negotiates whatever the server offers.
+	Protocol string `json:"protocol,omitempty"`
+	// DualStack repeats the latency and throughput phases over IPv4 and IPv6
+	// after the regular phases, to compare the two paths
+	DualStack *bool `json:"dual_stack,omitempty"`
+}
+
+// TestPreset is a named set of test options
+type TestPreset struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Options     TestOptions `json:"options"`
+}
+
+// DefaultTestPresets returns the built-in test presets
+func DefaultTestPresets() []TestPreset {
+	return []TestPreset{
+		{Name: PresetQuick, Description: "Short test of latency and throughput",
+			Options: TestOptions{Phases: []string{PhaseLatency, PhaseDownload, PhaseUpload}, DurationMs: 5000, WarmUpMs: 1000}},
+		{Name: PresetStandard, Description: "Every phase with the default timing",
+			Options: TestOptions{}},
+		{Name: PresetThorough, Description: "Longer phases that add streams until fast links are saturated",
+			Options: TestOptions{DurationMs: 20000, WarmUpMs: 3000, AdaptiveStreams: Bool(true)}},
+		{Name: PresetLite, Description: "Single stream with small requests for metered connections",
+			Options: TestOptions{Phases: []string{PhaseLatency, PhaseDownload, PhaseUpload}, DurationMs: 5000, WarmUpMs: 1000,
+				DownloadStreams: 1, UploadStreams: 1, DownloadRequestBytes: 1 << 20, UploadRequestBytes: 512 << 10}},
+	}
+}
+
+// Bool returns a pointer to b, for the flags of TestOptions
+func Bool(b bool) *bool {
+	return &b
+}
+
+// enabled reports whether a flag of TestOptions is set to true
+func enabled(flag *bool) bool {
+	return flag != nil && *flag
+}
+
+// overlay returns base with every non-zero field of o applied on top. A flag
+// set to false counts as non-zero, so it turns off a flag of base.
+func (o TestOptions) overlay(base TestOptions) TestOptions {
+	if o.ServerID != "" {
+		base.ServerID = o.ServerID
+	}
+	if o.Strict != nil {
+		base.Strict = o.Strict
+	}
+	if len(o.Phases) > 0 {
+		base.Phases = o.Phases
+	}
+	if o.DurationMs != 0 {
+		base.DurationMs = o.DurationMs
+	}
+	if o.WarmUpMs != 0 {
+		base.WarmUpMs = o.WarmUpMs
+	}
+	if o.DownloadStreams != 0 {
+		base.DownloadStreams = o.DownloadStreams
+	}
+	if o.UploadStreams != 0 {
+		base.UploadStreams = o.UploadStreams
+	}
+	if o.AdaptiveStreams != nil {
+		base.AdaptiveStreams = o.AdaptiveStreams
+	}
+	if o.MaxStreams != 0 {
+		base.MaxStreams = o.MaxStreams
+	}
+	if o.DownloadRequestBytes != 0 {
+		base.DownloadRequestBytes = o.DownloadRequestBytes
+	}
+	if o.UploadRequestBytes != 0 {
+		base.UploadRequestBytes = o.UploadRequestBytes
+	}
+	if o.Protocol != "" {
+		base.Protocol = o.Protocol
+	}
+	if o.DualStack != nil {
+		base.DualStack = o.DualStack
+	}
+	return base
+}
+
+// validate checks that the options are within the limits of this backend
+func (o TestOptions) validate() error {
+	for _, phase := range o.Phases {
+		switch phase {
+		case PhaseLatency, PhasePacketLoss, PhaseDNS, PhaseDownload, PhaseUpload:
+		default:
+			return fmt.Errorf("unknown phase %q", phase)
+		}
+	}
+	if o.DurationMs < 0 || time.Duration(o.DurationMs)*time.Millisecond > maxTestDuration {
+		return fmt.Errorf("duration must not exceed %s", maxTestDuration)
+	}
+	if o.WarmUpMs < 0 {
+		return fmt.Errorf("warm-up must not be negative")
+	}
+	if o.DownloadStreams < 0 || o.DownloadStreams > maxStreams || o.UploadStreams < 0 || o.UploadStreams > maxStreams ||
+		o.MaxStreams < 0 || o.MaxStreams > maxStreams {
+		return fmt.Errorf("stream count must be between 0 (default) and %d", maxStreams)
+	}
+	if o.DownloadRequestBytes != 0 && (o.DownloadRequestBytes < minRequestBytes || o.DownloadRequestBytes > maxDownloadRequest) {
+		return fmt.Errorf("download request size must be between %d and %d bytes", minRequestBytes, maxDownloadRequest)
+	}
+	if o.UploadRequestBytes != 0 && (o.UploadRequestBytes < minRequestBytes || o.UploadRequestBytes > maxUploadRequest) {
+		return fmt.Errorf("upload request size must be between %d and %d bytes", minRequestBytes, maxUploadRequest)
+	}
+	switch o.Protocol {
+	case "", ProtocolHTTP1, ProtocolHTTP2, ProtocolHTTP3:
+	default:
+		return fmt.Errorf("unknown protocol %q", o.Protocol)
+	}
+	return nil
+}
+
+// testPlan is a fully resolved set of test options
+type testPlan struct {
+	TestOptions
+	throughput ThroughputConfig
+	// strict, adaptiveStreams and dualStack are the resolved flags
+	strict          bool
+	adaptiveStreams bool
+	dualStack       bool
+}
+
+// runs reports whether the plan includes the given phase
+func (p testPlan) runs(phase string) bool {
+	if len(p.Phases) == 0 {
+		return phase != PhaseDNS
+	}
+	for _, included := range p.Phases {
+		if included == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// downloadStreams returns the stream count of the download phase, which is
+// the cap in adaptive mode
+func (p testPlan) downloadStreams() int {
+	if p.adaptiveStreams {
+		return p.MaxStreams
+	}
+	return p.DownloadStreams
+}
+
+// uploadStreams returns the stream count of the upload phase, which is the
+// cap in adaptive mode
+func (p testPlan) uploadStreams() int {
+	if p.adaptiveStreams {
+		return p.MaxStreams
+	}
+	return p.UploadStreams
+}
+
+// resolveOptions applies opts on top of its preset and the service defaults
+func (s *SpeedTestService) resolveOptions(opts TestOptions) (testPlan, error) {
+	name := opts.Preset
+	if name == "" {
+		name = PresetStandard
+	}
+	preset, err := s.presets.get(name)
+	if err != nil {
+		return testPlan{}, fmt.Errorf("%w: %v", ErrInvalidOptions, err)
+	}
+	if err := opts.validate(); err != nil {
+		return testPlan{}, fmt.Errorf("%w: %v", ErrInvalidOptions, err)
+	}
+
+	plan := testPlan{TestOptions: opts.overlay(preset.Options), throughput: s.throughput}
+	plan.Preset = name
+	plan.strict = enabled(plan.Strict)
+	plan.adaptiveStreams = enabled(plan.AdaptiveStreams)
+	plan.dualStack = enabled(plan.DualStack)
+	if plan.DurationMs != 0 {
+		plan.throughput.Duration = time.Duration(plan.DurationMs) * time.Millisecond
+	}
+	if plan.WarmUpMs != 0 {
+		plan.throughput.WarmUp = time.Duration(plan.WarmUpMs) * time.Millisecond
+	}
+	if err := plan.throughput.Validate(); err != nil {
+		return testPlan{}, fmt.Errorf("%w: %v", ErrInvalidOptions, err)
+	}
+	if plan.DownloadStreams == 0 {
+		plan.DownloadStreams = defaultStreamsCount
+	}
+	if plan.UploadStreams == 0 {
+		plan.UploadStreams = defaultStreamsCount
+	}
+	if plan.MaxStreams == 0 {
+		plan.MaxStreams = maxStreams
+	}
+	if plan.DownloadRequestBytes == 0 {
+		plan.DownloadRequestBytes = downloadRequestBytes
+	}
+	if plan.UploadRequestBytes == 0 {
+		plan.UploadRequestBytes = uploadRequestBytes
+	}
+	return plan, nil
+}
+
+// presetStore holds the test presets in memory and, if it has a path,
+// writes every change back to a JSON file so it survives restarts
+type presetStore struct {
+	mu      sync.RWMutex
+	path    string
+	presets map[string]TestPreset
+}
+
+func newPresetStore(presets []TestPreset) *presetStore {
+	return &presetStore{presets: presetMap(presets)}
+}
+
+// presetMap indexes presets by name
+func presetMap(presets []TestPreset) map[string]TestPreset {
+	m := make(map[string]TestPreset, len(presets))
+	for _, preset := range presets {
+		m[preset.Name] = preset
+	}
+	return m
+}
+
+// loadPresetStore loads the presets from path. If the file does not exist it
+// is created with the given default presets. A file with an invalid or
+// duplicate preset fails to load.
+func loadPresetStore(path string, defaults []TestPreset) (*presetStore, error) {
+	store := &presetStore{path: path}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		var presets []TestPreset
+		if err := json.Unmarshal(data, &presets); err != nil {
+			return nil, fmt.Errorf("failed to parse test preset file %s: %w", path, err)
+		}
+		store.presets = make(map[string]TestPreset, len(presets))
+		for _, preset := range presets {
+			if err := preset.validate(); err != nil {
+				return nil, fmt.Errorf("test preset file %s: %w", path, err)
+			}
+			if _, ok := store.presets[preset.Name]; ok {
+				return nil, fmt.Errorf("test preset file %s: duplicate preset %q", path, preset.Name)
+			}
+			store.presets[preset.Name] = preset
+		}
+		if _, ok := store.presets[PresetStandard]; !ok {
+			return nil, fmt.Errorf("test preset file %s has no %s preset", path, PresetStandard)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		store.presets = presetMap(defaults)
+		if err := store.write(store.presets); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("failed to read test preset file %s: %w", path, err)
+	}
+	return store, nil
+}
+
+// sorted returns the presets ordered by name
+func sorted(presets map[string]TestPreset) []TestPreset {
+	list := make([]TestPreset, 0, len(presets))
+	for _, preset := range presets {
+		list = append(list, preset)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (p *presetStore) list() []TestPreset {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return sorted(p.presets)
+}
+
+func (p *presetStore) get(name string) (TestPreset, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	preset, ok := p.presets[name]
+	if !ok {
+		return TestPreset{}, fmt.Errorf("%w: %s", ErrPresetNotFound, name)
+	}
+	return preset, nil
+}
+
+// validate checks that the preset is named, not based on another preset and
+// has valid options
+func (t TestPreset) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("test preset name is required")
+	}
+	if t.Options.Preset != "" {
+		return fmt.Errorf("a preset cannot be based on another preset")
+	}
+	return t.Options.validate()
+}
+
+func (p *presetStore) save(preset TestPreset) error {
+	if err := preset.validate(); err != nil {
+		return err
+	}
+	return p.update(func(presets map[string]TestPreset) error {
+		presets[preset.Name] = preset
+		return nil
+	})
+}
+
+func (p *presetStore) remove(name string) error {
+	if name == PresetStandard {
+		return ErrPresetRequired
+	}
+	return p.update(func(presets map[string]TestPreset) error {
+		if _, ok := presets[name]; !ok {
+			return fmt.Errorf("%w: %s", ErrPresetNotFound, name)
+		}
+		delete(presets, name)
+		return nil
+	})
+}
+
+// update applies change to a copy of the presets and swaps the copy in once
+// it has been written, so a failed write leaves the presets as they are
+func (p *presetStore) update(change func(map[string]TestPreset) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	next := maps.Clone(p.presets)
+	if err := change(next); err != nil {
+		return err
+	}
+	if err := p.write(next); err != nil {
+		return err
+	}
+	p.presets = next
+	return nil
+}
+
+// write saves presets to the store's file, if it has one
+func (p *presetStore) write(presets map[string]TestPreset) error {
+	if p.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(sorted(presets), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(p.path, data); err != nil {
+		return fmt.Errorf("failed to save test presets: %w", err)
+	}
+	return nil
+}
+
+// LoadTestPresets keeps the test presets in the JSON file at path, which is
+// created with the built-in presets if it does not exist. Every change is
+// written back to the file.
+func (s *SpeedTestService) LoadTestPresets(path string) error {
+	store, err := loadPresetStore(path, DefaultTestPresets())
+	if err != nil {
+		return err
+	}
+	s.presets = store
+	return nil
+}
+
+// ListTestPresets returns every test preset ordered by name
+func (s *SpeedTestService) ListTestPresets(ctx context.Context) []TestPreset {
+	return s.presets.list()
+}
+
+// SaveTestPreset adds a test preset or replaces the one with the same name
+func (s *SpeedTestService) SaveTestPreset(ctx context.Context, preset TestPreset) error {
+	return s.presets.save(preset)
+}
+
+// RemoveTestPreset deletes a test preset. The standard preset cannot be
+// removed because it is the default.
+func (s *SpeedTestService) RemoveTestPreset(ctx context.Context, name string) error {
+	return s.presets.remove(name)
+}
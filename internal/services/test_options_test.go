@@ -0,0 +1,101 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveOptionsFlags(t *testing.T) {
+	service := NewSpeedTestService(nil, nil, NewInMemoryTestServerRegistry())
+
+	for _, tc := range []struct {
+		name string
+		opts TestOptions
+		want bool
+	}{
+		{"preset flag", TestOptions{Preset: PresetThorough}, true},
+		{"turned off", TestOptions{Preset: PresetThorough, AdaptiveStreams: Bool(false)}, false},
+		{"turned on", TestOptions{Preset: PresetQuick, AdaptiveStreams: Bool(true)}, true},
+		{"unset", TestOptions{Preset: PresetQuick}, false},
+	} {
+		plan, err := service.resolveOptions(tc.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if plan.adaptiveStreams != tc.want {
+			t.Errorf("%s: adaptive streams %v; want %v", tc.name, plan.adaptiveStreams, tc.want)
+		}
+	}
+}
+
+func TestLoadTestPresetsPersistsChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "presets.json")
+	ctx := context.Background()
+
+	service := NewSpeedTestService(nil, nil, NewInMemoryTestServerRegistry())
+	if err := service.LoadTestPresets(path); err != nil {
+		t.Fatal(err)
+	}
+	custom := TestPreset{Name: "night", Options: TestOptions{DurationMs: 15000, Strict: Bool(true)}}
+	if err := service.SaveTestPreset(ctx, custom); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.RemoveTestPreset(ctx, PresetLite); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewSpeedTestService(nil, nil, NewInMemoryTestServerRegistry())
+	if err := restarted.LoadTestPresets(path); err != nil {
+		t.Fatal(err)
+	}
+	preset, err := restarted.presets.get("night")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preset.Options.DurationMs != 15000 || !enabled(preset.Options.Strict) {
+		t.Fatalf("reloaded preset %+v", preset)
+	}
+	if _, err := restarted.presets.get(PresetLite); !errors.Is(err, ErrPresetNotFound) {
+		t.Fatalf("removed preset is back: %v", err)
+	}
+	if _, err := restarted.presets.get(PresetStandard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadTestPresetsRejectsInvalidPresets(t *testing.T) {
+	const standard = `{"name":"standard","options":{}}`
+	for _, tc := range []struct {
+		name string
+		file string
+	}{
+		{"missing name", `[` + standard + `,{"options":{}}]`},
+		{"based on a preset", `[` + standard + `,{"name":"a","options":{"preset":"quick"}}]`},
+		{"unknown phase", `[` + standard + `,{"name":"a","options":{"phases":["video"]}}]`},
+		{"too many streams", `[` + standard + `,{"name":"a","options":{"download_streams":1000}}]`},
+		{"duplicate name", `[` + standard + `,` + standard + `]`},
+		{"no standard preset", `[{"name":"a","options":{}}]`},
+	} {
+		path := filepath.Join(t.TempDir(), "presets.json")
+		if err := os.WriteFile(path, []byte(tc.file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		service := NewSpeedTestService(nil, nil, NewInMemoryTestServerRegistry())
+		if err := service.LoadTestPresets(path); err == nil {
+			t.Errorf("%s: loaded", tc.name)
+		}
+	}
+}
+
+func TestDNSPhaseIsOptIn(t *testing.T) {
+	if plan := (testPlan{}); plan.runs(PhaseDNS) || !plan.runs(PhaseDownload) {
+		t.Fatal("a plan without phases must run every phase but the DNS benchmark")
+	}
+	plan := testPlan{TestOptions: TestOptions{Phases: []string{PhaseLatency, PhaseDNS}}}
+	if !plan.runs(PhaseDNS) || plan.runs(PhaseDownload) {
+		t.Fatal("a plan must run the listed phases")
+	}
+}
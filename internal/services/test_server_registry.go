@@ -0,0 +1,350 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/measure"
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+// Protocols a test server can speak for throughput measurements
+const (
+	ProtocolHTTP1 = measure.ProtocolHTTP1
+	ProtocolHTTP2 = measure.ProtocolHTTP2
+	ProtocolHTTP3 = measure.ProtocolHTTP3
+)
+
+var (
+	// ErrServerNotFound is returned when a test server ID is not registered
+	ErrServerNotFound = errors.New("test server not found")
+
+	// ErrServerExists is returned when adding a test server with a duplicate ID
+	ErrServerExists = errors.New("test server already exists")
+)
+
+// ServerCapabilities declares which measurement phases a test server supports
+type ServerCapabilities struct {
+	// Download means the server implements /__down?bytes=N
+	Download bool `json:"download"`
+	// Upload means the server implements /__up
+	Upload bool `json:"upload"`
+	// Latency means the server can be used for round-trip time probes
+	Latency bool `json:"latency"`
+	// Protocol is the highest HTTP protocol the server speaks
+	Protocol string `json:"protocol"`
+}
+
+// TestServer represents a speed test server
+type TestServer struct {
+	ID           string             `json:"id"`
+	Name         string             `json:"name"`
+	URL          string             `json:"url"`
+	Location     string             `json:"location"`
+	Capabilities ServerCapabilities `json:"capabilities"`
+	// UDPEchoAddress is the host:port of the server's UDP echo responder,
+	// used for packet loss measurements. Empty if it has none.
+	UDPEchoAddress string `json:"udp_echo_address,omitempty"`
+	// InsecureSkipVerify accepts any TLS certificate, for servers such as a
+	// local instance with a self-signed certificate
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+	Disabled           bool `json:"disabled"`
+}
+
+// Supports reports whether the server is enabled and supports the given phase
+func (t TestServer) Supports(phase string) bool {
+	if t.Disabled {
+		return false
+	}
+	switch phase {
+	case PhaseDownload:
+		return t.Capabilities.Download
+	case PhaseUpload:
+		return t.Capabilities.Upload
+	case PhaseLatency:
+		return t.Capabilities.Latency
+	case PhasePacketLoss:
+		return t.UDPEchoAddress != ""
+	}
+	return false
+}
+
+// info returns the public identity of the server, without the settings
+// only the backend needs
+func (t TestServer) info() models.TestServerInfo {
+	return models.TestServerInfo{ID: t.ID, Name: t.Name, URL: t.URL, Location: t.Location}
+}
+
+// validate checks that the server has the fields required to be registered
+func (t TestServer) validate() error {
+	if t.ID == "" {
+		return fmt.Errorf("test server id is required")
+	}
+	if t.URL == "" {
+		return fmt.Errorf("test server url is required")
+	}
+	if u, err := url.Parse(t.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("test server url %q must be an absolute http or https url", t.URL)
+	}
+	if t.UDPEchoAddress != "" {
+		if _, _, err := net.SplitHostPort(t.UDPEchoAddress); err != nil {
+			return fmt.Errorf("invalid udp echo address: %w", err)
+		}
+	}
+	switch t.Capabilities.Protocol {
+	case "", ProtocolHTTP1, ProtocolHTTP2, ProtocolHTTP3:
+	default:
+		return fmt.Errorf("unknown protocol %q", t.Capabilities.Protocol)
+	}
+	return nil
+}
+
+// DefaultTestServers returns the built-in list of test servers. Only servers
+// that implement /__down and /__up are marked as download and upload capable.
+// None of them runs a UDP echo responder, so the packet loss phase is skipped
+// until a server with a udp_echo_address is registered, such as another
+// instance of this backend, whose responder listens on UDP_ECHO_ADDR.
+func DefaultTestServers() []TestServer {
+	return []TestServer{
+		{ID: "cloudflare", Name: "Cloudflare", URL: "https://speed.cloudflare.com", Location: "Global CDN",
+			Capabilities: ServerCapabilities{Download: true, Upload: true, Latency: true, Protocol: ProtocolHTTP3}},
+		{ID: "turksat", Name: "Turksat", URL: "http://speedtest.turksat.com.tr", Location: "Ankara, Turkey",
+			Capabilities: ServerCapabilities{Latency: true, Protocol: ProtocolHTTP1}},
+		{ID: "turktelekom", Name: "Turk Telekom", URL: "http://speedtest.turktelekom.com.tr", Location: "Istanbul, Turkey",
+			Capabilities: ServerCapabilities{Latency: true, Protocol: ProtocolHTTP1}},
+		{ID: "google", Name: "Google", URL: "https://www.google.com", Location: "Global CDN",
+			Capabilities: ServerCapabilities{Latency: true, Protocol: ProtocolHTTP3}},
+		{ID: "microsoft", Name: "Microsoft", URL: "https://www.microsoft.com", Location: "Global CDN",
+			Capabilities: ServerCapabilities{Latency: true, Protocol: ProtocolHTTP2}},
+	}
+}
+
+// TestServerRegistry defines the interface for managing test servers
+type TestServerRegistry interface {
+	// List returns all registered test servers, including disabled ones
+	List(ctx context.Context) ([]TestServer, error)
+
+	// Get returns the test server with the given ID
+	Get(ctx context.Context, id string) (TestServer, error)
+
+	// Add registers a new test server
+	Add(ctx context.Context, server TestServer) error
+
+	// SetDisabled enables or disables a test server
+	SetDisabled(ctx context.Context, id string, disabled bool) error
+
+	// Remove deletes a test server from the registry
+	Remove(ctx context.Context, id string) error
+}
+
+// InMemoryTestServerRegistry is an in-memory implementation of TestServerRegistry
+type InMemoryTestServerRegistry struct {
+	mu      sync.RWMutex
+	servers []TestServer
+}
+
+// NewInMemoryTestServerRegistry creates a registry seeded with the given servers
+func NewInMemoryTestServerRegistry(servers ...TestServer) *InMemoryTestServerRegistry {
+	r := &InMemoryTestServerRegistry{}
+	r.servers = append(r.servers, servers...)
+	return r
+}
+
+func (r *InMemoryTestServerRegistry) List(ctx context.Context) ([]TestServer, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]TestServer(nil), r.servers...), nil
+}
+
+func (r *InMemoryTestServerRegistry) Get(ctx context.Context, id string) (TestServer, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	i := r.indexOf(id)
+	if i < 0 {
+		return TestServer{}, ErrServerNotFound
+	}
+	return r.servers[i], nil
+}
+
+func (r *InMemoryTestServerRegistry) Add(ctx context.Context, server TestServer) error {
+	if err := server.validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.indexOf(server.ID) >= 0 {
+		return ErrServerExists
+	}
+	r.servers = append(r.servers, server)
+	return nil
+}
+
+func (r *InMemoryTestServerRegistry) SetDisabled(ctx context.Context, id string, disabled bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.indexOf(id)
+	if i < 0 {
+		return ErrServerNotFound
+	}
+	r.servers[i].Disabled = disabled
+	return nil
+}
+
+func (r *InMemoryTestServerRegistry) Remove(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.indexOf(id)
+	if i < 0 {
+		return ErrServerNotFound
+	}
+	r.servers = append(r.servers[:i], r.servers[i+1:]...)
+	return nil
+}
+
+// indexOf returns the position of the server with the given ID, or -1.
+// The caller must hold the lock.
+func (r *InMemoryTestServerRegistry) indexOf(id string) int {
+	for i, server := range r.servers {
+		if server.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// FileTestServerRegistry is a TestServerRegistry persisted to a JSON file.
+// Every change is written back to disk so it survives restarts.
+type FileTestServerRegistry struct {
+	path   string
+	mu     sync.RWMutex
+	memory *InMemoryTestServerRegistry
+}
+
+// NewFileTestServerRegistry loads the registry from path. If the file does not
+// exist it is created with the given default servers. A file with an invalid
+// or duplicate server fails to load.
+func NewFileTestServerRegistry(path string, defaults []TestServer) (*FileTestServerRegistry, error) {
+	r := &FileTestServerRegistry{path: path}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		var servers []TestServer
+		if err := json.Unmarshal(data, &servers); err != nil {
+			return nil, fmt.Errorf("failed to parse test server file %s: %w", path, err)
+		}
+		r.memory = NewInMemoryTestServerRegistry()
+		for i, server := range servers {
+			if err := r.memory.Add(context.Background(), server); err != nil {
+				return nil, fmt.Errorf("test server file %s: server %d: %w", path, i+1, err)
+			}
+		}
+	case errors.Is(err, os.ErrNotExist):
+		r.memory = NewInMemoryTestServerRegistry(defaults...)
+		if err := r.save(context.Background(), r.memory); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("failed to read test server file %s: %w", path, err)
+	}
+
+	return r, nil
+}
+
+func (r *FileTestServerRegistry) List(ctx context.Context) ([]TestServer, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.memory.List(ctx)
+}
+
+func (r *FileTestServerRegistry) Get(ctx context.Context, id string) (TestServer, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.memory.Get(ctx, id)
+}
+
+func (r *FileTestServerRegistry) Add(ctx context.Context, server TestServer) error {
+	return r.update(ctx, func(servers *InMemoryTestServerRegistry) error {
+		return servers.Add(ctx, server)
+	})
+}
+
+func (r *FileTestServerRegistry) SetDisabled(ctx context.Context, id string, disabled bool) error {
+	return r.update(ctx, func(servers *InMemoryTestServerRegistry) error {
+		return servers.SetDisabled(ctx, id, disabled)
+	})
+}
+
+func (r *FileTestServerRegistry) Remove(ctx context.Context, id string) error {
+	return r.update(ctx, func(servers *InMemoryTestServerRegistry) error {
+		return servers.Remove(ctx, id)
+	})
+}
+
+// update applies change to a copy of the registry and swaps the copy in
+// once it has been saved, so a failed write leaves the registry as it is
+// on disk
+func (r *FileTestServerRegistry) update(ctx context.Context, change func(*InMemoryTestServerRegistry) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	servers, err := r.memory.List(ctx)
+	if err != nil {
+		return err
+	}
+	next := NewInMemoryTestServerRegistry(servers...)
+	if err := change(next); err != nil {
+		return err
+	}
+	if err := r.save(ctx, next); err != nil {
+		return err
+	}
+	r.memory = next
+	return nil
+}
+
+// save writes the given servers to the registry's file
+func (r *FileTestServerRegistry) save(ctx context.Context, memory *InMemoryTestServerRegistry) error {
+	servers, err := memory.List(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(servers, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(r.path, data); err != nil {
+		return fmt.Errorf("failed to save test servers: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so a crash never leaves a truncated file behind
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
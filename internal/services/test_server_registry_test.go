@@ -0,0 +1,74 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileTestServerRegistryKeepsStateOnFailedSave(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "registry")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	r, err := NewFileTestServerRegistry(filepath.Join(dir, "servers.json"), []TestServer{{ID: "a", URL: "http://a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without its directory the registry cannot be saved
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add(ctx, TestServer{ID: "b", URL: "http://b"}); err == nil {
+		t.Fatal("added a server that could not be saved")
+	}
+	if err := r.SetDisabled(ctx, "a", true); err == nil {
+		t.Fatal("disabled a server although the change could not be saved")
+	}
+	if err := r.Remove(ctx, "a"); err == nil {
+		t.Fatal("removed a server although the change could not be saved")
+	}
+
+	servers, err := r.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 || servers[0].ID != "a" || servers[0].Disabled {
+		t.Fatalf("registry holds %+v after failed saves", servers)
+	}
+}
+
+func TestFileTestServerRegistryRejectsInvalidServers(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		file string
+		want error
+	}{
+		{"missing url", `[{"id":"a"}]`, nil},
+		{"relative url", `[{"id":"a","url":"speed.example"}]`, nil},
+		{"unsupported scheme", `[{"id":"a","url":"ftp://speed.example"}]`, nil},
+		{"unknown protocol", `[{"id":"a","url":"http://a","capabilities":{"protocol":"spdy"}}]`, nil},
+		{"duplicate id", `[{"id":"a","url":"http://a"},{"id":"a","url":"http://b"}]`, ErrServerExists},
+	} {
+		path := filepath.Join(t.TempDir(), "servers.json")
+		if err := os.WriteFile(path, []byte(tc.file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := NewFileTestServerRegistry(path, nil)
+		if err == nil || (tc.want != nil && !errors.Is(err, tc.want)) {
+			t.Errorf("%s: loaded with error %v", tc.name, err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "servers.json")
+	if err := os.WriteFile(path, []byte(`[{"id":"a","url":"http://a"},{"id":"b","url":"https://b:8443"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileTestServerRegistry(path, nil); err != nil {
+		t.Fatal(err)
+	}
+}
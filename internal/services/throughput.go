@@ -0,0 +1,75 @@
+package services
+
+import (
+	"github.com/cetinibs/online-speed-test-backend-root/internal/measure"
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+const (
+	// downloadRequestBytes is the default size requested by each /__down
+	// call. Streams issue new requests until the phase duration has elapsed.
+	downloadRequestBytes = 25000000 // 25MB
+
+	// uploadRequestBytes is the default size of each /__up request body
+	uploadRequestBytes = 5 * 1024 * 1024 // 5MB
+)
+
+// ThroughputConfig controls how the download and upload phases are timed
+type ThroughputConfig = measure.ThroughputConfig
+
+// DefaultThroughputConfig returns the default throughput phase timing
+func DefaultThroughputConfig() ThroughputConfig {
+	return measure.DefaultThroughputConfig()
+}
+
+// serverProber returns the prober of the throughput phases of plan against
+// server. Requests are sent through client and every throughput sample is
+// reported to progress.
+func (s *SpeedTestService) serverProber(server TestServer, client *protocolClient, plan testPlan, progress ProgressFunc) *measure.ServerProber {
+	return &measure.ServerProber{
+		URL:                  server.URL,
+		Transport:            client.transport,
+		Pinger:               serverPinger(serverProbeCount),
+		Config:               plan.throughput,
+		DownloadStreams:      plan.downloadStreams(),
+		UploadStreams:        plan.uploadStreams(),
+		DownloadRequestBytes: plan.DownloadRequestBytes,
+		UploadRequestBytes:   plan.UploadRequestBytes,
+		Adaptive:             plan.adaptiveStreams,
+		OnSample: func(phase string, sample measure.Sample) {
+			progress.emit(ProgressEvent{
+				Type:      EventSample,
+				Phase:     phase,
+				ElapsedMs: measure.Millis(sample.Elapsed),
+				Mbps:      sample.Mbps,
+			})
+		},
+	}
+}
+
+// applyThroughput records how a throughput phase ran on result
+func applyThroughput(result *models.SpeedTestResult, phase string, throughput measure.Throughput) {
+	if throughput.Protocol != "" {
+		result.Protocol = throughput.Protocol
+	}
+	switch phase {
+	case PhaseDownload:
+		result.DownloadSpeed = throughput.Mbps
+		result.DownloadStreams, result.DownloadRamp = throughput.Streams, throughput.Ramp
+		if throughput.Trace != nil {
+			traces(result).Download = throughput.Trace
+		}
+		if throughput.Timings != nil {
+			connectionTimings(result).Download = throughput.Timings
+		}
+	case PhaseUpload:
+		result.UploadSpeed = throughput.Mbps
+		result.UploadStreams, result.UploadRamp = throughput.Streams, throughput.Ramp
+		if throughput.Trace != nil {
+			traces(result).Upload = throughput.Trace
+		}
+		if throughput.Timings != nil {
+			connectionTimings(result).Upload = throughput.Timings
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package services
+
+import "github.com/cetinibs/online-speed-test-backend-root/internal/models"
+
+// traces returns the traces of result, creating them if needed
+func traces(result *models.SpeedTestResult) *models.ResultTraces {
+	if result.Traces == nil {
+		result.Traces = &models.ResultTraces{}
+	}
+	return result.Traces
+}
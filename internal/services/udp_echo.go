@@ -0,0 +1,258 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+// UDP probe datagram layout, big endian:
+//
+//	0:4   magic "STUP"
+//	4:8   sequence number
+//	8:16  client send time, Unix nanoseconds
+//	16:24 server receive time, Unix nanoseconds, filled in by the responder
+//	24:   padding up to the configured packet size
+const (
+	udpHeaderSize     = 24
+	udpMaxPacketSize  = 1400
+	udpMaxProbeRate   = 1000
+	udpMaxProbeCount  = 10000
+	udpReplyGraceTime = time.Second
+)
+
+var udpMagic = []byte("STUP")
+
+// PacketLossConfig controls the UDP packet loss probe
+type PacketLossConfig struct {
+	// Rate is the number of datagrams sent per second
+	Rate int
+	// Count is the total number of datagrams sent
+	Count int
+	// PacketSize is the size of each datagram in bytes
+	PacketSize int
+}
+
+// DefaultPacketLossConfig returns the default UDP probe settings
+func DefaultPacketLossConfig() PacketLossConfig {
+	return PacketLossConfig{
+		Rate:       50,
+		Count:      200,
+		PacketSize: 64,
+	}
+}
+
+// validate checks that the configuration is within safe bounds
+func (c PacketLossConfig) validate() error {
+	if c.Rate <= 0 || c.Rate > udpMaxProbeRate {
+		return fmt.Errorf("probe rate must be between 1 and %d packets per second", udpMaxProbeRate)
+	}
+	if c.Count <= 0 || c.Count > udpMaxProbeCount {
+		return fmt.Errorf("probe count must be between 1 and %d", udpMaxProbeCount)
+	}
+	if c.PacketSize < udpHeaderSize || c.PacketSize > udpMaxPacketSize {
+		return fmt.Errorf("packet size must be between %d and %d bytes", udpHeaderSize, udpMaxPacketSize)
+	}
+	return nil
+}
+
+// UDPEchoResponder answers probe datagrams so clients can measure packet loss
+// against this backend. Datagrams without the probe header are ignored, and
+// replies are never larger than the request.
+type UDPEchoResponder struct {
+	conn net.PacketConn
+}
+
+// ListenUDPEcho starts listening for probe datagrams on addr
+func ListenUDPEcho(addr string) (*UDPEchoResponder, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPEchoResponder{conn: conn}, nil
+}
+
+// Addr returns the address the responder listens on
+func (r *UDPEchoResponder) Addr() net.Addr {
+	return r.conn.LocalAddr()
+}
+
+// Serve echoes probe datagrams until the responder is closed
+func (r *UDPEchoResponder) Serve() error {
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if n < udpHeaderSize || !bytes.Equal(buf[:4], udpMagic) {
+			continue
+		}
+
+		binary.BigEndian.PutUint64(buf[16:24], uint64(time.Now().UnixNano()))
+		r.conn.WriteTo(buf[:n], addr)
+	}
+}
+
+// Close stops the responder
+func (r *UDPEchoResponder) Close() error {
+	return r.conn.Close()
+}
+
+// udpReply is one echoed datagram as seen by the probe
+type udpReply struct {
+	seq     uint32
+	transit float64 // server receive time minus client send time, in ms
+}
+
+// measurePacketLoss sends sequenced, timestamped datagrams to the server's
+// UDP echo responder and reports loss, reordering, duplicates and the
+// one-way jitter of the client to server path. The probe stops early when
+// ctx is done.
+func (s *SpeedTestService) measurePacketLoss(ctx context.Context, server TestServer) (*models.PacketLossResult, error) {
+	cfg := s.packetLoss
+	if server.UDPEchoAddress == "" {
+		return nil, fmt.Errorf("test server %q has no UDP echo responder", server.ID)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server.UDPEchoAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	parent := ctx
+	interval := time.Second / time.Duration(cfg.Rate)
+	sendDuration := interval * time.Duration(cfg.Count)
+	ctx, cancel := context.WithTimeout(ctx, sendDuration+udpReplyGraceTime)
+	defer cancel()
+
+	// Unblock the read below as soon as the probe is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	// Send datagrams at the configured rate while replies are read below
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- sendProbes(ctx, conn, cfg, interval)
+	}()
+
+	var replies []udpReply
+	buf := make([]byte, udpMaxPacketSize)
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			// ICMP port unreachable and similar errors surface on reads;
+			// keep listening until the deadline
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if n < udpHeaderSize || !bytes.Equal(buf[:4], udpMagic) {
+			continue
+		}
+
+		sent := int64(binary.BigEndian.Uint64(buf[8:16]))
+		received := int64(binary.BigEndian.Uint64(buf[16:24]))
+		replies = append(replies, udpReply{
+			seq:     binary.BigEndian.Uint32(buf[4:8]),
+			transit: float64(received-sent) / float64(time.Millisecond),
+		})
+	}
+
+	if err := <-sendErr; err != nil {
+		return nil, err
+	}
+	if err := parent.Err(); err != nil {
+		return nil, err
+	}
+	return summarizeReplies(cfg.Count, replies), nil
+}
+
+// sendProbes writes cfg.Count datagrams spaced by interval
+func sendProbes(ctx context.Context, conn net.Conn, cfg PacketLossConfig, interval time.Duration) error {
+	packet := make([]byte, cfg.PacketSize)
+	copy(packet, udpMagic)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for seq := 0; seq < cfg.Count; seq++ {
+		binary.BigEndian.PutUint32(packet[4:8], uint32(seq))
+		binary.BigEndian.PutUint64(packet[8:16], uint64(time.Now().UnixNano()))
+		binary.BigEndian.PutUint64(packet[16:24], 0)
+		if _, err := conn.Write(packet); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// summarizeReplies computes loss statistics from the replies in the order
+// they arrived
+func summarizeReplies(sent int, replies []udpReply) *models.PacketLossResult {
+	result := &models.PacketLossResult{Sent: sent}
+
+	seen := make(map[uint32]bool, len(replies))
+	var unique []udpReply
+	var highest uint32
+	for i, reply := range replies {
+		if int(reply.seq) >= sent {
+			continue
+		}
+		if seen[reply.seq] {
+			result.Duplicates++
+			continue
+		}
+		seen[reply.seq] = true
+		if i > 0 && reply.seq < highest {
+			result.Reordered++
+		}
+		if reply.seq > highest {
+			highest = reply.seq
+		}
+		unique = append(unique, reply)
+	}
+
+	result.Received = len(unique)
+	result.LossPercent = float64(sent-len(unique)) / float64(sent) * 100
+
+	// One-way jitter is the mean absolute difference of the transit times of
+	// consecutive datagrams. Clock offset between client and server cancels
+	// out in the differences.
+	sort.Slice(unique, func(i, j int) bool { return unique[i].seq < unique[j].seq })
+	var diffSum float64
+	for i := 1; i < len(unique); i++ {
+		diffSum += math.Abs(unique[i].transit - unique[i-1].transit)
+	}
+	if len(unique) > 1 {
+		result.Jitter = diffSum / float64(len(unique)-1)
+	}
+	return result
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"net"
+	"testing"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+func TestSummarizeReplies(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		sent    int
+		replies []udpReply
+		want    models.PacketLossResult
+	}{
+		{
+			name:    "all in order",
+			sent:    3,
+			replies: []udpReply{{0, 10}, {1, 12}, {2, 10}},
+			want:    models.PacketLossResult{Sent: 3, Received: 3, Jitter: 2},
+		},
+		{
+			name:    "lost",
+			sent:    4,
+			replies: []udpReply{{0, 10}, {3, 10}},
+			want:    models.PacketLossResult{Sent: 4, Received: 2, LossPercent: 50},
+		},
+		{
+			name:    "none received",
+			sent:    2,
+			replies: nil,
+			want:    models.PacketLossResult{Sent: 2, LossPercent: 100},
+		},
+		{
+			// Jitter follows the sequence, not the arrival order
+			name:    "reordered",
+			sent:    4,
+			replies: []udpReply{{0, 10}, {2, 14}, {1, 12}, {3, 16}},
+			want:    models.PacketLossResult{Sent: 4, Received: 4, Reordered: 1, Jitter: 2},
+		},
+		{
+			name:    "duplicated",
+			sent:    2,
+			replies: []udpReply{{0, 10}, {0, 30}, {1, 11}},
+			want:    models.PacketLossResult{Sent: 2, Received: 2, Duplicates: 1, Jitter: 1},
+		},
+		{
+			name:    "sequence out of range",
+			sent:    2,
+			replies: []udpReply{{0, 10}, {1, 10}, {7, 50}},
+			want:    models.PacketLossResult{Sent: 2, Received: 2},
+		},
+	} {
+		got := summarizeReplies(tc.sent, tc.replies)
+		if got.Sent != tc.want.Sent || got.Received != tc.want.Received || got.Reordered != tc.want.Reordered ||
+			got.Duplicates != tc.want.Duplicates || math.Abs(got.LossPercent-tc.want.LossPercent) > 1e-9 ||
+			math.Abs(got.Jitter-tc.want.Jitter) > 1e-9 {
+			t.Errorf("%s: summarized as %+v; want %+v", tc.name, *got, tc.want)
+		}
+	}
+}
+
+// lossyRelay forwards probe datagrams to the responder at target, dropping
+// those whose sequence number drop returns true and holding back sequence
+// number held until the one after it has been forwarded. Replies are relayed
+// back unchanged.
+func lossyRelay(t *testing.T, target string, drop func(seq uint32) bool, held uint32) string {
+	t.Helper()
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := net.Dial("udp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		upstream.Close()
+	})
+
+	peer := make(chan net.Addr, 1)
+	go func() {
+		buf := make([]byte, udpMaxPacketSize)
+		var holding []byte
+		for {
+			n, addr, err := client.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case peer <- addr:
+			default:
+			}
+			seq := binary.BigEndian.Uint32(buf[4:8])
+			switch {
+			case drop(seq):
+			case seq == held:
+				holding = append([]byte(nil), buf[:n]...)
+			default:
+				upstream.Write(buf[:n])
+				if seq == held+1 && holding != nil {
+					upstream.Write(holding)
+				}
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, udpMaxPacketSize)
+		addr := <-peer
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				return
+			}
+			client.WriteTo(buf[:n], addr)
+		}
+	}()
+	return client.LocalAddr().String()
+}
+
+func TestMeasurePacketLossThroughResponder(t *testing.T) {
+	responder, err := ListenUDPEcho("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close()
+	go responder.Serve()
+
+	// Every tenth datagram is lost and the fifth overtaken by the sixth
+	relay := lossyRelay(t, responder.Addr().String(), func(seq uint32) bool { return seq%10 == 3 }, 5)
+
+	service := NewSpeedTestService(nil, nil, NewInMemoryTestServerRegistry())
+	if err := service.SetPacketLossConfig(PacketLossConfig{Rate: 1000, Count: 50, PacketSize: 64}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := service.measurePacketLoss(context.Background(), TestServer{ID: "local", UDPEchoAddress: relay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Sent != 50 || result.Received != 45 || result.LossPercent != 10 || result.Reordered != 1 || result.Duplicates != 0 {
+		t.Fatalf("measured %+v", *result)
+	}
+}
@@ -0,0 +1,317 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/measure"
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+const (
+	// browserPingCount is the number of ping/pong round trips in the latency phase
+	browserPingCount = 10
+
+	// browserPingTimeout bounds the wait for a single pong
+	browserPingTimeout = 2 * time.Second
+
+	// browserMinFrameSize and browserMaxFrameSize bound the binary frames sent
+	// during the download phase. Frames start small and double as data flows.
+	browserMinFrameSize = 8 * 1024
+	browserMaxFrameSize = 1 << 20
+
+	// browserWriteSlack is how long a write may block past the phase deadline
+	browserWriteSlack = 5 * time.Second
+
+	// BrowserReadLimit is the largest message a browser client may send
+	BrowserReadLimit = 4 << 20
+)
+
+// Types of messages exchanged with a browser client
+const (
+	browserMessagePhase       = "phase"
+	browserMessagePing        = "ping"
+	browserMessagePong        = "pong"
+	browserMessageMeasurement = "measurement"
+	browserMessageResult      = "result"
+	browserMessageError       = "error"
+)
+
+// selfServer identifies this backend as the server of browser-driven tests
+var selfServer = models.TestServerInfo{ID: "self", Name: "This server"}
+
+// browserMessage is a JSON text message of the browser test protocol
+type browserMessage struct {
+	Type       string                  `json:"type"`
+	Phase      string                  `json:"phase,omitempty"`
+	Seq        int                     `json:"seq,omitempty"`
+	DurationMs float64                 `json:"duration_ms,omitempty"`
+	ElapsedMs  float64                 `json:"elapsed_ms,omitempty"`
+	Bytes      int64                   `json:"bytes,omitempty"`
+	Mbps       float64                 `json:"mbps,omitempty"`
+	Result     *models.SpeedTestResult `json:"result,omitempty"`
+	Error      string                  `json:"error,omitempty"`
+}
+
+// browserSession runs a browser-driven speed test over one WebSocket.
+//
+// The server drives the test. It announces each phase with a "phase"
+// message. In the latency phase it sends "ping" messages that the client
+// echoes back as "pong" with the same seq. In the download phase it sends
+// binary frames, and in the upload phase the client sends binary frames until
+// the next message arrives. Both throughput phases report progress with
+// "measurement" messages. The test ends with a "result" or "error" message.
+type browserSession struct {
+	conn    *websocket.Conn
+	cfg     ThroughputConfig
+	payload []byte
+	uploads *measure.Meter
+	pongs   chan int
+}
+
+// RunBrowserTest runs a browser-driven speed test over conn and saves the
+// result. The connection is not closed.
+func (s *SpeedTestService) RunBrowserTest(ctx context.Context, conn *websocket.Conn, userID string, ipInfo map[string]string) (*models.SpeedTestResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	session := &browserSession{
+		conn:    conn,
+		cfg:     s.throughput,
+		payload: make([]byte, browserMaxFrameSize),
+		uploads: &measure.Meter{},
+		pongs:   make(chan int, browserPingCount),
+	}
+	rand.Read(session.payload)
+
+	// A failed read means the client went away, which ends the test
+	go func() {
+		session.readLoop()
+		cancel()
+	}()
+
+	result, err := session.run(ctx)
+	if err != nil {
+		session.writeMessage(browserMessage{Type: browserMessageError, Error: err.Error()})
+		return nil, err
+	}
+
+	result.ID = fmt.Sprintf("%d", time.Now().UnixNano())
+	result.UserID = userID
+	result.ISP = ipInfo["isp"]
+	result.IPAddress = ipInfo["ip"]
+	result.Country = ipInfo["country"]
+	result.Region = ipInfo["region"]
+	result.Server = selfServer
+	result.TestType = models.TestTypeBrowser
+	result.CreatedAt = time.Now()
+
+	// Save the result to the database
+	if err := s.speedTestRepo.SaveResult(ctx, result); err != nil {
+		session.writeMessage(browserMessage{Type: browserMessageError, Error: "failed to save result"})
+		return result, err
+	}
+
+	session.writeMessage(browserMessage{Type: browserMessageResult, Result: result})
+	session.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return result, nil
+}
+
+// run executes the latency, download and upload phases in order
+func (b *browserSession) run(ctx context.Context) (*models.SpeedTestResult, error) {
+	latency, err := b.measureLatency(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("latency phase failed: %w", err)
+	}
+	download, err := b.measureDownload(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("download phase failed: %w", err)
+	}
+	upload, err := b.measureUpload(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("upload phase failed: %w", err)
+	}
+
+	result := &models.SpeedTestResult{
+		DownloadSpeed: download,
+		UploadSpeed:   upload,
+		Provenance: &models.ResultProvenance{
+			Latency:  measured(models.SourcePrimary, MethodWebSocketPing, selfServer.ID),
+			Download: measured(models.SourcePrimary, MethodWebSocket, selfServer.ID),
+			Upload:   measured(models.SourcePrimary, MethodWebSocket, selfServer.ID),
+		},
+	}
+	applyLatency(result, latency)
+	return result, nil
+}
+
+// readLoop consumes client messages until the connection fails. Binary
+// frames count towards the upload phase and pongs are handed to the latency
+// phase.
+func (b *browserSession) readLoop() {
+	for {
+		messageType, r, err := b.conn.NextReader()
+		if err != nil {
+			return
+		}
+
+		// Upload messages are large, so their bytes are counted as they
+		// arrive rather than once the whole message has been read
+		if messageType == websocket.BinaryMessage {
+			if _, err := io.Copy(b.uploads, r); err != nil {
+				return
+			}
+			continue
+		}
+
+		var msg browserMessage
+		if err := json.NewDecoder(r).Decode(&msg); err != nil {
+			continue
+		}
+		if msg.Type == browserMessagePong {
+			select {
+			case b.pongs <- msg.Seq:
+			default:
+			}
+		}
+	}
+}
+
+// measureLatency measures the WebSocket round-trip time with ping messages
+func (b *browserSession) measureLatency(ctx context.Context) (measure.LatencyStats, error) {
+	if err := b.writeMessage(browserMessage{Type: browserMessagePhase, Phase: PhaseLatency}); err != nil {
+		return measure.LatencyStats{}, err
+	}
+
+	var pingTimes []float64
+	for seq := 1; seq <= browserPingCount; seq++ {
+		start := time.Now()
+		if err := b.writeMessage(browserMessage{Type: browserMessagePing, Seq: seq}); err != nil {
+			return measure.LatencyStats{}, err
+		}
+
+		timeout := time.NewTimer(browserPingTimeout)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				timeout.Stop()
+				return measure.LatencyStats{}, ctx.Err()
+			case <-timeout.C:
+				break wait
+			case pong := <-b.pongs:
+				// Ignore late pongs of earlier pings
+				if pong == seq {
+					pingTimes = append(pingTimes, measure.Millis(time.Since(start)))
+					timeout.Stop()
+					break wait
+				}
+			}
+		}
+	}
+
+	if len(pingTimes) < 3 {
+		return measure.LatencyStats{}, fmt.Errorf("not enough successful pings")
+	}
+	return measure.NewLatencyStats(pingTimes), nil
+}
+
+// measureDownload sends binary frames for the phase duration and returns the
+// steady-state speed
+func (b *browserSession) measureDownload(ctx context.Context) (float64, error) {
+	if err := b.writeMessage(browserMessage{Type: browserMessagePhase, Phase: PhaseDownload, DurationMs: measure.Millis(b.cfg.Duration)}); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	deadline := start.Add(b.cfg.Duration)
+	sampler := measure.NewIntervalSampler(start, b.cfg.SampleInterval)
+	frameSize := browserMinFrameSize
+	var sent int64
+
+	for time.Now().Before(deadline) {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+
+		b.conn.SetWriteDeadline(deadline.Add(browserWriteSlack))
+		if err := b.conn.WriteMessage(websocket.BinaryMessage, b.payload[:frameSize]); err != nil {
+			return 0, err
+		}
+		sent += int64(frameSize)
+
+		// Grow frames once enough data has flowed at the current size
+		if frameSize < browserMaxFrameSize && sent >= int64(frameSize)*16 {
+			frameSize *= 2
+		}
+
+		if sample, ok := sampler.Observe(time.Now(), sent); ok {
+			if err := b.writeMeasurement(PhaseDownload, sample, sent); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if sent == 0 {
+		return 0, fmt.Errorf("no data transferred")
+	}
+	return measure.SteadyStateSpeed(sampler.Samples, b.cfg.WarmUp, b.cfg.TrimFraction), nil
+}
+
+// measureUpload lets the client send binary frames for the phase duration and
+// returns the steady-state speed
+func (b *browserSession) measureUpload(ctx context.Context) (float64, error) {
+	base := b.uploads.Total()
+	if err := b.writeMessage(browserMessage{Type: browserMessagePhase, Phase: PhaseUpload, DurationMs: measure.Millis(b.cfg.Duration)}); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	sampler := measure.NewIntervalSampler(start, b.cfg.SampleInterval)
+	ticker := time.NewTicker(b.cfg.SampleInterval)
+	defer ticker.Stop()
+	timeout := time.NewTimer(b.cfg.Duration)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-timeout.C:
+			if b.uploads.Total() == base {
+				return 0, fmt.Errorf("no data received")
+			}
+			return measure.SteadyStateSpeed(sampler.Samples, b.cfg.WarmUp, b.cfg.TrimFraction), nil
+		case now := <-ticker.C:
+			received := b.uploads.Total() - base
+			if sample, ok := sampler.Observe(now, received); ok {
+				if err := b.writeMeasurement(PhaseUpload, sample, received); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+}
+
+// writeMeasurement reports a throughput sample to the client
+func (b *browserSession) writeMeasurement(phase string, sample measure.Sample, total int64) error {
+	return b.writeMessage(browserMessage{
+		Type:      browserMessageMeasurement,
+		Phase:     phase,
+		ElapsedMs: measure.Millis(sample.Elapsed),
+		Bytes:     total,
+		Mbps:      sample.Mbps,
+	})
+}
+
+// writeMessage sends a JSON text message to the client
+func (b *browserSession) writeMessage(msg browserMessage) error {
+	b.conn.SetWriteDeadline(time.Now().Add(browserWriteSlack))
+	return b.conn.WriteJSON(msg)
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/cetinibs/online-speed-test-backend-root/internal/models"
+)
+
+// memoryResults is a speed test repository that keeps results in memory
+type memoryResults struct {
+	mu      sync.Mutex
+	results []*models.SpeedTestResult
+}
+
+func (m *memoryResults) SaveResult(ctx context.Context, result *models.SpeedTestResult) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.results = append(m.results, result)
+	return nil
+}
+
+func (m *memoryResults) GetResultsByUserID(ctx context.Context, userID string) ([]*models.SpeedTestResult, error) {
+	return nil, nil
+}
+
+func (m *memoryResults) GetResultByID(ctx context.Context, id string) (*models.SpeedTestResult, error) {
+	return nil, nil
+}
+
+func (m *memoryResults) DeleteResult(ctx context.Context, id string) error {
+	return nil
+}
+
+// testThroughputConfig keeps the throughput phases of session tests short
+var testThroughputConfig = ThroughputConfig{
+	Duration:       600 * time.Millisecond,
+	WarmUp:         100 * time.Millisecond,
+	SampleInterval: 50 * time.Millisecond,
+	TrimFraction:   0.1,
+}
+
+// serveWebSocket runs test on every WebSocket accepted by a test server
+// offering subprotocols, and returns its ws:// URL and the results
+func serveWebSocket(t *testing.T, subprotocols []string, test func(ctx context.Context, conn *websocket.Conn) (*models.SpeedTestResult, error)) (string, <-chan *models.SpeedTestResult) {
+	t.Helper()
+	results := make(chan *models.SpeedTestResult, 1)
+	upgrader := websocket.Upgrader{Subprotocols: subprotocols}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		result, err := test(r.Context(), conn)
+		if err != nil {
+			t.Errorf("test failed: %v", err)
+		}
+		results <- result
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http"), results
+}
+
+func TestBrowserTestRoundTrip(t *testing.T) {
+	repo := &memoryResults{}
+	service := NewSpeedTestService(repo, nil, NewInMemoryTestServerRegistry())
+	if err := service.SetThroughputConfig(testThroughputConfig); err != nil {
+		t.Fatal(err)
+	}
+	url, results := serveWebSocket(t, nil, func(ctx context.Context, conn *websocket.Conn) (*models.SpeedTestResult, error) {
+		return service.RunBrowserTest(ctx, conn, "user", map[string]string{"ip": "127.0.0.1"})
+	})
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Play the browser: answer pings, take the download and upload until the
+	// result arrives
+	var downloaded, downloadReported int64
+	stopUpload := make(chan struct{})
+	uploadDone := make(chan struct{})
+	var final browserMessage
+	for final.Type == "" {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType == websocket.BinaryMessage {
+			downloaded += int64(len(data))
+			continue
+		}
+		var msg browserMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case msg.Type == browserMessagePing:
+			if err := conn.WriteJSON(browserMessage{Type: browserMessagePong, Seq: msg.Seq}); err != nil {
+				t.Fatal(err)
+			}
+		case msg.Type == browserMessageMeasurement && msg.Phase == PhaseDownload:
+			downloadReported = msg.Bytes
+		case msg.Type == browserMessagePhase && msg.Phase == PhaseUpload:
+			go func() {
+				defer close(uploadDone)
+				frame := make([]byte, 32*1024)
+				for {
+					select {
+					case <-stopUpload:
+						return
+					default:
+					}
+					if conn.WriteMessage(websocket.BinaryMessage, frame) != nil {
+						return
+					}
+				}
+			}()
+		case msg.Type == browserMessageResult || msg.Type == browserMessageError:
+			final = msg
+		}
+	}
+	close(stopUpload)
+	<-uploadDone
+
+	if final.Type != browserMessageResult {
+		t.Fatalf("test ended with %+v", final)
+	}
+	if downloadReported == 0 || downloadReported > downloaded {
+		t.Errorf("server reported %d download bytes; the client received %d", downloadReported, downloaded)
+	}
+	result := <-results
+	if result == nil || result.DownloadSpeed <= 0 || result.UploadSpeed <= 0 || result.Ping <= 0 || result.TestType != models.TestTypeBrowser {
+		t.Fatalf("measured %+v", result)
+	}
+	if result.Provenance.Download.Source != models.SourcePrimary || result.Provenance.Upload.Method != MethodWebSocket {
+		t.Errorf("provenance %+v", result.Provenance)
+	}
+	if len(repo.results) != 1 || repo.results[0] != result {
+		t.Error("the result was not saved")
+	}
+}
+
+func TestBrowserDownloadFailsWithoutData(t *testing.T) {
+	// A phase over before the first frame transfers nothing
+	cfg := testThroughputConfig
+	cfg.Duration = time.Nanosecond
+	cfg.WarmUp = 0
+	url, results := serveWebSocket(t, nil, func(ctx context.Context, conn *websocket.Conn) (*models.SpeedTestResult, error) {
+		b := &browserSession{conn: conn, cfg: cfg, payload: make([]byte, browserMaxFrameSize)}
+		if _, err := b.measureDownload(ctx); err == nil {
+			t.Error("a download without data succeeded")
+		}
+		return nil, nil
+	})
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-results
+}